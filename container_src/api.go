@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// apiVersionPrefix is the root of the versioned route tree
+const apiVersionPrefix = "/v1"
+
+type strictKey struct{}
+
+// strict marks a handler's JSON bodies for strict decoding: unknown fields
+// are rejected rather than ignored. All /v1 routes are strict; the legacy
+// aliases stay lenient because the Worker forwards extra fields to them.
+func strict(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(w, r.WithContext(context.WithValue(r.Context(), strictKey{}, true)))
+	}
+}
+
+func isStrict(r *http.Request) bool {
+	v, _ := r.Context().Value(strictKey{}).(bool)
+	return v
+}
+
+// decodeJSON decodes a request body into v, rejecting unknown fields and
+// trailing data on strict routes
+func decodeJSON(r *http.Request, v any) *apiError {
+	dec := json.NewDecoder(r.Body)
+	if isStrict(r) {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		if bodyTooLarge(err) {
+			return newAPIError(codeSourceTooLarge, "Request body too large")
+		}
+		return newAPIErrorf(codeInvalidRequest, "Invalid JSON payload: %v", err)
+	}
+	if isStrict(r) {
+		if err := dec.Decode(&struct{}{}); err != io.EOF {
+			return newAPIError(codeInvalidRequest, "Invalid JSON payload: unexpected data after the request object")
+		}
+	}
+	return nil
+}
+
+// deprecated serves a legacy unversioned route, pointing clients at its /v1
+// successor with Deprecation and Link headers. Wildcards such as {id} in
+// successor are filled from the request's path, and its query string is
+// kept, so the link names the same resource.
+func deprecated(successor string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		link := wildcardPattern.ReplaceAllStringFunc(successor, func(wildcard string) string {
+			return url.PathEscape(r.PathValue(wildcard[1 : len(wildcard)-1]))
+		})
+		if r.URL.RawQuery != "" {
+			link += "?" + r.URL.RawQuery
+		}
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", link))
+		h(w, r)
+	}
+}
+
+// wildcardPattern matches a path wildcard of a route pattern
+var wildcardPattern = regexp.MustCompile(`\{[A-Za-z_][A-Za-z0-9_]*\}`)
+
+var (
+	audioQualityPattern = regexp.MustCompile(`^[0-9]{1,3}k$`)
+	instanceIDPattern   = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,128}$`)
+)
+
+// validate checks an extraction request before any work is done
+func (req *FFmpegRequest) validate() *apiError {
+	if apiErr := validateSource(req.VideoURL, req.Source); apiErr != nil {
+		return apiErr
+	}
+	if req.Preset != "" && (req.AudioFormat != "" || req.AudioQuality != "") {
+		return newAPIError(codeInvalidRequest, "preset replaces audio_format and audio_quality; set one or the other")
+	}
+	if _, apiErr := outputProfile(req.AudioFormat, req.Preset); apiErr != nil {
+		return apiErr
+	}
+	if req.AudioQuality != "" && !audioQualityPattern.MatchString(req.AudioQuality) {
+		return newAPIError(codeInvalidRequest, "audio_quality must be a bitrate such as 128k or 192k")
+	}
+	if req.InstanceID != "" && !instanceIDPattern.MatchString(req.InstanceID) {
+		return newAPIError(codeInvalidRequest, "instance_id may only contain letters, digits, '.', '_' and '-'")
+	}
+	if _, ok := parsePriority(req.Priority); !ok {
+		return newAPIError(codeInvalidRequest, "priority must be interactive or batch")
+	}
+	return validateCallbackURL(req.CallbackURL)
+}
+
+// validateSource checks that a request names exactly one source to fetch:
+// a video URL or an object in S3-compatible storage
+func validateSource(videoURL string, source *ObjectSource) *apiError {
+	if videoURL == "" && source == nil {
+		return newAPIError(codeInvalidRequest, "video_url or source is required")
+	}
+	if videoURL != "" && source != nil {
+		return newAPIError(codeInvalidRequest, "video_url and source are mutually exclusive")
+	}
+	if source != nil && (source.Bucket == "" || source.Key == "") {
+		return newAPIError(codeInvalidRequest, "source.bucket and source.key are required")
+	}
+	if videoURL != "" {
+		u, err := url.Parse(videoURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return newAPIError(codeInvalidRequest, "video_url must be an absolute http or https URL")
+		}
+	}
+	return nil
+}
+
+// validate checks a base64 upload request before it is decoded
+func (req *UploadBase64Request) validate() *apiError {
+	if req.VideoData == "" {
+		return newAPIError(codeInvalidRequest, "video_data is required")
+	}
+	if _, ok := lookupProfile(req.OutputFormat); !ok {
+		return newAPIErrorf(codeUnsupportedFormat, "Unsupported output format: %s. Supported: %s", req.OutputFormat, profileList())
+	}
+	if req.InstanceId != "" && !instanceIDPattern.MatchString(req.InstanceId) {
+		return newAPIError(codeInvalidRequest, "instance_id may only contain letters, digits, '.', '_' and '-'")
+	}
+	if _, ok := parsePriority(req.Priority); !ok {
+		return newAPIError(codeInvalidRequest, "priority must be interactive or batch")
+	}
+	return validateCallbackURL(req.CallbackURL)
+}
+
+// validateUploadForm checks a parsed multipart upload. On strict routes any
+// field other than video, output_format, instance_id, priority,
+// callback_url and dry_run is rejected.
+func validateUploadForm(r *http.Request) *apiError {
+	if isStrict(r) {
+		for name := range r.MultipartForm.Value {
+			if name != "output_format" && name != "instance_id" && name != "priority" && name != "callback_url" && name != "dry_run" {
+				return newAPIErrorf(codeInvalidRequest, "unknown form field %q", name)
+			}
+		}
+		for name := range r.MultipartForm.File {
+			if name != "video" {
+				return newAPIErrorf(codeInvalidRequest, "unknown form file %q", name)
+			}
+		}
+	}
+	if id := r.FormValue("instance_id"); id != "" && !instanceIDPattern.MatchString(id) {
+		return newAPIError(codeInvalidRequest, "instance_id may only contain letters, digits, '.', '_' and '-'")
+	}
+	if _, ok := parsePriority(r.FormValue("priority")); !ok {
+		return newAPIError(codeInvalidRequest, "priority must be interactive or batch")
+	}
+	if v := r.FormValue("dry_run"); v != "" {
+		if _, err := strconv.ParseBool(v); err != nil {
+			return newAPIError(codeInvalidRequest, "dry_run must be true or false")
+		}
+	}
+	return validateCallbackURL(r.FormValue("callback_url"))
+}
+
+// registerV1Routes mounts the versioned API on router
+func registerV1Routes(router *http.ServeMux) {
+	router.HandleFunc("POST "+apiVersionPrefix+"/extract-audio", extractRoute(strict(idempotent(trackJob(ffmpegHandler)))))
+	router.HandleFunc("POST "+apiVersionPrefix+"/upload", uploadRoute(strict(trackJob(uploadHandler))))
+	router.HandleFunc("POST "+apiVersionPrefix+"/upload-base64", base64Route(strict(trackJob(uploadBase64Handler))))
+	router.HandleFunc("GET "+apiVersionPrefix+"/download/{id}", downloadHandler)
+	router.HandleFunc("HEAD "+apiVersionPrefix+"/download/{id}", downloadHandler)
+	router.HandleFunc("GET "+apiVersionPrefix+"/jobs/{id}", jobHandler)
+	router.HandleFunc("POST "+apiVersionPrefix+"/recipe", extractRoute(strict(trackJob(recipeHandler))))
+	router.HandleFunc("GET "+apiVersionPrefix+"/presets", presetsHandler)
+	router.HandleFunc("POST "+apiVersionPrefix+"/presets", extractRoute(strict(presetsHandler)))
+	router.HandleFunc("GET "+apiVersionPrefix+"/presets/{name}", presetHandler)
+	router.HandleFunc("PUT "+apiVersionPrefix+"/presets/{name}", extractRoute(strict(presetHandler)))
+	router.HandleFunc("DELETE "+apiVersionPrefix+"/presets/{name}", presetHandler)
+	router.HandleFunc("POST "+apiVersionPrefix+"/batch", batchRoute(strict(batchHandler)))
+	router.HandleFunc("GET "+apiVersionPrefix+"/batch/{id}", batchStatusHandler)
+	router.HandleFunc("GET "+apiVersionPrefix+"/capabilities", capabilitiesHandler)
+	router.HandleFunc("GET "+apiVersionPrefix+"/openapi.json", openAPIHandler)
+}
+
+// registerLegacyRoutes mounts the original unversioned routes as deprecated
+// aliases of their /v1 successors
+func registerLegacyRoutes(router *http.ServeMux) {
+	router.HandleFunc("/ffmpeg/extract-audio", deprecated(apiVersionPrefix+"/extract-audio", extractRoute(idempotent(trackJob(ffmpegHandler)))))
+	router.HandleFunc("/ffmpeg/upload", deprecated(apiVersionPrefix+"/upload", uploadRoute(trackJob(uploadHandler))))
+	router.HandleFunc("/ffmpeg/upload-base64", deprecated(apiVersionPrefix+"/upload-base64", base64Route(trackJob(uploadBase64Handler))))
+	router.HandleFunc("/download/{id}", deprecated(apiVersionPrefix+"/download/{id}", downloadHandler))
+}
+
+// Body and time limits shared by each processing route and its legacy alias.
+// Timeouts bound the request context, which FFmpeg runs inherit; body limits
+// cover the largest valid payload plus form overhead.
+func extractRoute(h http.HandlerFunc) http.HandlerFunc {
+	return withLimits(cfg.Server.ExtractRouteTimeout.std(), cfg.Limits.MaxJSONBodyBytes, h)
+}
+
+func batchRoute(h http.HandlerFunc) http.HandlerFunc {
+	return withLimits(cfg.Server.ExtractRouteTimeout.std(), cfg.Limits.MaxJSONBodyBytes*int64(cfg.Batch.MaxItems), h)
+}
+
+func uploadRoute(h http.HandlerFunc) http.HandlerFunc {
+	return withLimits(cfg.Server.UploadRouteTimeout.std(), cfg.Limits.MaxUploadBytes+1024*1024, h)
+}
+
+func base64Route(h http.HandlerFunc) http.HandlerFunc {
+	return withLimits(cfg.Server.UploadRouteTimeout.std(), cfg.Limits.MaxBase64UploadBytes/3*4+1024*1024, h)
+}
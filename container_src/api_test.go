@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLegacyRoutesLinkToTheirSuccessor(t *testing.T) {
+	setupTestEnv(t)
+	router := http.NewServeMux()
+	registerLegacyRoutes(router)
+
+	tests := []struct {
+		method, path string
+		link         string
+	}{
+		{http.MethodGet, "/download/3f2a9c?expires=1700000000&sig=abc", `</v1/download/3f2a9c?expires=1700000000&sig=abc>; rel="successor-version"`},
+		{http.MethodGet, "/download/a%20b", `</v1/download/a%20b>; rel="successor-version"`},
+		{http.MethodGet, "/ffmpeg/extract-audio", `</v1/extract-audio>; rel="successor-version"`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if got := rec.Header().Get("Link"); got != tt.link {
+			t.Errorf("%s %s: Link %s, want %s", tt.method, tt.path, got, tt.link)
+		}
+		if rec.Header().Get("Deprecation") != "true" {
+			t.Errorf("%s %s: no Deprecation header", tt.method, tt.path)
+		}
+	}
+}
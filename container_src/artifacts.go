@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// artifact is a finished output that can be downloaded through a signed URL.
+// Clients only ever see the opaque ID; the path stays server-side.
+type artifact struct {
+	ID       string
+	Path     string
+	Profile  audioProfile
+	Expires  time.Time
+	ETag     string    // strong ETag from the content hash, "" if unreadable
+	Modified time.Time // Last-Modified, fixed when the output is registered
+}
+
+// artifactRegistry maps opaque artifact IDs to files and signs download URLs
+type artifactRegistry struct {
+	mu     sync.Mutex
+	byID   map[string]*artifact
+	key    []byte
+	urlTTL time.Duration
+}
+
+var (
+	errArtifactNotFound = errors.New("artifact not found")
+	errInvalidSignature = errors.New("invalid download signature")
+	errSignatureExpired = errors.New("download link expired")
+)
+
+// artifacts is the process-wide artifact registry
+var artifacts *artifactRegistry
+
+// newArtifactRegistryFromConfig signs with storage.download_signing_key, or a
+// random key when unset (links then stop working on restart, as do the files
+// behind them). storage.download_url_ttl bounds how long a link stays valid.
+func newArtifactRegistryFromConfig() *artifactRegistry {
+	key := []byte(cfg.Storage.DownloadSigningKey)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			panic(fmt.Sprintf("failed to generate download signing key: %v", err))
+		}
+		slog.Warn("DOWNLOAD_SIGNING_KEY not set, using a random per-process key")
+	}
+
+	return &artifactRegistry{
+		byID:   make(map[string]*artifact),
+		key:    key,
+		urlTTL: cfg.Storage.DownloadURLTTL.std(),
+	}
+}
+
+// register records a finished output that lives until expires and returns
+// its artifact
+func (a *artifactRegistry) register(path string, p audioProfile, expires time.Time) *artifact {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(fmt.Sprintf("failed to generate artifact ID: %v", err))
+	}
+
+	art := &artifact{
+		ID:       hex.EncodeToString(id),
+		Path:     path,
+		Profile:  p,
+		Expires:  expires,
+		Modified: time.Now().UTC(),
+	}
+	// The ETag and Last-Modified are taken once here rather than from the
+	// file on each download: a cached output shares its inode with the
+	// cache, so its metadata is not a stable identity
+	if sum, err := hashFile(path); err == nil {
+		art.ETag = `"` + strings.TrimPrefix(sum, "sha256:") + `"`
+	} else {
+		slog.Warn("Failed to hash output for its ETag", "path", path, "error", err)
+	}
+	if info, err := os.Stat(path); err == nil {
+		art.Modified = info.ModTime().UTC()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// Drop entries whose files the janitor has already expired
+	now := time.Now()
+	for id, existing := range a.byID {
+		if now.After(existing.Expires) {
+			delete(a.byID, id)
+		}
+	}
+	a.byID[art.ID] = art
+	return art
+}
+
+// signedURL returns a download URL for an artifact that expires with the
+// artifact or after the URL TTL, whichever comes first
+func (a *artifactRegistry) signedURL(art *artifact) string {
+	expires := time.Now().Add(a.urlTTL)
+	if art.Expires.Before(expires) {
+		expires = art.Expires
+	}
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	q := url.Values{}
+	q.Set("expires", exp)
+	q.Set("sig", a.sign(art.ID, exp))
+	return fmt.Sprintf("%s/download/%s?%s", apiVersionPrefix, art.ID, q.Encode())
+}
+
+func (a *artifactRegistry) sign(id, expires string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(id + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// resolve verifies a signed download request and returns its artifact
+func (a *artifactRegistry) resolve(id, expires, sig string) (*artifact, error) {
+	if id == "" || expires == "" || sig == "" {
+		return nil, errInvalidSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(a.sign(id, expires))) {
+		return nil, errInvalidSignature
+	}
+
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, errInvalidSignature
+	}
+	if time.Now().Unix() > exp {
+		return nil, errSignatureExpired
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	art, ok := a.byID[id]
+	if !ok {
+		return nil, errArtifactNotFound
+	}
+	if _, err := os.Stat(art.Path); err != nil {
+		delete(a.byID, id)
+		return nil, errArtifactNotFound
+	}
+	return art, nil
+}
+
+// lookup returns the artifact behind a download URL this registry signed,
+// or nil once its file is gone or has expired
+func (a *artifactRegistry) lookup(downloadURL string) *artifact {
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		return nil
+	}
+	id := strings.TrimPrefix(u.Path, apiVersionPrefix+"/download/")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	art, ok := a.byID[id]
+	if !ok || time.Now().After(art.Expires) {
+		return nil
+	}
+	if _, err := os.Stat(art.Path); err != nil {
+		return nil
+	}
+	return art
+}
+
+// publishOutput starts a finished output's TTL and returns a signed download
+// URL for it
+func publishOutput(path string, p audioProfile) string {
+	expires := tempFiles.trackOutput(path)
+	return artifacts.signedURL(artifacts.register(path, p, expires))
+}
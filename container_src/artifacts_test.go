@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedQuery splits a download URL from signedURL into its artifact ID,
+// expiry and signature
+func signedQuery(t *testing.T, downloadURL string) (id, expires, sig string) {
+	t.Helper()
+	u, err := url.Parse(downloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimPrefix(u.Path, apiVersionPrefix+"/download/"), u.Query().Get("expires"), u.Query().Get("sig")
+}
+
+func TestArtifactResolve(t *testing.T) {
+	setupTestEnv(t)
+	publish := func(name string) string {
+		path := filepath.Join(cfg.Storage.ProcessingDir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return publishOutput(path, audioProfiles["mp3"])
+	}
+	id, expires, sig := signedQuery(t, publish("a.mp3"))
+	otherID, otherExpires, otherSig := signedQuery(t, publish("b.mp3"))
+	gone, goneExpires, goneSig := signedQuery(t, publish("c.mp3"))
+	os.Remove(filepath.Join(cfg.Storage.ProcessingDir, "c.mp3"))
+
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	later := strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10)
+	tampered := []byte(sig)
+	tampered[0] ^= 1
+
+	tests := []struct {
+		name             string
+		id, expires, sig string
+		want             error
+	}{
+		{"valid", id, expires, sig, nil},
+		{"tampered signature", id, expires, string(tampered), errInvalidSignature},
+		{"missing signature", id, expires, "", errInvalidSignature},
+		{"extended expiry", id, later, sig, errInvalidSignature},
+		{"expired", id, past, artifacts.sign(id, past), errSignatureExpired},
+		{"unparsable expiry", id, "soon", artifacts.sign(id, "soon"), errInvalidSignature},
+		{"another artifact's signature", id, otherExpires, otherSig, errInvalidSignature},
+		{"signature moved to another artifact", otherID, expires, sig, errInvalidSignature},
+		{"unknown artifact", "0123", later, artifacts.sign("0123", later), errArtifactNotFound},
+		{"file removed", gone, goneExpires, goneSig, errArtifactNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			art, err := artifacts.resolve(tt.id, tt.expires, tt.sig)
+			if !errors.Is(err, tt.want) || (err == nil && art.ID != tt.id) {
+				t.Errorf("resolve() = %v, %v; want %v", art, err, tt.want)
+			}
+		})
+	}
+	if _, ok := artifacts.byID[gone]; ok {
+		t.Error("artifact whose file is gone stayed registered")
+	}
+}
+
+func TestArtifactSignedURLExpiresWithTheFile(t *testing.T) {
+	setupTestEnv(t)
+	art := &artifact{ID: "abc", Expires: time.Now().Add(time.Minute)}
+	_, expires, _ := signedQuery(t, artifacts.signedURL(art))
+	if exp, _ := strconv.ParseInt(expires, 10, 64); exp != art.Expires.Unix() {
+		t.Errorf("link expires at %d, want the artifact's expiry %d", exp, art.Expires.Unix())
+	}
+
+	art.Expires = time.Now().Add(artifacts.urlTTL + time.Hour)
+	_, expires, _ = signedQuery(t, artifacts.signedURL(art))
+	if exp, _ := strconv.ParseInt(expires, 10, 64); exp > time.Now().Add(artifacts.urlTTL).Unix() {
+		t.Errorf("link expires at %d, past the URL TTL", exp)
+	}
+}
+
+func TestDownloadRejectsBadLinks(t *testing.T) {
+	setupTestEnv(t)
+	path := filepath.Join(cfg.Storage.ProcessingDir, "a.mp3")
+	if err := os.WriteFile(path, []byte("mp3 data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	downloadURL := publishOutput(path, audioProfiles["mp3"])
+	id, expires, sig := signedQuery(t, downloadURL)
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	link := func(id, expires, sig string) string {
+		return apiVersionPrefix + "/download/" + id + "?" + url.Values{"expires": {expires}, "sig": {sig}}.Encode()
+	}
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		code   string
+	}{
+		{"valid", downloadURL, http.StatusOK, ""},
+		{"tampered signature", link(id, expires, strings.Repeat("0", len(sig))), http.StatusForbidden, codeInvalidSignature},
+		{"expired", link(id, past, artifacts.sign(id, past)), http.StatusForbidden, codeLinkExpired},
+		{"mismatched artifact", link("0123", expires, sig), http.StatusForbidden, codeInvalidSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := download(t, tt.url, nil)
+			if rec.Code != tt.status || (tt.code != "" && !strings.Contains(rec.Body.String(), tt.code)) {
+				t.Errorf("download answered %d: %s; want %d %s", rec.Code, rec.Body, tt.status, tt.code)
+			}
+		})
+	}
+}
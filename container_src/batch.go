@@ -0,0 +1,537 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// batchDir is the subdirectory of the journal directory holding batch records
+const batchDir = "batches"
+
+// BatchRequest is the JSON body of /v1/batch
+type BatchRequest struct {
+	Defaults    FFmpegRequest   `json:"defaults" doc:"Fields applied to every item that leaves them empty: instance_id, priority, audio_format, audio_quality, preset and callback_url"`
+	Items       []FFmpegRequest `json:"items" openapi:"required" doc:"One extraction request per source"`
+	Concurrency int             `json:"concurrency,omitempty" doc:"Items processed at once; at most, and by default, BATCH_MAX_CONCURRENCY"`
+	Zip         bool            `json:"zip,omitempty" doc:"Package every output in one ZIP once all items have finished"`
+}
+
+// batchState is a batch as reported by GET /v1/batch/{id}
+type batchState struct {
+	ID        string      `json:"id" openapi:"required"`
+	Status    string      `json:"status" openapi:"required" doc:"running, succeeded, partial or failed"`
+	Total     int         `json:"total"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+	Items     []batchItem `json:"items"`
+	Zip       *batchZip   `json:"zip,omitempty"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// batchItem is the outcome of one item, which runs as its own job
+type batchItem struct {
+	Index    int             `json:"index"`
+	JobID    string          `json:"job_id,omitempty"`
+	Status   jobStatus       `json:"status" doc:"queued, running, succeeded or failed"`
+	Response *FFmpegResponse `json:"response,omitempty"`
+}
+
+// batchZip is the archive of a batch's outputs
+type batchZip struct {
+	Status      string `json:"status" doc:"pending, ready or failed"`
+	FileName    string `json:"file_name,omitempty"`
+	DownloadURL string `json:"download_url,omitempty"`
+	Bytes       int64  `json:"bytes,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// zipProfile lets a batch archive be published like an audio output
+var zipProfile = audioProfile{Name: "zip", Extension: "zip", ContentType: "application/zip"}
+
+// batchRegistry runs batches and keeps their state, persisted as one JSON
+// file per batch so status survives a restart
+type batchRegistry struct {
+	mu        sync.Mutex
+	ctx       context.Context // canceled at shutdown
+	dir       string
+	byID      map[string]*batchState
+	retention time.Duration
+}
+
+// batches is the process-wide batch registry
+var batches *batchRegistry
+
+// newBatchRegistryFromConfig loads the batches of earlier runs. Batches run
+// under ctx, and finished ones are kept as long as jobs (storage.job_retention,
+// or the artifact TTL when the job journal is disabled).
+func newBatchRegistryFromConfig(ctx context.Context) *batchRegistry {
+	retention := cfg.Storage.JobRetention.std()
+	if retention == 0 {
+		retention = cfg.Storage.ArtifactTTL.std()
+	}
+	b := &batchRegistry{
+		ctx:       ctx,
+		dir:       filepath.Join(cfg.Storage.ProcessingDir, journalDir, batchDir),
+		byID:      make(map[string]*batchState),
+		retention: retention,
+	}
+	if err := os.MkdirAll(b.dir, 0755); err != nil {
+		slog.Warn("Batch records will not survive a restart", "error", err)
+		return b
+	}
+
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		slog.Warn("Failed to read batch records", "error", err)
+		return b
+	}
+	for _, e := range entries {
+		path := filepath.Join(b.dir, e.Name())
+		if !strings.HasSuffix(e.Name(), ".json") {
+			os.Remove(path) // interrupted save
+			continue
+		}
+		data, err := os.ReadFile(path)
+		var st batchState
+		if err == nil {
+			err = json.Unmarshal(data, &st)
+		}
+		if err != nil || st.ID == "" {
+			slog.Warn("Dropping unreadable batch record", "file", e.Name(), "error", err)
+			os.Remove(path)
+			continue
+		}
+		if st.Status != "running" && time.Since(st.UpdatedAt) > retention {
+			os.Remove(path)
+			continue
+		}
+		b.byID[st.ID] = &st
+		if st.Status == "running" {
+			b.interruptLocked(&st)
+		}
+	}
+	slog.Info("Batch registry ready", "batches", len(b.byID))
+	return b
+}
+
+// interruptLocked fails the items a previous process left unfinished
+func (b *batchRegistry) interruptLocked(st *batchState) {
+	for i := range st.Items {
+		if item := &st.Items[i]; !item.Status.final() {
+			item.Status = jobFailed
+			item.Response = &FFmpegResponse{Code: codeInterrupted, Error: "The container restarted before the item finished; submit it again"}
+		}
+	}
+	if st.Zip != nil && st.Zip.Status == "pending" {
+		st.Zip.Status, st.Zip.Error = "failed", "The container restarted before the archive was built"
+	}
+	b.updateLocked(st)
+}
+
+// updateLocked recounts a batch's items, derives its status and saves it
+func (b *batchRegistry) updateLocked(st *batchState) {
+	st.Succeeded, st.Failed = 0, 0
+	for _, item := range st.Items {
+		switch item.Status {
+		case jobSucceeded:
+			st.Succeeded++
+		case jobFailed:
+			st.Failed++
+		}
+	}
+	switch {
+	case st.Succeeded+st.Failed < st.Total || (st.Zip != nil && st.Zip.Status == "pending"):
+		st.Status = "running"
+	case st.Failed == 0:
+		st.Status = "succeeded"
+	case st.Succeeded == 0:
+		st.Status = "failed"
+	default:
+		st.Status = "partial"
+	}
+	st.UpdatedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err == nil {
+		path := filepath.Join(b.dir, st.ID+".json")
+		if err = os.WriteFile(path+".tmp", data, 0644); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		slog.Warn("Failed to save batch record", "batch_id", st.ID, "error", err)
+	}
+}
+
+// get returns a copy of the batch's state
+func (b *batchRegistry) get(id string) (batchState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st, ok := b.byID[id]
+	if !ok {
+		return batchState{}, false
+	}
+	copied := *st
+	copied.Items = append([]batchItem(nil), st.Items...)
+	if st.Zip != nil {
+		archive := *st.Zip
+		copied.Zip = &archive
+	}
+	return copied, true
+}
+
+// start records a new batch and runs its items in the background
+func (b *batchRegistry) start(items []FFmpegRequest, concurrency int, wantZip bool) batchState {
+	now := time.Now().UTC()
+	st := &batchState{ID: "batch_" + newRequestID()[:16], Total: len(items), Items: make([]batchItem, len(items)), CreatedAt: now}
+	for i := range st.Items {
+		st.Items[i] = batchItem{Index: i, Status: jobQueued}
+	}
+	if wantZip {
+		st.Zip = &batchZip{Status: "pending"}
+	}
+
+	b.mu.Lock()
+	b.pruneLocked()
+	b.byID[st.ID] = st
+	b.updateLocked(st)
+	b.mu.Unlock()
+
+	// The batch counts as an active job until its last item and archive are
+	// done, so a drain waits for it even between items
+	health.activeJobs.Add(1)
+	go func() {
+		defer health.activeJobs.Add(-1)
+		b.run(st.ID, items, concurrency, wantZip)
+	}()
+	state, _ := b.get(st.ID)
+	return state
+}
+
+// pruneLocked forgets finished batches older than the retention
+func (b *batchRegistry) pruneLocked() {
+	for id, st := range b.byID {
+		if st.Status != "running" && time.Since(st.UpdatedAt) > b.retention {
+			delete(b.byID, id)
+			os.Remove(filepath.Join(b.dir, id+".json"))
+		}
+	}
+}
+
+// setItem updates one item under the lock and saves the batch
+func (b *batchRegistry) setItem(id string, index int, update func(*batchItem)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st, ok := b.byID[id]; ok {
+		update(&st.Items[index])
+		b.updateLocked(st)
+	}
+}
+
+// run processes a batch's items at most concurrency at a time, then builds
+// its archive if one was requested
+func (b *batchRegistry) run(id string, items []FFmpegRequest, concurrency int, wantZip bool) {
+	ctx := withLogAttrs(b.ctx, slog.String("batch_id", id))
+	slog.InfoContext(ctx, "Batch started", "items", len(items), "concurrency", concurrency)
+
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, item := range items {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			b.setItem(id, i, func(it *batchItem) {
+				it.Status = jobFailed
+				it.Response = &FFmpegResponse{Code: codeDraining, Error: "Server shut down before the item started; submit it again"}
+			})
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			b.runItem(withLogAttrs(ctx, slog.Int("batch_item", i)), id, i, item)
+		}()
+	}
+	wg.Wait()
+
+	if wantZip {
+		b.buildZip(ctx, id)
+	}
+	st, _ := b.get(id)
+	slog.InfoContext(ctx, "Batch finished", "status", st.Status, "succeeded", st.Succeeded, "failed", st.Failed)
+}
+
+// batchItemHandler is the extraction handler as the versioned route runs it
+var batchItemHandler = strict(trackJob(ffmpegHandler))
+
+// runItem runs one item through the extraction handler in-process, so it is
+// queued, journaled and cached exactly like a request to /v1/extract-audio.
+// An item refused because the queue is full waits and tries again, up to
+// batch.queue_retries times. Only the attempt that is kept stays in the
+// journal; the refused ones before it are discarded.
+func (b *batchRegistry) runItem(ctx context.Context, id string, index int, item FFmpegRequest) {
+	body, _ := json.Marshal(item)
+	b.setItem(id, index, func(it *batchItem) { it.Status = jobRunning })
+
+	for attempt := 0; ; attempt++ {
+		itemCtx, cancel := context.WithTimeout(ctx, cfg.Server.ExtractRouteTimeout.std())
+		req, _ := http.NewRequestWithContext(itemCtx, http.MethodPost, apiVersionPrefix+"/extract-audio", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := &batchItemWriter{header: http.Header{}}
+		batchItemHandler(rec, req)
+		cancel()
+
+		var resp FFmpegResponse
+		if err := json.Unmarshal(rec.body.Bytes(), &resp); err != nil {
+			resp = FFmpegResponse{Code: codeInternal, Error: fmt.Sprintf("Unreadable item response: %v", err)}
+		}
+		if resp.Code == codeQueueFull && attempt < cfg.Batch.QueueRetries {
+			slog.InfoContext(ctx, "Job queue full, retrying batch item", "item", index, "attempt", attempt+1, "retry_in", cfg.Workers.RetryAfter.std().String())
+			timer := time.NewTimer(cfg.Workers.RetryAfter.std())
+			select {
+			case <-timer.C:
+				journal.discard(rec.header.Get("X-Job-ID"))
+				continue
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+
+		b.setItem(id, index, func(it *batchItem) {
+			it.JobID = rec.header.Get("X-Job-ID")
+			it.Status = jobFailed
+			if resp.Success {
+				it.Status = jobSucceeded
+			}
+			it.Response = &resp
+		})
+		return
+	}
+}
+
+// buildZip packages the outputs of every succeeded item and publishes the
+// archive through a signed download URL
+func (b *batchRegistry) buildZip(ctx context.Context, id string) {
+	st, _ := b.get(id)
+	fail := func(err error) {
+		slog.WarnContext(ctx, "Failed to build batch archive", "error", err)
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if st, ok := b.byID[id]; ok {
+			st.Zip = &batchZip{Status: "failed", Error: err.Error()}
+			b.updateLocked(st)
+		}
+	}
+
+	if ctx.Err() != nil {
+		fail(fmt.Errorf("server shut down before the archive was built"))
+		return
+	}
+
+	var files []string
+	var names []string
+	var total int64
+	for _, item := range st.Items {
+		if item.Status != jobSucceeded || item.Response == nil || item.Response.FileName == "" {
+			continue
+		}
+		path := filepath.Join(cfg.Storage.ProcessingDir, filepath.Base(item.Response.FileName))
+		info, err := os.Stat(path)
+		if err != nil {
+			fail(fmt.Errorf("output of item %d is no longer available", item.Index))
+			return
+		}
+		files = append(files, path)
+		names = append(names, fmt.Sprintf("%03d_%s", item.Index, filepath.Base(path)))
+		total += info.Size()
+	}
+	if len(files) == 0 {
+		fail(fmt.Errorf("no item produced an output"))
+		return
+	}
+	if err := tempFiles.admit(total); err != nil {
+		fail(err)
+		return
+	}
+
+	path := filepath.Join(cfg.Storage.ProcessingDir, id+".zip")
+	tempFiles.trackPending(path)
+	if err := writeZip(path, files, names); err != nil {
+		tempFiles.release(path)
+		fail(err)
+		return
+	}
+	info, _ := os.Stat(path)
+	downloadURL := publishOutput(path, zipProfile)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st, ok := b.byID[id]; ok {
+		st.Zip = &batchZip{Status: "ready", FileName: filepath.Base(path), DownloadURL: downloadURL, Bytes: info.Size()}
+		b.updateLocked(st)
+	}
+}
+
+// writeZip stores files in a new archive at path. Audio codecs do not
+// compress further, so entries are stored rather than deflated.
+func writeZip(path string, files, names []string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(out)
+	for i, file := range files {
+		if err = addZipEntry(zw, file, names[i]); err != nil {
+			break
+		}
+	}
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func addZipEntry(zw *zip.Writer, file, name string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// batchItemWriter captures the response of an item run in-process. Interim
+// 1xx responses sent while the item is queued are dropped.
+type batchItemWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *batchItemWriter) Header() http.Header { return w.header }
+
+func (w *batchItemWriter) WriteHeader(status int) {
+	if status >= 200 && w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *batchItemWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.body.Write(b)
+}
+
+// withDefaults fills the fields an item leaves empty from the batch defaults.
+// Items are batch priority unless they ask otherwise.
+func (req FFmpegRequest) withDefaults(d FFmpegRequest) FFmpegRequest {
+	fill := func(v *string, def string) {
+		if *v == "" {
+			*v = def
+		}
+	}
+	fill(&req.InstanceID, d.InstanceID)
+	fill(&req.Priority, d.Priority)
+	fill(&req.Priority, priorityBatch.String())
+	// A preset and an explicit format exclude each other, so the defaults
+	// only supply whichever the item has not chosen
+	if req.AudioFormat == "" && req.AudioQuality == "" {
+		fill(&req.Preset, d.Preset)
+	}
+	if req.Preset == "" {
+		fill(&req.AudioFormat, d.AudioFormat)
+		fill(&req.AudioQuality, d.AudioQuality)
+	}
+	fill(&req.CallbackURL, d.CallbackURL)
+	return req
+}
+
+// batchHandler serves POST /v1/batch: it validates every item up front and
+// answers 202 with the batch, whose progress GET /v1/batch/{id} reports
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if health.draining.Load() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, newAPIError(codeDraining, "Server is shutting down, retry on another instance"))
+		return
+	}
+
+	var req BatchRequest
+	if apiErr := decodeJSON(r, &req); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if len(req.Items) == 0 || len(req.Items) > cfg.Batch.MaxItems {
+		writeError(w, r, newAPIErrorf(codeInvalidRequest, "items must hold between 1 and %d requests", cfg.Batch.MaxItems))
+		return
+	}
+	if req.Concurrency == 0 {
+		req.Concurrency = cfg.Batch.MaxConcurrency
+	}
+	if req.Concurrency < 1 || req.Concurrency > cfg.Batch.MaxConcurrency {
+		writeError(w, r, newAPIErrorf(codeInvalidRequest, "concurrency must be between 1 and %d", cfg.Batch.MaxConcurrency))
+		return
+	}
+
+	if req.Defaults.VideoURL != "" || req.Defaults.Source != nil {
+		writeError(w, r, newAPIError(codeInvalidRequest, "defaults may not set video_url or source; give each item its own"))
+		return
+	}
+	if req.Defaults.UseR2Storage || req.Defaults.DryRun {
+		writeError(w, r, newAPIError(codeInvalidRequest, "defaults may not set use_r2_storage or dry_run; neither is supported in a batch"))
+		return
+	}
+
+	items := make([]FFmpegRequest, len(req.Items))
+	for i, item := range req.Items {
+		items[i] = item.withDefaults(req.Defaults)
+		if items[i].UseR2Storage {
+			writeError(w, r, newAPIErrorf(codeInvalidRequest, "items[%d]: use_r2_storage is not supported in a batch; outputs are returned as download URLs", i))
+			return
+		}
+		if items[i].DryRun {
+			writeError(w, r, newAPIErrorf(codeInvalidRequest, "items[%d]: dry_run is not supported in a batch; send the item to /v1/extract-audio instead", i))
+			return
+		}
+		if apiErr := items[i].validate(); apiErr != nil {
+			writeError(w, r, newAPIErrorf(apiErr.Code, "items[%d]: %s", i, apiErr.Message))
+			return
+		}
+	}
+
+	st := batches.start(items, req.Concurrency, req.Zip)
+	slog.InfoContext(r.Context(), "Batch accepted", "batch_id", st.ID, "items", st.Total)
+	w.Header().Set("Location", apiVersionPrefix+"/batch/"+st.ID)
+	writeJSON(w, http.StatusAccepted, st)
+}
+
+// batchStatusHandler serves GET /v1/batch/{id}
+func batchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	st, ok := batches.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, newAPIError(codeNotFound, "Batch not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
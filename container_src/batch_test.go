@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postBatch sends body to batchHandler
+func postBatch(t *testing.T, body string) (*httptest.ResponseRecorder, batchState) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	batchHandler(rec, httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/batch", strings.NewReader(body)))
+	var st batchState
+	json.Unmarshal(rec.Body.Bytes(), &st)
+	return rec, st
+}
+
+func TestBatchDefaultsMayNotSetSource(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults string
+	}{
+		{"video_url", `{"video_url":"https://example.com/v.mp4"}`},
+		{"source", `{"source":{"bucket":"media","key":"v.mp4"}}`},
+		{"use_r2_storage", `{"use_r2_storage":true}`},
+		{"dry_run", `{"dry_run":true}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnv(t)
+			batches = newBatchRegistryFromConfig(context.Background())
+			rec, _ := postBatch(t, `{"defaults":`+tt.defaults+`,"items":[{"video_url":"https://example.com/a.mp4"}]}`)
+			var resp FFmpegResponse
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if rec.Code != http.StatusBadRequest || resp.Code != codeInvalidRequest || !strings.Contains(resp.Error, "defaults may not set") {
+				t.Errorf("batch answered %d: %s", rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBatchCountsAsActiveJobUntilDone(t *testing.T) {
+	setupTestEnv(t)
+	batches = newBatchRegistryFromConfig(context.Background())
+	video := serveVideo(t)
+	rec, st := postBatch(t, `{"items":[{"video_url":"`+video+`"},{"video_url":"`+video+`"},{"video_url":"`+video+`"}],"concurrency":1,"zip":true}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("batch answered %d: %s", rec.Code, rec.Body.String())
+	}
+	if n := health.activeJobs.Load(); n < 1 {
+		t.Errorf("%d active jobs right after the batch was accepted", n)
+	}
+
+	// A drain waiting for active jobs must see the whole batch through
+	if !health.waitForJobs(10 * time.Second) {
+		t.Fatal("batch never finished")
+	}
+	done, _ := batches.get(st.ID)
+	if done.Status != "succeeded" || done.Zip == nil || done.Zip.Status != "ready" {
+		t.Errorf("drain ended with the batch %s and zip %+v", done.Status, done.Zip)
+	}
+}
+
+func TestBatchQueueFullRetriesAreBounded(t *testing.T) {
+	setupTestEnv(t)
+	cfg.Batch.QueueRetries = 2
+	cfg.Workers.RetryAfter = duration(10 * time.Millisecond)
+	// one busy download slot and no queue refuse every item once it has
+	// been journaled
+	cfg.Workers.DownloadConcurrency, cfg.Workers.QueueSize, cfg.Workers.TenantQueueSize = 1, 0, 0
+	newWorkPoolsFromConfig()
+	release, err := downloadPool.acquire(t.Context(), jobTicket{tenant: "busy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	batches = newBatchRegistryFromConfig(context.Background())
+
+	rec, st := postBatch(t, `{"items":[{"video_url":"`+serveVideo(t)+`"}]}`)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("batch answered %d: %s", rec.Code, rec.Body.String())
+	}
+	if !health.waitForJobs(5 * time.Second) {
+		t.Fatal("batch kept retrying a full queue")
+	}
+
+	done, _ := batches.get(st.ID)
+	item := done.Items[0]
+	if item.Status != jobFailed || item.Response == nil || item.Response.Code != codeQueueFull {
+		t.Fatalf("item = %+v, want failed with %s", item, codeQueueFull)
+	}
+	// the refused attempts before the last are not left in the journal
+	if n := journaledJobs(); n != 1 {
+		t.Errorf("journal holds %d jobs, want only the last attempt", n)
+	}
+	if job, ok := journal.get(item.JobID); !ok || job.Status != jobFailed {
+		t.Errorf("item job %s = %+v, %v", item.JobID, job, ok)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resultCache keeps transcoded outputs keyed by a hash of the source and the
+// normalized transcoding parameters, evicting least recently used entries
+// once the disk budget is exceeded
+type resultCache struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	lru      *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key  string
+	path string
+	size int64
+}
+
+// results is the process-wide result cache; nil when caching is disabled
+var results *resultCache
+
+// newResultCacheFromConfig creates the cache under the processing directory
+// with the storage.cache_max_bytes budget (0 disables the cache)
+func newResultCacheFromConfig() *resultCache {
+	maxBytes := cfg.Storage.CacheMaxBytes
+	if maxBytes == 0 {
+		slog.Info("Result cache disabled")
+		return nil
+	}
+
+	c, err := newResultCache(filepath.Join(cfg.Storage.ProcessingDir, "cache"), maxBytes)
+	if err != nil {
+		slog.Warn("Result cache disabled", "error", err)
+		return nil
+	}
+	return c
+}
+
+// newResultCache opens a cache directory, indexing any entries left by a
+// previous run in the order they were added. Recency is tracked in memory
+// only: cached files share their inode with published outputs, whose
+// modification time must not change.
+func newResultCache(dir string, maxBytes int64) (*resultCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	c := &resultCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %v", err)
+	}
+
+	type existing struct {
+		entry   *cacheEntry
+		modTime time.Time
+	}
+	var found []existing
+	for _, de := range dirEntries {
+		info, err := de.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(de.Name(), ".tmp") {
+			os.Remove(filepath.Join(dir, de.Name())) // interrupted put
+			continue
+		}
+		key := strings.TrimSuffix(de.Name(), filepath.Ext(de.Name()))
+		found = append(found, existing{
+			entry:   &cacheEntry{key: key, path: filepath.Join(dir, de.Name()), size: info.Size()},
+			modTime: info.ModTime(),
+		})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.Before(found[j].modTime) })
+	for _, f := range found {
+		c.entries[f.entry.key] = c.lru.PushFront(f.entry)
+		c.size += f.entry.size
+	}
+
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+
+	slog.Info("Result cache ready", "entries", c.lru.Len(), "bytes", c.size, "max_bytes", c.maxBytes)
+	return c, nil
+}
+
+// cacheKey combines a source identity with normalized transcoding parameters
+func cacheKey(sourceID string, p audioProfile, quality string) string {
+	sum := sha256.Sum256([]byte(sourceID + "\n" + p.normalizedParams(quality)))
+	return hex.EncodeToString(sum[:])
+}
+
+// materialize places a copy of the cached output for key at dst, reporting
+// whether there was a hit. The copy is a hard link where possible so the
+// caller may delete it without affecting the cache.
+func (c *resultCache) materialize(key, dst string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+
+	c.mu.Lock()
+	elem, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return false
+	}
+	entry := elem.Value.(*cacheEntry)
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	if err := linkOrCopy(entry.path, dst); err != nil {
+		slog.Warn("Cache entry unusable, dropping it", "key", key, "error", err)
+		c.remove(key)
+		return false
+	}
+	return true
+}
+
+// contains reports whether key has a cached result
+func (c *resultCache) contains(key string) bool {
+	if c == nil || key == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.entries[key]
+	return ok
+}
+
+// put stores a finished output under key, evicting old entries as needed
+func (c *resultCache) put(key, src string, p audioProfile) {
+	if c == nil || key == "" {
+		return
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		slog.Warn("Not caching result", "path", src, "error", err)
+		return
+	}
+	if info.Size() > c.maxBytes {
+		slog.Info("Not caching result larger than cache budget", "path", src)
+		return
+	}
+
+	path := filepath.Join(c.dir, key+"."+p.Extension)
+	tmp := path + ".tmp"
+	if err := linkOrCopy(src, tmp); err != nil {
+		slog.Warn("Failed to add result to cache", "path", src, "error", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		slog.Warn("Failed to add result to cache", "path", src, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.size -= elem.Value.(*cacheEntry).size
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, path: path, size: info.Size()})
+	c.size += info.Size()
+	c.evictLocked()
+
+	slog.Info("Cached result", "key", key, "bytes", info.Size(), "cache_bytes", c.size, "max_bytes", c.maxBytes)
+}
+
+func (c *resultCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		c.size -= entry.size
+		os.Remove(entry.path)
+	}
+}
+
+// evictLocked removes least recently used entries until the cache fits its budget
+func (c *resultCache) evictLocked() {
+	for c.size > c.maxBytes && c.lru.Len() > 0 {
+		elem := c.lru.Back()
+		entry := elem.Value.(*cacheEntry)
+		c.lru.Remove(elem)
+		delete(c.entries, entry.key)
+		c.size -= entry.size
+		os.Remove(entry.path)
+		slog.Info("Evicted cached result", "key", entry.key, "bytes", entry.size)
+	}
+}
+
+// linkOrCopy hard-links src to dst, falling back to a copy across filesystems
+func linkOrCopy(src, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// hashFile returns a content identity for a local file
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashBytes returns a content identity for in-memory data
+func hashBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// sourceIdentity returns a cheap identity for a remote source without
+// downloading it: the URL or object key plus its ETag. It returns "" when the
+// origin provides no ETag, in which case callers fall back to hashing the bytes.
+func sourceIdentity(ctx context.Context, req FFmpegRequest) string {
+	if req.Source != nil {
+		client, err := newS3ClientFromConfig()
+		if err != nil {
+			return ""
+		}
+		_, etag, err := client.headObject(ctx, *req.Source)
+		if err != nil || etag == "" {
+			return ""
+		}
+		return "s3:" + req.Source.String() + "#" + etag
+	}
+
+	ctx, span := startSpan(ctx, "HEAD source", spanKindClient)
+	defer span.finish()
+	headReq, err := http.NewRequestWithContext(ctx, http.MethodHead, req.VideoURL, nil)
+	if err != nil {
+		return ""
+	}
+	injectTraceparent(ctx, headReq)
+
+	client := &http.Client{Timeout: cfg.Download.HeadTimeout.std()}
+	resp, err := client.Do(headReq)
+	if err != nil {
+		span.fail(err)
+		return ""
+	}
+	resp.Body.Close()
+
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		return ""
+	}
+	return "url:" + req.VideoURL + "#" + etag
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// download fetches a signed download URL through downloadHandler
+func download(t *testing.T, downloadURL string, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, downloadURL, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	router := http.NewServeMux()
+	registerV1Routes(router)
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestCacheHitKeepsPublishedETag(t *testing.T) {
+	setupTestEnv(t)
+
+	path := filepath.Join(cfg.Storage.ProcessingDir, "audio_a.mp3")
+	if err := os.WriteFile(path, []byte("mp3 data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	key := cacheKey("url:http://example.com/v.mp4#\"1\"", audioProfiles["mp3"], "")
+	results.put(key, path, audioProfiles["mp3"])
+	downloadURL := publishOutput(path, audioProfiles["mp3"])
+
+	first := download(t, downloadURL, nil)
+	if first.Code != http.StatusOK {
+		t.Fatalf("download: status %d: %s", first.Code, first.Body)
+	}
+	etag, modified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("download sent ETag %q and Last-Modified %q", etag, modified)
+	}
+
+	// a later cache hit links the same inode to another output
+	if !results.materialize(key, filepath.Join(cfg.Storage.ProcessingDir, "audio_b.mp3")) {
+		t.Fatal("materialize missed")
+	}
+	if info, err := os.Stat(path); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("published output modified at %v after a cache hit, want %v", info.ModTime(), old)
+	}
+
+	again := download(t, downloadURL, http.Header{"If-None-Match": {etag}})
+	if again.Code != http.StatusNotModified {
+		t.Errorf("revalidation after a cache hit: status %d, want 304", again.Code)
+	}
+	ranged := download(t, downloadURL, http.Header{"Range": {"bytes=0-2"}, "If-Range": {etag}})
+	if ranged.Code != http.StatusPartialContent || ranged.Body.String() != "mp3" {
+		t.Errorf("If-Range after a cache hit: status %d body %q, want 206 \"mp3\"", ranged.Code, ranged.Body)
+	}
+	if got := again.Header().Get("ETag"); got != etag {
+		t.Errorf("ETag changed from %s to %s", etag, got)
+	}
+}
+
+func TestCacheETagFollowsContent(t *testing.T) {
+	setupTestEnv(t)
+
+	publish := func(name, content string) string {
+		path := filepath.Join(cfg.Storage.ProcessingDir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rec := download(t, publishOutput(path, audioProfiles["mp3"]), nil)
+		return rec.Header().Get("ETag")
+	}
+	a, b, c := publish("a.mp3", "same"), publish("b.mp3", "same"), publish("c.mp3", "other")
+	if a != b {
+		t.Errorf("identical outputs got ETags %s and %s", a, b)
+	}
+	if a == c {
+		t.Errorf("different outputs share ETag %s", a)
+	}
+}
+
+// cachedKeys lists the cache's keys, most recently used first
+func cachedKeys(c *resultCache) []string {
+	var keys []string
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*cacheEntry).key)
+	}
+	return keys
+}
+
+// cacheOutput writes an output of size bytes modified at mtime for put
+func cacheOutput(t *testing.T, dir, name string, size int, mtime time.Time) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	c, err := newResultCache(filepath.Join(dir, "cache"), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp3 := audioProfiles["mp3"]
+	now := time.Now()
+	c.put("a", cacheOutput(t, dir, "a.mp3", 10, now), mp3)
+	c.put("b", cacheOutput(t, dir, "b.mp3", 10, now), mp3)
+	if !c.materialize("a", filepath.Join(dir, "a-hit.mp3")) {
+		t.Fatal("materialize a missed")
+	}
+	c.put("c", cacheOutput(t, dir, "c.mp3", 10, now), mp3)
+	c.put("huge", cacheOutput(t, dir, "huge.mp3", 30, now), mp3)
+
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true, "huge": false} {
+		if got := c.contains(key); got != want {
+			t.Errorf("contains(%s) = %v, want %v", key, got, want)
+		}
+		if _, err := os.Stat(filepath.Join(c.dir, key+".mp3")); (err == nil) != want {
+			t.Errorf("cache file for %s: %v, want present=%v", key, err, want)
+		}
+	}
+	if c.size != 20 {
+		t.Errorf("cache size = %d, want 20", c.size)
+	}
+	// the hit's copy does not belong to the cache
+	if _, err := os.Stat(filepath.Join(dir, "a-hit.mp3")); err != nil {
+		t.Errorf("materialized copy: %v", err)
+	}
+}
+
+func TestCacheIndexSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := filepath.Join(dir, "cache")
+	c, err := newResultCache(cacheDir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mp3 := audioProfiles["mp3"]
+	start := time.Now().Add(-time.Hour)
+	for i, key := range []string{"oldest", "middle", "newest"} {
+		c.put(key, cacheOutput(t, dir, key+".mp3", 10, start.Add(time.Duration(i)*time.Minute)), mp3)
+	}
+	// recency is not persisted, so this hit is forgotten on restart
+	c.materialize("oldest", filepath.Join(dir, "hit.mp3"))
+	if err := os.WriteFile(filepath.Join(cacheDir, "partial.mp3.tmp"), []byte("cut short"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = newResultCache(cacheDir, 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.contains("oldest") || !c.contains("middle") || !c.contains("newest") || c.size != 20 {
+		t.Errorf("restarted cache holds %v (%d bytes), want middle and newest", cachedKeys(c), c.size)
+	}
+	if _, err := os.Stat(filepath.Join(cacheDir, "partial.mp3.tmp")); !os.IsNotExist(err) {
+		t.Errorf("interrupted put left behind: %v", err)
+	}
+	if got := fmt.Sprint(cachedKeys(c)); got != "[newest middle]" {
+		t.Errorf("recency after restart = %s, want newest first", got)
+	}
+}
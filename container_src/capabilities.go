@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// toolInfo reports whether an external tool is usable and its version
+type toolInfo struct {
+	Available bool   `json:"available"`
+	Version   string `json:"version,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// profileCapability describes one output profile and whether this build of
+// FFmpeg can produce it
+type profileCapability struct {
+	Name           string `json:"name"`
+	Codec          string `json:"codec"`
+	ContentType    string `json:"content_type"`
+	DefaultBitrate string `json:"default_bitrate,omitempty"`
+	SampleRate     string `json:"sample_rate"`
+	Enabled        bool   `json:"enabled"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+}
+
+// serviceLimits are the size and time limits enforced by the handlers
+type serviceLimits struct {
+	MaxBase64UploadBytes  int64 `json:"max_base64_upload_bytes"`
+	MaxUploadBytes        int64 `json:"max_upload_bytes"`
+	MaxDownloadBytes      int64 `json:"max_download_bytes"`
+	MaxInlineAudioBytes   int64 `json:"max_inline_audio_bytes"`
+	UploadTimeoutSeconds  int   `json:"upload_timeout_seconds"`
+	ExtractTimeoutSeconds int   `json:"extract_timeout_seconds"`
+}
+
+// capabilities is the body of GET /capabilities
+type capabilities struct {
+	FFmpeg   toolInfo            `json:"ffmpeg"`
+	YtDlp    toolInfo            `json:"yt_dlp"`
+	Profiles []profileCapability `json:"profiles"`
+	Limits   serviceLimits       `json:"limits"`
+	Features map[string]bool     `json:"features"`
+	Encoders []string            `json:"encoders"`
+	Filters  []string            `json:"filters"`
+	Muxers   []string            `json:"muxers"`
+	ProbedAt time.Time           `json:"probed_at"`
+
+	codecs []string // codecs the encoders produce, which -acodec also accepts
+}
+
+// optionalFilters are FFmpeg filters that optional features depend on
+var optionalFilters = []string{"loudnorm", "silenceremove", "atrim", "showwavespic", "aresample"}
+
+var (
+	capsMu     sync.RWMutex
+	cachedCaps *capabilities
+)
+
+// probeCapabilities inspects the FFmpeg and yt-dlp binaries once at startup,
+// caches the result and disables profiles whose encoder is missing
+func probeCapabilities() {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.FFmpeg.ProbeTimeout.std())
+	defer cancel()
+
+	caps := &capabilities{ProbedAt: time.Now().UTC()}
+
+	caps.FFmpeg = probeVersion(ctx, "ffmpeg", "-hide_banner", "-version")
+	if caps.FFmpeg.Available {
+		caps.Encoders, caps.codecs = probeList(ctx, "-encoders")
+		caps.Filters, _ = probeList(ctx, "-filters")
+		caps.Muxers, _ = probeList(ctx, "-muxers")
+	}
+	caps.YtDlp = probeVersion(ctx, "yt-dlp", "--version")
+
+	// Only disable profiles when we actually got an encoder list; if FFmpeg
+	// is missing every job fails anyway and the profiles say nothing useful
+	if len(caps.Encoders) > 0 {
+		disableProfilesWithout(append(caps.Encoders, caps.codecs...))
+	}
+
+	capsMu.Lock()
+	cachedCaps = caps
+	capsMu.Unlock()
+
+	slog.Info("Capabilities probed", "ffmpeg", caps.FFmpeg.Available, "encoders", len(caps.Encoders),
+		"filters", len(caps.Filters), "muxers", len(caps.Muxers), "yt_dlp", caps.YtDlp.Available)
+}
+
+// probeVersion runs a tool's version command and returns its first line
+func probeVersion(ctx context.Context, name string, args ...string) toolInfo {
+	out, err := exec.CommandContext(ctx, name, args...).Output()
+	if err != nil {
+		return toolInfo{Error: err.Error()}
+	}
+	version, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return toolInfo{Available: true, Version: version}
+}
+
+// probeList runs `ffmpeg -hide_banner <flag>` and returns the names it lists,
+// with the codecs named by rows ending in "(codec <name>)", as an encoder
+// such as libmp3lame does. Encoders, filters and muxers all print a legend
+// followed by rows of "<flags> <name> ..."; legend lines contain " = " and
+// are skipped.
+func probeList(ctx context.Context, flag string) (names, codecs []string) {
+	out, err := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", flag).Output()
+	if err != nil {
+		slog.Warn("FFmpeg probe failed", "flag", flag, "error", err)
+		return nil, nil
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(string(out)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.Contains(line, " = ") || strings.HasSuffix(strings.TrimSpace(line), ":") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.Trim(fields[0], "-") == "" {
+			continue
+		}
+		names = append(names, fields[1])
+		if _, codec, ok := strings.Cut(line, "(codec "); ok {
+			codecs = append(codecs, strings.TrimSuffix(codec, ")"))
+		}
+	}
+	sort.Strings(names)
+	return names, codecs
+}
+
+// filterAvailable reports whether this FFmpeg build has a filter. Without a
+// probed filter list every filter is assumed present and FFmpeg reports any gap.
+func filterAvailable(name string) bool {
+	capsMu.RLock()
+	defer capsMu.RUnlock()
+	if cachedCaps == nil || len(cachedCaps.Filters) == 0 {
+		return true
+	}
+	for _, f := range cachedCaps.Filters {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// disableProfilesWithout disables every profile whose codec no encoder in
+// encoders produces
+func disableProfilesWithout(encoders []string) {
+	available := make(map[string]bool, len(encoders))
+	for _, e := range encoders {
+		available[e] = true
+	}
+
+	for _, name := range profileNames() {
+		p := audioProfiles[name]
+		if !available[p.Codec] {
+			disableProfile(name, "encoder "+p.Codec+" is not available in this FFmpeg build")
+			slog.Warn("Disabled output profile, encoder missing", "profile", name, "encoder", p.Codec)
+		}
+	}
+}
+
+// currentCapabilities returns the cached probe result with the live profile
+// registry and feature flags
+func currentCapabilities() capabilities {
+	capsMu.RLock()
+	caps := capabilities{}
+	if cachedCaps != nil {
+		caps = *cachedCaps
+	}
+	capsMu.RUnlock()
+
+	caps.Profiles = nil
+	for _, name := range allProfileNames() {
+		p := audioProfiles[name]
+		reason := profileDisabledReason(name)
+		caps.Profiles = append(caps.Profiles, profileCapability{
+			Name:           p.Name,
+			Codec:          p.Codec,
+			ContentType:    p.ContentType,
+			DefaultBitrate: p.Bitrate,
+			SampleRate:     p.SampleRate,
+			Enabled:        reason == "",
+			DisabledReason: reason,
+		})
+	}
+
+	caps.Limits = serviceLimits{
+		MaxBase64UploadBytes:  cfg.Limits.MaxBase64UploadBytes,
+		MaxUploadBytes:        cfg.Limits.MaxUploadBytes,
+		MaxDownloadBytes:      cfg.Limits.MaxDownloadBytes,
+		MaxInlineAudioBytes:   cfg.Limits.MaxInlineAudioBytes,
+		UploadTimeoutSeconds:  int(cfg.FFmpeg.UploadTimeout.std() / time.Second),
+		ExtractTimeoutSeconds: int(cfg.FFmpeg.ExtractTimeout.std() / time.Second),
+	}
+
+	_, s3Err := newS3ClientFromConfig()
+	caps.Features = map[string]bool{
+		"object_storage_source": s3Err == nil,
+		"result_cache":          results != nil,
+		"signed_downloads":      true,
+		"url_download":          true,
+		"yt_dlp":                caps.YtDlp.Available,
+	}
+	filters := make(map[string]bool, len(caps.Filters))
+	for _, f := range caps.Filters {
+		filters[f] = true
+	}
+	for _, f := range optionalFilters {
+		caps.Features["filter_"+f] = filters[f]
+	}
+	return caps
+}
+
+// capabilitiesHandler reports the FFmpeg build's features, the output
+// profiles it supports and the service limits
+func capabilitiesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, r, newAPIError(codeMethodNotAllowed, "Method not allowed"))
+		return
+	}
+	writeJSON(w, http.StatusOK, currentCapabilities())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// probedFFmpeg answers the capability probes like an FFmpeg build without
+// libopus or the showwavespic filter
+const probedFFmpeg = `#!/bin/sh
+case "$2" in
+-version) echo 'ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers'; echo 'built with gcc 13' ;;
+-encoders) cat <<'EOT'
+Encoders:
+ V..... = Video
+ A..... = Audio
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+ A....D flac                 FLAC (Free Lossless Audio Codec)
+ A....D libmp3lame           libmp3lame MP3 (MPEG audio layer 3) (codec mp3)
+ A....D pcm_s16le            PCM signed 16-bit little-endian
+EOT
+;;
+-filters) cat <<'EOT'
+Filters:
+  T.. = Timeline support
+  .S. = Slice threading
+  A = Audio input/output
+ TS. atrim             A->A       Pick one continuous section from the input, drop the rest.
+ ... loudnorm          A->A       EBU R128 loudness normalization
+ ... aresample         A->A       Resample audio data.
+EOT
+;;
+-muxers) cat <<'EOT'
+ Formats:
+ D. = Demuxing supported
+ .E = Muxing supported
+ --
+  E mp3             MP3 (MPEG audio layer 3)
+  E ogg             Ogg
+EOT
+;;
+esac
+`
+
+// setupCapabilities probes fake ffmpeg and yt-dlp binaries, restoring the
+// profile registry and the probe cache afterwards
+func setupCapabilities(t *testing.T) {
+	t.Helper()
+	setupTestEnv(t)
+	bin := filepath.SplitList(os.Getenv("PATH"))[0]
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(probedFFmpeg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "yt-dlp"), []byte("#!/bin/sh\necho 2024.08.06\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		disabledMu.Lock()
+		disabledProfiles = map[string]string{}
+		disabledMu.Unlock()
+		capsMu.Lock()
+		cachedCaps = nil
+		capsMu.Unlock()
+	})
+	probeCapabilities()
+}
+
+func TestCapabilitiesReportTheProbedBuild(t *testing.T) {
+	setupCapabilities(t)
+
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("capabilities answered %d: %s", rec.Code, rec.Body)
+	}
+	var caps capabilities
+	if err := json.Unmarshal(rec.Body.Bytes(), &caps); err != nil {
+		t.Fatal(err)
+	}
+
+	if !caps.FFmpeg.Available || caps.FFmpeg.Version != "ffmpeg version 6.1.1 Copyright (c) 2000-2023 the FFmpeg developers" {
+		t.Errorf("ffmpeg = %+v", caps.FFmpeg)
+	}
+	if !caps.YtDlp.Available || caps.YtDlp.Version != "2024.08.06" {
+		t.Errorf("yt_dlp = %+v", caps.YtDlp)
+	}
+	if want := []string{"aac", "flac", "libmp3lame", "libx264", "pcm_s16le"}; !slices.Equal(caps.Encoders, want) {
+		t.Errorf("encoders = %v, want %v", caps.Encoders, want)
+	}
+	if want := []string{"aresample", "atrim", "loudnorm"}; !slices.Equal(caps.Filters, want) {
+		t.Errorf("filters = %v, want %v", caps.Filters, want)
+	}
+	if want := []string{"mp3", "ogg"}; !slices.Equal(caps.Muxers, want) {
+		t.Errorf("muxers = %v, want %v", caps.Muxers, want)
+	}
+
+	enabled := map[string]bool{}
+	for _, p := range caps.Profiles {
+		enabled[p.Name] = p.Enabled
+		if p.Name == "opus" && p.DisabledReason != "encoder libopus is not available in this FFmpeg build" {
+			t.Errorf("opus disabled because %q", p.DisabledReason)
+		}
+	}
+	want := map[string]bool{"mp3": true, "wav": true, "aac": true, "flac": true, "opus": false}
+	if !maps.Equal(enabled, want) {
+		t.Errorf("enabled profiles = %v, want %v", enabled, want)
+	}
+	if _, ok := lookupProfile("opus"); ok {
+		t.Error("disabled opus profile is still served")
+	}
+
+	for feature, want := range map[string]bool{
+		"filter_loudnorm": true, "filter_atrim": true, "filter_showwavespic": false,
+		"yt_dlp": true, "result_cache": true, "object_storage_source": false,
+	} {
+		if caps.Features[feature] != want {
+			t.Errorf("feature %s = %v, want %v", feature, caps.Features[feature], want)
+		}
+	}
+	if filterAvailable("showwavespic") || !filterAvailable("loudnorm") {
+		t.Error("filterAvailable does not follow the probed filter list")
+	}
+	if caps.Limits.MaxUploadBytes != cfg.Limits.MaxUploadBytes || caps.Limits.ExtractTimeoutSeconds != int(cfg.FFmpeg.ExtractTimeout.std().Seconds()) {
+		t.Errorf("limits = %+v", caps.Limits)
+	}
+}
+
+func TestCapabilitiesWithoutFFmpeg(t *testing.T) {
+	setupTestEnv(t)
+	t.Setenv("PATH", t.TempDir())
+	t.Cleanup(func() {
+		capsMu.Lock()
+		cachedCaps = nil
+		capsMu.Unlock()
+	})
+	probeCapabilities()
+
+	caps := currentCapabilities()
+	if caps.FFmpeg.Available || caps.FFmpeg.Error == "" || caps.YtDlp.Available {
+		t.Errorf("tools = %+v, %+v, want both unavailable", caps.FFmpeg, caps.YtDlp)
+	}
+	// without an encoder list no profile is disabled; jobs report the failure
+	for _, p := range caps.Profiles {
+		if !p.Enabled {
+			t.Errorf("profile %s disabled without a probe: %s", p.Name, p.DisabledReason)
+		}
+	}
+	if !filterAvailable("showwavespic") {
+		t.Error("filters are assumed missing without a probe")
+	}
+
+	rec := httptest.NewRecorder()
+	capabilitiesHandler(rec, httptest.NewRequest(http.MethodPost, "/capabilities", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST answered %d, want 405", rec.Code)
+	}
+}
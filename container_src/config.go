@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is every tunable setting of the service. Defaults are overridden by
+// an optional JSON or YAML file named by CONFIG_FILE, which is in turn
+// overridden by the environment variable listed in each field's env tag.
+// Fields tagged secret are redacted by the admin endpoint.
+type config struct {
+	Server   serverConfig   `json:"server"`
+	Limits   limitsConfig   `json:"limits"`
+	Download downloadConfig `json:"download"`
+	FFmpeg   ffmpegConfig   `json:"ffmpeg"`
+	Storage  storageConfig  `json:"storage"`
+	S3       s3Config       `json:"s3"`
+	Workers  workersConfig  `json:"workers"`
+	Batch    batchConfig    `json:"batch"`
+	Webhooks webhooksConfig `json:"webhooks"`
+	Health   healthConfig   `json:"health"`
+	Logging  loggingConfig  `json:"logging"`
+	Tracing  tracingConfig  `json:"tracing"`
+	Admin    adminConfig    `json:"admin"`
+}
+
+type serverConfig struct {
+	Port                int      `json:"port" env:"PORT"`
+	ExtractRouteTimeout duration `json:"extract_route_timeout" env:"EXTRACT_ROUTE_TIMEOUT"`
+	UploadRouteTimeout  duration `json:"upload_route_timeout" env:"UPLOAD_ROUTE_TIMEOUT"`
+	DrainTimeout        duration `json:"drain_timeout" env:"DRAIN_TIMEOUT"`       // how long shutdown waits for running jobs
+	ShutdownTimeout     duration `json:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"` // for responses once jobs are stopped
+	ReadmeTimeout       duration `json:"readme_timeout" env:"README_FETCH_TIMEOUT"`
+}
+
+type limitsConfig struct {
+	MaxBase64UploadBytes int64 `json:"max_base64_upload_bytes" env:"MAX_BASE64_UPLOAD_BYTES"`
+	MaxUploadBytes       int64 `json:"max_upload_bytes" env:"MAX_UPLOAD_BYTES"`
+	MaxDownloadBytes     int64 `json:"max_download_bytes" env:"MAX_DOWNLOAD_BYTES"`
+	MaxInlineAudioBytes  int64 `json:"max_inline_audio_bytes" env:"MAX_INLINE_AUDIO_BYTES"` // larger outputs are not returned base64-encoded
+	MaxJSONBodyBytes     int64 `json:"max_json_body_bytes" env:"MAX_JSON_BODY_BYTES"`
+	UploadMemoryBytes    int64 `json:"upload_memory_bytes" env:"UPLOAD_MEMORY_BYTES"` // of a multipart upload; the rest is spooled to disk
+	MaxRecipeSteps       int   `json:"max_recipe_steps" env:"MAX_RECIPE_STEPS"`
+}
+
+type downloadConfig struct {
+	ChunkSize    int64    `json:"chunk_size" env:"DOWNLOAD_CHUNK_SIZE"`
+	HeadTimeout  duration `json:"head_timeout" env:"DOWNLOAD_HEAD_TIMEOUT"`
+	ChunkTimeout duration `json:"chunk_timeout" env:"DOWNLOAD_CHUNK_TIMEOUT"`
+}
+
+type ffmpegConfig struct {
+	UploadTimeout  duration `json:"upload_timeout" env:"UPLOAD_FFMPEG_TIMEOUT"`
+	ExtractTimeout duration `json:"extract_timeout" env:"EXTRACT_FFMPEG_TIMEOUT"`
+	KillGrace      duration `json:"kill_grace" env:"FFMPEG_KILL_GRACE"`       // between SIGTERM and SIGKILL
+	ProbeTimeout   duration `json:"probe_timeout" env:"FFMPEG_PROBE_TIMEOUT"` // for the capabilities probe at startup
+}
+
+type storageConfig struct {
+	ProcessingDir      string   `json:"processing_dir" env:"PROCESSING_DIR"`
+	TempMaxBytes       int64    `json:"temp_max_bytes" env:"TEMP_MAX_BYTES"`
+	TempMinFreeBytes   int64    `json:"temp_min_free_bytes" env:"TEMP_MIN_FREE_BYTES"`
+	ArtifactTTL        duration `json:"artifact_ttl" env:"ARTIFACT_TTL"`
+	InputTTL           duration `json:"input_ttl" env:"INPUT_TTL"`             // safety net; inputs are released as soon as a job ends
+	CacheMaxBytes      int64    `json:"cache_max_bytes" env:"CACHE_MAX_BYTES"` // 0 disables the result cache
+	DownloadSigningKey string   `json:"download_signing_key" env:"DOWNLOAD_SIGNING_KEY" secret:"true"`
+	DownloadURLTTL     duration `json:"download_url_ttl" env:"DOWNLOAD_URL_TTL"`
+	JobRetention       duration `json:"job_retention" env:"JOB_RETENTION"` // 0 disables the job journal
+}
+
+type s3Config struct {
+	Endpoint            string `json:"endpoint" env:"S3_ENDPOINT"`
+	Region              string `json:"region" env:"S3_REGION"`
+	AccessKeyID         string `json:"access_key_id" env:"S3_ACCESS_KEY_ID" secret:"true"`
+	SecretAccessKey     string `json:"secret_access_key" env:"S3_SECRET_ACCESS_KEY" secret:"true"`
+	DownloadConcurrency int    `json:"download_concurrency" env:"S3_DOWNLOAD_CONCURRENCY"`
+}
+
+type workersConfig struct {
+	FFmpegConcurrency   int      `json:"ffmpeg_concurrency" env:"FFMPEG_CONCURRENCY"`
+	DownloadConcurrency int      `json:"download_concurrency" env:"DOWNLOAD_CONCURRENCY"`
+	QueueSize           int      `json:"queue_size" env:"JOB_QUEUE_SIZE"`           // per pool; 0 refuses jobs as soon as every slot is busy
+	TenantQueueSize     int      `json:"tenant_queue_size" env:"TENANT_QUEUE_SIZE"` // per pool and instance_id
+	RetryAfter          duration `json:"retry_after" env:"QUEUE_RETRY_AFTER"`
+	InteractiveWeight   int      `json:"interactive_weight" env:"INTERACTIVE_WEIGHT"`
+	BatchWeight         int      `json:"batch_weight" env:"BATCH_WEIGHT"`
+	TenantWeights       string   `json:"tenant_weights" env:"TENANT_WEIGHTS"` // instance_id=weight,...; others weigh 1
+}
+
+type batchConfig struct {
+	MaxItems       int `json:"max_items" env:"BATCH_MAX_ITEMS"`
+	MaxConcurrency int `json:"max_concurrency" env:"BATCH_MAX_CONCURRENCY"` // items of one batch processed at once
+	QueueRetries   int `json:"queue_retries" env:"BATCH_QUEUE_RETRIES"`     // times an item refused with queue_full is tried again
+}
+
+type webhooksConfig struct {
+	SigningKey  string   `json:"signing_key" env:"WEBHOOK_SIGNING_KEY" secret:"true"` // empty disables callback_url
+	MaxAttempts int      `json:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS"`
+	Backoff     duration `json:"backoff" env:"WEBHOOK_BACKOFF"` // before the second attempt, doubling after each failure
+	MaxBackoff  duration `json:"max_backoff" env:"WEBHOOK_MAX_BACKOFF"`
+	Timeout     duration `json:"timeout" env:"WEBHOOK_TIMEOUT"` // per attempt
+}
+
+type healthConfig struct {
+	ReadyMaxActiveJobs int64    `json:"ready_max_active_jobs" env:"READY_MAX_ACTIVE_JOBS"`
+	DrainDelay         duration `json:"drain_delay" env:"DRAIN_DELAY"`
+}
+
+type loggingConfig struct {
+	Level  string `json:"level" env:"LOG_LEVEL"`
+	Format string `json:"format" env:"LOG_FORMAT"`
+}
+
+type tracingConfig struct {
+	Exporter       string `json:"exporter" env:"OTEL_TRACES_EXPORTER"`
+	Endpoint       string `json:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	TracesEndpoint string `json:"traces_endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	Headers        string `json:"headers" env:"OTEL_EXPORTER_OTLP_HEADERS" secret:"true"`
+	ServiceName    string `json:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+type adminConfig struct {
+	Token string `json:"token" env:"ADMIN_TOKEN" secret:"true"` // empty leaves admin endpoints unauthenticated
+}
+
+// cfg is the process-wide configuration, loaded once at startup
+var cfg = defaultConfig()
+
+// defaultConfig returns the settings used when nothing overrides them
+func defaultConfig() *config {
+	return &config{
+		Server: serverConfig{
+			Port:                8080,
+			ExtractRouteTimeout: duration(5 * time.Minute),
+			UploadRouteTimeout:  duration(3 * time.Minute),
+			DrainTimeout:        duration(60 * time.Second),
+			ShutdownTimeout:     duration(5 * time.Second),
+			ReadmeTimeout:       duration(30 * time.Second),
+		},
+		Limits: limitsConfig{
+			MaxBase64UploadBytes: 50 * 1024 * 1024,
+			MaxUploadBytes:       200 * 1024 * 1024,
+			MaxDownloadBytes:     200 * 1024 * 1024,
+			MaxInlineAudioBytes:  10 * 1024 * 1024,
+			MaxJSONBodyBytes:     64 * 1024,
+			UploadMemoryBytes:    64 * 1024 * 1024,
+			MaxRecipeSteps:       32,
+		},
+		Download: downloadConfig{
+			ChunkSize:    5 * 1024 * 1024,
+			HeadTimeout:  duration(5 * time.Second),
+			ChunkTimeout: duration(15 * time.Second),
+		},
+		FFmpeg: ffmpegConfig{
+			UploadTimeout:  duration(30 * time.Second),
+			ExtractTimeout: duration(60 * time.Second),
+			KillGrace:      duration(5 * time.Second),
+			ProbeTimeout:   duration(20 * time.Second),
+		},
+		Storage: storageConfig{
+			ProcessingDir:    "/tmp/processing",
+			TempMaxBytes:     2 * 1024 * 1024 * 1024,
+			TempMinFreeBytes: 100 * 1024 * 1024,
+			ArtifactTTL:      duration(time.Hour),
+			InputTTL:         duration(15 * time.Minute),
+			CacheMaxBytes:    1024 * 1024 * 1024,
+			DownloadURLTTL:   duration(time.Hour),
+			JobRetention:     duration(24 * time.Hour),
+		},
+		S3: s3Config{
+			Region:              "auto", // R2 accepts "auto"
+			DownloadConcurrency: 4,
+		},
+		Workers: workersConfig{
+			FFmpegConcurrency:   runtime.NumCPU(),
+			DownloadConcurrency: 4,
+			QueueSize:           16,
+			TenantQueueSize:     8,
+			RetryAfter:          duration(10 * time.Second),
+			InteractiveWeight:   4,
+			BatchWeight:         1,
+		},
+		Batch: batchConfig{
+			MaxItems:       100,
+			MaxConcurrency: 4,
+			QueueRetries:   30,
+		},
+		Webhooks: webhooksConfig{
+			MaxAttempts: 5,
+			Backoff:     duration(time.Second),
+			MaxBackoff:  duration(time.Minute),
+			Timeout:     duration(10 * time.Second),
+		},
+		Health: healthConfig{
+			ReadyMaxActiveJobs: 4,
+			DrainDelay:         duration(5 * time.Second),
+		},
+		Logging: loggingConfig{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: tracingConfig{
+			ServiceName: "vegvisr-container",
+		},
+	}
+}
+
+// duration is a time.Duration written as a Go duration string such as "30s"
+type duration time.Duration
+
+func (d duration) std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON accepts a duration string or a number of seconds
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		var secs float64
+		if err := json.Unmarshal(b, &secs); err != nil {
+			return fmt.Errorf("invalid duration %s", b)
+		}
+		*d = duration(secs * float64(time.Second))
+		return nil
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+// loadConfig builds the configuration from the defaults, the file named by
+// CONFIG_FILE and the environment, then validates it
+func loadConfig() (*config, error) {
+	c := defaultConfig()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, fmt.Errorf("config file %s: %v", path, err)
+		}
+	}
+	if err := applyEnv(reflect.ValueOf(c).Elem()); err != nil {
+		return nil, err
+	}
+	c.S3.Endpoint = strings.TrimRight(c.S3.Endpoint, "/")
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile merges a JSON or YAML file, chosen by extension, into c. Unknown
+// keys are rejected so a typo does not silently leave a default in place.
+func (c *config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		doc, err := parseYAML(data)
+		if err != nil {
+			return err
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unsupported format, use .json, .yaml or .yml")
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	return dec.Decode(c)
+}
+
+// applyEnv overrides every field with a non-empty env tag variable
+func applyEnv(v reflect.Value) error {
+	var errs []error
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, fv := t.Field(i), v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(fv); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		name := field.Tag.Get("env")
+		raw := os.Getenv(name)
+		if name == "" || raw == "" {
+			continue
+		}
+		if err := setField(fv, raw); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// setField parses raw into a string, integer or duration field
+func setField(fv reflect.Value, raw string) error {
+	if fv.Type() == reflect.TypeOf(duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", raw)
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(raw)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", raw)
+		}
+		fv.SetInt(n)
+	default:
+		return fmt.Errorf("unsupported field type %s", fv.Type())
+	}
+	return nil
+}
+
+// validate reports every invalid setting at once
+func (c *config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port must be between 1 and 65535, got %d", c.Server.Port)
+	check(c.Server.ExtractRouteTimeout > 0, "server.extract_route_timeout must be positive")
+	check(c.Server.UploadRouteTimeout > 0, "server.upload_route_timeout must be positive")
+	check(c.Server.DrainTimeout >= 0, "server.drain_timeout must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.ReadmeTimeout > 0, "server.readme_timeout must be positive")
+
+	check(c.Limits.MaxBase64UploadBytes > 0, "limits.max_base64_upload_bytes must be positive")
+	check(c.Limits.MaxUploadBytes > 0, "limits.max_upload_bytes must be positive")
+	check(c.Limits.MaxDownloadBytes > 0, "limits.max_download_bytes must be positive")
+	check(c.Limits.MaxInlineAudioBytes >= 0, "limits.max_inline_audio_bytes must not be negative")
+	check(c.Limits.MaxJSONBodyBytes >= 1024, "limits.max_json_body_bytes must be at least 1024")
+	check(c.Limits.UploadMemoryBytes >= 1024*1024, "limits.upload_memory_bytes must be at least 1048576")
+	check(c.Limits.MaxRecipeSteps >= 1, "limits.max_recipe_steps must be at least 1, got %d", c.Limits.MaxRecipeSteps)
+
+	check(c.Download.ChunkSize >= 64*1024, "download.chunk_size must be at least 65536")
+	check(c.Download.HeadTimeout > 0, "download.head_timeout must be positive")
+	check(c.Download.ChunkTimeout > 0, "download.chunk_timeout must be positive")
+
+	check(c.FFmpeg.UploadTimeout > 0, "ffmpeg.upload_timeout must be positive")
+	check(c.FFmpeg.ExtractTimeout > 0, "ffmpeg.extract_timeout must be positive")
+	check(c.FFmpeg.KillGrace > 0, "ffmpeg.kill_grace must be positive")
+	check(c.FFmpeg.ProbeTimeout > 0, "ffmpeg.probe_timeout must be positive")
+	check(c.FFmpeg.UploadTimeout <= c.Server.UploadRouteTimeout, "ffmpeg.upload_timeout must not exceed server.upload_route_timeout")
+	check(c.FFmpeg.ExtractTimeout <= c.Server.ExtractRouteTimeout, "ffmpeg.extract_timeout must not exceed server.extract_route_timeout")
+
+	check(filepath.IsAbs(c.Storage.ProcessingDir), "storage.processing_dir must be an absolute path, got %q", c.Storage.ProcessingDir)
+	check(c.Storage.TempMaxBytes > 0, "storage.temp_max_bytes must be positive")
+	check(c.Storage.TempMinFreeBytes >= 0, "storage.temp_min_free_bytes must not be negative")
+	check(c.Storage.ArtifactTTL > 0, "storage.artifact_ttl must be positive")
+	check(c.Storage.InputTTL > 0, "storage.input_ttl must be positive")
+	check(c.Storage.CacheMaxBytes >= 0, "storage.cache_max_bytes must not be negative")
+	check(c.Storage.CacheMaxBytes < c.Storage.TempMaxBytes, "storage.cache_max_bytes must be below storage.temp_max_bytes")
+	check(c.Storage.DownloadURLTTL > 0, "storage.download_url_ttl must be positive")
+	check(c.Storage.JobRetention >= 0, "storage.job_retention must not be negative")
+
+	check(c.S3.Endpoint == "" || strings.HasPrefix(c.S3.Endpoint, "https://") || strings.HasPrefix(c.S3.Endpoint, "http://"),
+		"s3.endpoint must be an http or https URL")
+	check(c.S3.Region != "", "s3.region must not be empty")
+	check(c.S3.DownloadConcurrency >= 1 && c.S3.DownloadConcurrency <= 64, "s3.download_concurrency must be between 1 and 64, got %d", c.S3.DownloadConcurrency)
+
+	check(c.Workers.FFmpegConcurrency >= 1, "workers.ffmpeg_concurrency must be at least 1, got %d", c.Workers.FFmpegConcurrency)
+	check(c.Workers.DownloadConcurrency >= 1, "workers.download_concurrency must be at least 1, got %d", c.Workers.DownloadConcurrency)
+	check(c.Workers.QueueSize >= 0, "workers.queue_size must not be negative")
+	check(c.Workers.TenantQueueSize >= 0 && c.Workers.TenantQueueSize <= c.Workers.QueueSize,
+		"workers.tenant_queue_size must be between 0 and workers.queue_size, got %d", c.Workers.TenantQueueSize)
+	check(c.Workers.RetryAfter >= duration(time.Second), "workers.retry_after must be at least 1s")
+	check(c.Workers.InteractiveWeight >= 1 && c.Workers.BatchWeight >= 1, "workers.interactive_weight and workers.batch_weight must be at least 1")
+	if _, err := parseTenantWeights(c.Workers.TenantWeights); err != nil {
+		errs = append(errs, fmt.Errorf("workers.tenant_weights: %v", err))
+	}
+
+	check(c.Batch.MaxItems >= 1, "batch.max_items must be at least 1, got %d", c.Batch.MaxItems)
+	check(c.Batch.MaxConcurrency >= 1, "batch.max_concurrency must be at least 1, got %d", c.Batch.MaxConcurrency)
+	check(c.Batch.QueueRetries >= 0, "batch.queue_retries must not be negative, got %d", c.Batch.QueueRetries)
+
+	check(c.Webhooks.MaxAttempts >= 1, "webhooks.max_attempts must be at least 1, got %d", c.Webhooks.MaxAttempts)
+	check(c.Webhooks.Backoff > 0 && c.Webhooks.Backoff <= c.Webhooks.MaxBackoff, "webhooks.backoff must be positive and at most webhooks.max_backoff")
+	check(c.Webhooks.Timeout > 0, "webhooks.timeout must be positive")
+
+	check(c.Health.ReadyMaxActiveJobs > 0, "health.ready_max_active_jobs must be positive")
+	check(c.Health.DrainDelay >= 0, "health.drain_delay must not be negative")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.Logging.Level)) == nil, "logging.level must be debug, info, warn or error, got %q", c.Logging.Level)
+	check(c.Logging.Format == "json" || c.Logging.Format == "text", "logging.format must be json or text, got %q", c.Logging.Format)
+
+	check(c.Tracing.Exporter == "" || c.Tracing.Exporter == "otlp" || c.Tracing.Exporter == "none",
+		"tracing.exporter must be otlp or none, got %q", c.Tracing.Exporter)
+
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy of c with every non-empty secret replaced
+func (c *config) redacted() *config {
+	out := *c
+	redactSecrets(reflect.ValueOf(&out).Elem())
+	return &out
+}
+
+func redactSecrets(v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct {
+			redactSecrets(fv)
+			continue
+		}
+		if t.Field(i).Tag.Get("secret") == "true" && fv.String() != "" {
+			fv.SetString("[redacted]")
+		}
+	}
+}
+
+// adminAuthorized checks the bearer token when ADMIN_TOKEN is set, writing
+// a 401 response and returning false if it is missing or wrong
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if token := cfg.Admin.Token; token != "" {
+		presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, newAPIError(codeUnauthorized, "A valid admin token is required"))
+			return false
+		}
+	}
+	return true
+}
+
+// configHandler serves the effective configuration with secrets redacted.
+// When ADMIN_TOKEN is set it must be presented as a bearer token.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, cfg.redacted())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := defaultConfig().validate(); err != nil {
+		t.Errorf("defaults are invalid: %v", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(c *config)
+		wantErr []string
+	}{
+		{"port out of range", func(c *config) { c.Server.Port = 70000 }, []string{"server.port must be between 1 and 65535, got 70000"}},
+		{"ffmpeg timeout beyond its route", func(c *config) { c.FFmpeg.ExtractTimeout = c.Server.ExtractRouteTimeout + 1 },
+			[]string{"ffmpeg.extract_timeout must not exceed server.extract_route_timeout"}},
+		{"relative processing dir", func(c *config) { c.Storage.ProcessingDir = "tmp" }, []string{`storage.processing_dir must be an absolute path, got "tmp"`}},
+		{"cache over the disk budget", func(c *config) { c.Storage.CacheMaxBytes = c.Storage.TempMaxBytes },
+			[]string{"storage.cache_max_bytes must be below storage.temp_max_bytes"}},
+		{"tenant queue over the pool queue", func(c *config) { c.Workers.TenantQueueSize = c.Workers.QueueSize + 1 },
+			[]string{"workers.tenant_queue_size must be between 0 and workers.queue_size"}},
+		{"malformed tenant weights", func(c *config) { c.Workers.TenantWeights = "a=1,b" }, []string{`workers.tenant_weights: invalid tenant weight "b"`}},
+		{"backoff over its maximum", func(c *config) { c.Webhooks.Backoff = c.Webhooks.MaxBackoff + 1 },
+			[]string{"webhooks.backoff must be positive and at most webhooks.max_backoff"}},
+		{"negative batch retries", func(c *config) { c.Batch.QueueRetries = -1 }, []string{"batch.queue_retries must not be negative, got -1"}},
+		{"unknown log level", func(c *config) { c.Logging.Level = "loud" }, []string{`logging.level must be debug, info, warn or error, got "loud"`}},
+		{"unknown exporter", func(c *config) { c.Tracing.Exporter = "jaeger" }, []string{`tracing.exporter must be otlp or none, got "jaeger"`}},
+		{"limits moved into the config", func(c *config) {
+			c.Server.ReadmeTimeout = 0
+			c.Storage.InputTTL = 0
+			c.FFmpeg.ProbeTimeout = 0
+			c.Limits.UploadMemoryBytes = 1024
+			c.Limits.MaxRecipeSteps = 0
+		}, []string{
+			"server.readme_timeout must be positive",
+			"storage.input_ttl must be positive",
+			"ffmpeg.probe_timeout must be positive",
+			"limits.upload_memory_bytes must be at least 1048576",
+			"limits.max_recipe_steps must be at least 1, got 0",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaultConfig()
+			tt.mutate(c)
+			err := c.validate()
+			if err == nil {
+				t.Fatal("validate accepted an invalid config")
+			}
+			// Every invalid setting is reported, and nothing else
+			if got := strings.Split(err.Error(), "\n"); len(got) != len(tt.wantErr) {
+				t.Errorf("validate reported %d errors, want %d: %v", len(got), len(tt.wantErr), err)
+			}
+			for _, want := range tt.wantErr {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("validate error %q lacks %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("yaml file overrides defaults, environment overrides the file", func(t *testing.T) {
+		t.Setenv("CONFIG_FILE", write("config.yaml", `
+server:
+  port: 9000
+  readme_timeout: 10   # seconds
+storage:
+  input_ttl: 5m
+limits:
+  max_recipe_steps: 8
+`))
+		t.Setenv("MAX_RECIPE_STEPS", "12")
+		c, err := loadConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Server.Port != 9000 || c.Server.ReadmeTimeout.std() != 10*time.Second || c.Storage.InputTTL.std() != 5*time.Minute {
+			t.Errorf("file settings not applied: %+v, %+v", c.Server, c.Storage)
+		}
+		if c.Limits.MaxRecipeSteps != 12 {
+			t.Errorf("max_recipe_steps %d, want the environment's 12", c.Limits.MaxRecipeSteps)
+		}
+		if c.FFmpeg.ProbeTimeout.std() != 20*time.Second {
+			t.Errorf("default probe_timeout lost: %v", c.FFmpeg.ProbeTimeout.std())
+		}
+	})
+
+	tests := []struct {
+		name    string
+		file    string
+		data    string
+		env     map[string]string
+		wantErr string
+	}{
+		{"unknown key", "typo.json", `{"server":{"prot":1}}`, nil, `unknown field "prot"`},
+		{"flow style yaml", "flow.yaml", "server: {port: 1}", nil, "unsupported YAML syntax"},
+		{"unsupported extension", "config.toml", "", nil, "unsupported format"},
+		{"invalid value", "bad.yml", "server:\n  port: 0", nil, "server.port must be between 1 and 65535, got 0"},
+		{"invalid environment", "ok.json", `{}`, map[string]string{"INPUT_TTL": "soon"}, `INPUT_TTL: invalid duration "soon"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", write(tt.file, tt.data))
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
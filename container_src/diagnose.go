@@ -0,0 +1,109 @@
+package main
+
+import (
+	"strings"
+)
+
+// Causes reported in ffmpegDiagnosis.Cause
+const (
+	causeNoAudioStream    = "no_audio_stream"
+	causeInvalidData      = "invalid_data"
+	causeUnsupportedCodec = "unsupported_codec"
+	causeTruncatedFile    = "truncated_file"
+	causePermission       = "permission_denied"
+	causeProtocol         = "protocol_error"
+	causeUnknown          = "unknown"
+)
+
+// ffmpegDiagnosis is a classified FFmpeg failure with a message short
+// enough to show to end users
+type ffmpegDiagnosis struct {
+	Cause   string `json:"cause"`
+	Message string `json:"message"`
+	Line    string `json:"line,omitempty"` // the stderr line the cause was derived from
+}
+
+// inputFault reports whether the failure is caused by the submitted media
+// rather than by the server. A failure nothing recognised is not blamed on
+// the input.
+func (d *ffmpegDiagnosis) inputFault() bool {
+	switch d.Cause {
+	case causePermission, causeProtocol, causeUnknown:
+		return false
+	}
+	return true
+}
+
+// stderrPattern maps a lowercase stderr fragment to a cause
+type stderrPattern struct {
+	fragment string
+	cause    string
+}
+
+// stderrPatterns are listed from most to least specific
+var stderrPatterns = []stderrPattern{
+	{"does not contain any stream", causeNoAudioStream},
+	{"matches no streams", causeNoAudioStream},
+	{"no audio stream", causeNoAudioStream},
+
+	{"moov atom not found", causeTruncatedFile},
+	{"partial file", causeTruncatedFile},
+	{"truncating packet", causeTruncatedFile},
+	{"premature end", causeTruncatedFile},
+	{"ended prematurely", causeTruncatedFile},
+	{"unexpected end of file", causeTruncatedFile},
+	{"error opening input: end of file", causeTruncatedFile}, // empty input
+
+	{"unknown decoder", causeUnsupportedCodec},
+	{"decoder not found", causeUnsupportedCodec},
+	{"unsupported codec", causeUnsupportedCodec},
+	{"codec not currently supported", causeUnsupportedCodec},
+	{"could not find tag for codec", causeUnsupportedCodec},
+	{"no decoder for", causeUnsupportedCodec},
+	{"no decoder found", causeUnsupportedCodec},
+
+	{"invalid data found when processing input", causeInvalidData},
+	{"could not find codec parameters", causeInvalidData},
+	{"error while decoding", causeInvalidData},
+	{"invalid frame", causeInvalidData},
+	{"header missing", causeInvalidData},
+
+	{"permission denied", causePermission},
+	{"read-only file system", causePermission},
+
+	{"protocol not found", causeProtocol},
+	{"connection refused", causeProtocol},
+	{"failed to resolve hostname", causeProtocol},
+	{"connection timed out", causeProtocol},
+	{"network is unreachable", causeProtocol},
+	{"input/output error", causeProtocol},
+	{"i/o error", causeProtocol},
+	{"server returned", causeProtocol},
+}
+
+// causeMessages are the user-facing messages for each cause
+var causeMessages = map[string]string{
+	causeNoAudioStream:    "This video has no audio track.",
+	causeInvalidData:      "The file is corrupt or not a recognised media format.",
+	causeUnsupportedCodec: "The video uses a codec this server cannot decode.",
+	causeTruncatedFile:    "The file appears to be incomplete or truncated.",
+	causePermission:       "The server could not access the file.",
+	causeProtocol:         "The server could not read the input stream.",
+	causeUnknown:          "FFmpeg could not process this file.",
+}
+
+// diagnoseFFmpeg classifies FFmpeg's stderr. Patterns are tried in priority
+// order so that, for example, "moov atom not found" wins over the generic
+// "Invalid data found" line FFmpeg prints after it.
+func diagnoseFFmpeg(stderr string) *ffmpegDiagnosis {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	for _, p := range stderrPatterns {
+		for i := len(lines) - 1; i >= 0; i-- {
+			line := strings.TrimSpace(lines[i])
+			if strings.Contains(strings.ToLower(line), p.fragment) {
+				return &ffmpegDiagnosis{Cause: p.cause, Message: causeMessages[p.cause], Line: line}
+			}
+		}
+	}
+	return &ffmpegDiagnosis{Cause: causeUnknown, Message: causeMessages[causeUnknown]}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+)
+
+func TestDiagnoseFFmpeg(t *testing.T) {
+	tests := []struct {
+		name      string
+		stderr    string
+		wantCause string
+		wantLine  string
+		wantCode  string
+	}{
+		{
+			name: "no audio stream",
+			stderr: `Input #0, mov,mp4,m4a,3gp,3g2,mj2, from '/tmp/processing/video_a_1.mp4':
+  Stream #0:0[0x1](und): Video: h264 (High) (avc1 / 0x31637661), yuv420p, 1280x720, 1205 kb/s, 30 fps
+Stream map '0:a' matches no streams.
+To ignore this, add a trailing '?' to the map.
+Failed to set value '0:a' for option 'map': Invalid argument
+Error parsing options for output file /tmp/processing/audio_a_1.mp3.
+Error opening output files: Invalid argument`,
+			wantCause: causeNoAudioStream,
+			wantLine:  "Stream map '0:a' matches no streams.",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "no stream left by -vn",
+			stderr: `Output #0, mp3, to '/tmp/processing/audio_a_1.mp3':
+Output file #0 does not contain any stream`,
+			wantCause: causeNoAudioStream,
+			wantLine:  "Output file #0 does not contain any stream",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "missing moov atom wins over invalid data",
+			stderr: `[mov,mp4,m4a,3gp,3g2,mj2 @ 0x55d5c8a4a940] moov atom not found
+[in#0 @ 0x55d5c8a4a780] Error opening input: Invalid data found when processing input
+Error opening input file /tmp/processing/video_a_1.mp4.
+Error opening input files: Invalid data found when processing input`,
+			wantCause: causeTruncatedFile,
+			wantLine:  "[mov,mp4,m4a,3gp,3g2,mj2 @ 0x55d5c8a4a940] moov atom not found",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "mp4 cut short",
+			stderr: `[mov,mp4,m4a,3gp,3g2,mj2 @ 0x5612f0c0f900] stream 1, offset 0x2d0cb: partial file
+[in#0/mov,mp4,m4a,3gp,3g2,mj2 @ 0x5612f0c0f640] Error during demuxing: Invalid data found when processing input`,
+			wantCause: causeTruncatedFile,
+			wantLine:  "[mov,mp4,m4a,3gp,3g2,mj2 @ 0x5612f0c0f900] stream 1, offset 0x2d0cb: partial file",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name:      "matroska cut short",
+			stderr:    `[matroska,webm @ 0x55f1b4c3e2c0] File ended prematurely at pos. 52342 (0xcc76)`,
+			wantCause: causeTruncatedFile,
+			wantLine:  "[matroska,webm @ 0x55f1b4c3e2c0] File ended prematurely at pos. 52342 (0xcc76)",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "empty input",
+			stderr: `[in#0 @ 0x5581e7a4f780] Error opening input: End of file
+Error opening input file /tmp/processing/video_a_1.mp4.
+Error opening input files: End of file`,
+			wantCause: causeTruncatedFile,
+			wantLine:  "[in#0 @ 0x5581e7a4f780] Error opening input: End of file",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "end of file while muxing is not the input's fault",
+			stderr: `[mp3 @ 0x55b8e2d1a1c0] Estimating duration from bitrate, this may be inaccurate
+[out#0/mp3 @ 0x55b8e2d3f2c0] Error submitting a packet to the muxer: End of file
+[out#0/mp3 @ 0x55b8e2d3f2c0] Error writing trailer: End of file`,
+			wantCause: causeUnknown,
+			wantCode:  codeTranscodeFailed,
+		},
+		{
+			name: "not media",
+			stderr: `[in#0 @ 0x5608c2b8e780] Error opening input: Invalid data found when processing input
+Error opening input file /tmp/processing/video_a_1.mp4.
+Error opening input files: Invalid data found when processing input`,
+			wantCause: causeInvalidData,
+			wantLine:  "Error opening input files: Invalid data found when processing input",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "no decoder",
+			stderr: `Stream #0:0: Audio: none (ac-4 / 0x342D6361), 48000 Hz, 2 channels
+[aist#0:0/none @ 0x55c9d7e8b0c0] Decoding requested, but no decoder found for: none
+Error opening output files: Decoder not found`,
+			wantCause: causeUnsupportedCodec,
+			wantLine:  "Error opening output files: Decoder not found",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name: "corrupt frames",
+			stderr: `[mp3float @ 0x5638e3a1d0c0] Header missing
+[aist#0:0/mp3 @ 0x5638e3a0c440] Error while decoding stream #0:0: Invalid data found when processing input`,
+			wantCause: causeInvalidData,
+			wantLine:  "[aist#0:0/mp3 @ 0x5638e3a0c440] Error while decoding stream #0:0: Invalid data found when processing input",
+			wantCode:  codeInvalidInputMedia,
+		},
+		{
+			name:      "unreadable file",
+			stderr:    `/tmp/processing/video_a_1.mp4: Permission denied`,
+			wantCause: causePermission,
+			wantLine:  "/tmp/processing/video_a_1.mp4: Permission denied",
+			wantCode:  codeTranscodeFailed,
+		},
+		{
+			name: "source gone",
+			stderr: `[https @ 0x55f0a1c3e0c0] HTTP error 404 Not Found
+[in#0 @ 0x55f0a1c3dd80] Error opening input: Server returned 404 Not Found
+Error opening input file https://example.com/v.mp4.`,
+			wantCause: causeProtocol,
+			wantLine:  "[in#0 @ 0x55f0a1c3dd80] Error opening input: Server returned 404 Not Found",
+			wantCode:  codeTranscodeFailed,
+		},
+		{
+			name: "out of disk",
+			stderr: `[out#0/mp3 @ 0x55b8e2d3f2c0] Error writing trailer: No space left on device
+Conversion failed!`,
+			wantCause: causeUnknown,
+			wantCode:  codeTranscodeFailed,
+		},
+		{
+			name:      "no output",
+			stderr:    "",
+			wantCause: causeUnknown,
+			wantCode:  codeTranscodeFailed,
+		},
+	}
+
+	setupTestEnv(t)
+	exitErr := exec.Command("sh", "-c", "exit 1").Run()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := diagnoseFFmpeg(tt.stderr)
+			if d.Cause != tt.wantCause || d.Line != tt.wantLine {
+				t.Errorf("diagnosed %s from %q, want %s from %q", d.Cause, d.Line, tt.wantCause, tt.wantLine)
+			}
+			if d.Message != causeMessages[tt.wantCause] {
+				t.Errorf("message %q, want %q", d.Message, causeMessages[tt.wantCause])
+			}
+
+			apiErr := ffmpegError(context.Background(), exitErr, []byte(tt.stderr))
+			if apiErr.Code != tt.wantCode {
+				t.Errorf("classified as %s, want %s", apiErr.Code, tt.wantCode)
+			}
+			if apiErr.Diagnosis == nil || apiErr.Diagnosis.Cause != tt.wantCause {
+				t.Errorf("error carries diagnosis %+v", apiErr.Diagnosis)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DryRunResponse describes the job a request would run. A request with
+// dry_run set is validated and its source probed, but nothing is queued,
+// downloaded or transcoded.
+type DryRunResponse struct {
+	Success       bool          `json:"success" openapi:"required"`
+	Message       string        `json:"message" openapi:"required"`
+	DryRun        bool          `json:"dry_run" openapi:"required"`
+	Profile       dryRunProfile `json:"profile" openapi:"required"`
+	FFmpegArgs    []string      `json:"ffmpeg_args" openapi:"required" doc:"Arguments FFmpeg would be run with; the timestamp in the file names changes on a real run"`
+	OutputFile    string        `json:"output_file" openapi:"required" doc:"Name the output would be published under"`
+	EstimatedSize int64         `json:"estimated_size,omitempty" doc:"Predicted output size in bytes; omitted when the source's duration is unknown"`
+	SourceSize    int64         `json:"source_size,omitempty" doc:"Size of the source in bytes, when known"`
+	Probe         *mediaInfo    `json:"probe,omitempty" doc:"The source as probed by ffprobe"`
+}
+
+// dryRunProfile is the output profile a request resolved to
+type dryRunProfile struct {
+	Name        string `json:"name"`
+	Preset      string `json:"preset,omitempty"`
+	Codec       string `json:"codec"`
+	Bitrate     string `json:"bitrate,omitempty"`
+	SampleRate  string `json:"sample_rate"`
+	Channels    string `json:"channels,omitempty"`
+	Filter      string `json:"filter,omitempty"`
+	Extension   string `json:"extension"`
+	ContentType string `json:"content_type"`
+}
+
+// writeDryRun answers a dry run with the FFmpeg command that would turn
+// input into output. media and sourceSize describe the source as far as
+// it could be probed.
+func writeDryRun(w http.ResponseWriter, p audioProfile, preset, quality, input, output string, media *mediaInfo, sourceSize int64) {
+	writeJSON(w, http.StatusOK, DryRunResponse{
+		Success: true,
+		Message: "Dry run: nothing was downloaded or transcoded",
+		DryRun:  true,
+		Profile: dryRunProfile{
+			Name:        p.Name,
+			Preset:      preset,
+			Codec:       p.Codec,
+			Bitrate:     p.bitrate(quality),
+			SampleRate:  p.SampleRate,
+			Channels:    p.Channels,
+			Filter:      p.Filter,
+			Extension:   p.Extension,
+			ContentType: p.ContentType,
+		},
+		FFmpegArgs:    p.ffmpegArgs(input, output, quality),
+		OutputFile:    filepath.Base(output),
+		EstimatedSize: estimateOutputSize(p, quality, media),
+		SourceSize:    sourceSize,
+		Probe:         media,
+	})
+}
+
+// probeSource inspects an extraction request's source without downloading
+// it. ffprobe reads the source itself, fetching only what it needs; an
+// object in storage is sized with a signed HEAD and probed through a
+// presigned URL. A source that cannot be fetched fails as download_failed.
+func probeSource(ctx context.Context, req FFmpegRequest) (*mediaInfo, int64, *apiError) {
+	source := req.VideoURL
+	var size int64
+	if req.Source != nil {
+		client, err := newS3ClientFromConfig()
+		if err != nil {
+			return nil, 0, asAPIError(err, codeDownloadFailed)
+		}
+		if size, _, err = client.headObject(ctx, *req.Source); err != nil {
+			return nil, 0, asAPIError(err, codeDownloadFailed)
+		}
+		if source, err = client.presignURL(client.objectURL(*req.Source), cfg.FFmpeg.ExtractTimeout.std(), time.Now().UTC()); err != nil {
+			return nil, 0, newAPIErrorf(codeInternal, "Failed to sign the object URL: %v", err)
+		}
+	}
+
+	media, apiErr := probeMedia(ctx, source)
+	if apiErr != nil {
+		// The stderr names the URL, which for an object carries a signature
+		apiErr.Details = redactURLs(apiErr.Details)
+		if d := diagnoseFFmpeg(apiErr.Details); d.Cause == causeProtocol {
+			apiErr.Code, apiErr.Diagnosis = codeDownloadFailed, d
+			apiErr.Message = "ffprobe could not fetch the source: " + d.Line
+		}
+		return nil, 0, apiErr
+	}
+	if size == 0 {
+		size = media.Size
+	}
+	if apiErr := requireAudio(media); apiErr != nil {
+		return nil, 0, apiErr
+	}
+
+	if maxBytes := cfg.Limits.MaxDownloadBytes; size > maxBytes {
+		return nil, 0, newAPIErrorf(codeSourceTooLarge, "video file too large (%.1f MB). Maximum supported: %dMB", float64(size)/(1024*1024), maxBytes/(1024*1024))
+	}
+	return media, size, nil
+}
+
+// probeUpload probes an upload already saved to path
+func probeUpload(ctx context.Context, path string) (*mediaInfo, *apiError) {
+	media, apiErr := probeMedia(ctx, path)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return media, requireAudio(media)
+}
+
+// untrackDryRun drops the job trackJob opened for a request once its
+// handler has decoded dry_run: a dry run is not journaled and has no job ID.
+// It has still passed the drain and admission checks, and counts as an
+// active job while its source is probed.
+func untrackDryRun(w http.ResponseWriter, r *http.Request) {
+	w.Header().Del("X-Job-ID")
+	journal.discard(jobIDFrom(r.Context()))
+}
+
+// requireAudio refuses a probed source that has no audio stream to extract
+func requireAudio(media *mediaInfo) *apiError {
+	if media.audioStream() != nil {
+		return nil
+	}
+	return &apiError{
+		Code:      codeInvalidInputMedia,
+		Message:   "The source has no audio stream",
+		Diagnosis: &ffmpegDiagnosis{Cause: causeNoAudioStream, Message: causeMessages[causeNoAudioStream]},
+	}
+}
+
+// audioStream returns the first audio stream, or nil if there is none
+func (m *mediaInfo) audioStream() *mediaStream {
+	for i := range m.Streams {
+		if m.Streams[i].CodecType == "audio" {
+			return &m.Streams[i]
+		}
+	}
+	return nil
+}
+
+// estimateOutputSize predicts the size of an output from the source's
+// duration. It is exact for PCM and close for constant-bitrate lossy
+// codecs; FLAC is taken to compress PCM to about 60%. It returns 0 when
+// the duration is unknown.
+func estimateOutputSize(p audioProfile, quality string, media *mediaInfo) int64 {
+	if media == nil || media.Duration <= 0 {
+		return 0
+	}
+	if b := p.bitrate(quality); b != "" {
+		kbps, _ := strconv.Atoi(strings.TrimSuffix(b, "k"))
+		return int64(media.Duration * float64(kbps) * 1000 / 8)
+	}
+
+	// Lossless: FFmpeg keeps the source's channels unless the profile sets them
+	channels := 2
+	if n, err := strconv.Atoi(p.Channels); err == nil {
+		channels = n
+	} else if s := media.audioStream(); s != nil && s.Channels > 0 {
+		channels = s.Channels
+	}
+	rate, _ := strconv.ParseFloat(p.SampleRate, 64)
+	pcm := media.Duration * rate * float64(channels) * 2 // 16-bit samples
+	if p.Codec == "flac" {
+		return int64(pcm * 0.6)
+	}
+	return int64(pcm) + 44 // WAV header
+}
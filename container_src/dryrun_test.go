@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// replaceFFprobe swaps the fake ffprobe installed by setupTestEnv for script
+func replaceFFprobe(t *testing.T, script string) {
+	t.Helper()
+	bin := filepath.SplitList(os.Getenv("PATH"))[0]
+	if err := os.WriteFile(filepath.Join(bin, "ffprobe"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dryRun posts body to the extraction route and decodes the answer into v
+func dryRun(t *testing.T, body string, header http.Header, v any) *httptest.ResponseRecorder {
+	t.Helper()
+	h := extractRoute(strict(idempotent(trackJob(ffmpegHandler))))
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/extract-audio", strings.NewReader(body))
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("unreadable response %q: %v", rec.Body.String(), err)
+	}
+	return rec
+}
+
+// journaledJobs counts the jobs in the journal
+func journaledJobs() int {
+	journal.mu.Lock()
+	defer journal.mu.Unlock()
+	return len(journal.jobs)
+}
+
+func TestDryRunIsNotAJob(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+	}{
+		{"plain", nil},
+		{"with Idempotency-Key", http.Header{"Idempotency-Key": {"dry"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ffmpegRuns := setupTestEnv(t)
+			body := `{"video_url":"` + serveVideo(t) + `","dry_run":true}`
+			for i := 0; i < 2; i++ {
+				var resp DryRunResponse
+				rec := dryRun(t, body, tt.header, &resp)
+				if rec.Code != http.StatusOK || !resp.DryRun {
+					t.Fatalf("dry run answered %d: %s", rec.Code, rec.Body.String())
+				}
+				if id := rec.Header().Get("X-Job-ID"); id != "" {
+					t.Errorf("dry run was given job %s", id)
+				}
+				if rec.Header().Get("Idempotent-Replayed") != "" {
+					t.Error("dry run was replayed")
+				}
+			}
+			if n := journaledJobs(); n != 0 {
+				t.Errorf("journal holds %d jobs after dry runs", n)
+			}
+			if n := health.activeJobs.Load(); n != 0 {
+				t.Errorf("%d active jobs after dry runs", n)
+			}
+			if n := ffmpegRuns(); n != 0 {
+				t.Errorf("ffmpeg ran %d times", n)
+			}
+
+			// nor do they come back when the journal is replayed
+			journal.close()
+			journal = newJobJournalFromConfig()
+			if n := journaledJobs(); n != 0 || len(journal.keys) != 0 {
+				t.Errorf("replayed journal holds %d jobs and %d keys", n, len(journal.keys))
+			}
+		})
+	}
+}
+
+func TestDryRunRespectsAdmission(t *testing.T) {
+	setupTestEnv(t)
+	body := `{"video_url":"` + serveVideo(t) + `","dry_run":true}`
+
+	health.draining.Store(true)
+	var resp FFmpegResponse
+	if rec := dryRun(t, body, nil, &resp); rec.Code != http.StatusServiceUnavailable || resp.Code != codeDraining {
+		t.Errorf("dry run while draining answered %d %s, want 503 %s", rec.Code, resp.Code, codeDraining)
+	}
+	health.draining.Store(false)
+
+	// one busy slot and no queue saturate the FFmpeg pool
+	cfg.Workers.FFmpegConcurrency, cfg.Workers.QueueSize = 1, 0
+	newWorkPoolsFromConfig()
+	release, err := ffmpegPool.acquire(t.Context(), jobTicket{tenant: "busy"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	if rec := dryRun(t, body, nil, &resp); rec.Code != codeStatus[codeQueueFull] || resp.Code != codeQueueFull {
+		t.Errorf("dry run with a full queue answered %d %s, want %s", rec.Code, resp.Code, codeQueueFull)
+	}
+}
+
+func TestUploadDryRunIsNotAJob(t *testing.T) {
+	setupTestEnv(t)
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("dry_run", "true")
+	part, _ := form.CreateFormFile("video", "clip.mp4")
+	part.Write(bytes.Repeat([]byte("video"), 1000))
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/upload", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	uploadRoute(strict(trackJob(uploadHandler)))(rec, req)
+
+	var resp DryRunResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || !resp.DryRun {
+		t.Fatalf("dry run answered %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp.SourceSize != 5000 {
+		t.Errorf("source size %d, want 5000", resp.SourceSize)
+	}
+	if id := rec.Header().Get("X-Job-ID"); id != "" || journaledJobs() != 0 {
+		t.Errorf("upload dry run was journaled as job %q", id)
+	}
+}
+
+func TestDryRunSourceFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		stderr   string
+		wantCode string
+	}{
+		{"not found", "https://example.com/v.mp4: Server returned 404 Not Found", codeDownloadFailed},
+		{"dns", "[tcp @ 0x55d0c9e1c2c0] Failed to resolve hostname nope.invalid: Name or service not known\\nhttps://nope.invalid/v.mp4: Input/output error", codeDownloadFailed},
+		{"refused", "[tcp @ 0x5603f1a3e2c0] Connection to tcp://127.0.0.1:1 failed: Connection refused\\nhttp://127.0.0.1:1/v.mp4: Connection refused", codeDownloadFailed},
+		{"not media", "https://example.com/v.mp4: Invalid data found when processing input", codeInvalidInputMedia},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnv(t)
+			replaceFFprobe(t, "printf '"+tt.stderr+"\\n' >&2\nexit 1\n")
+			var resp FFmpegResponse
+			rec := dryRun(t, `{"video_url":"https://example.com/v.mp4?token=secret","dry_run":true}`, nil, &resp)
+			if resp.Code != tt.wantCode || rec.Code != codeStatus[tt.wantCode] {
+				t.Errorf("failed with %d %s, want %s: %s", rec.Code, resp.Code, tt.wantCode, resp.Error)
+			}
+		})
+	}
+}
+
+func TestDryRunProbesObjectThroughPresignedURL(t *testing.T) {
+	setupTestEnv(t)
+	s3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			t.Errorf("unexpected %s request, authorization %q", r.Method, r.Header.Get("Authorization"))
+		}
+		w.Header().Set("Content-Length", "5000")
+	}))
+	t.Cleanup(s3.Close)
+	cfg.S3.Endpoint, cfg.S3.Region = s3.URL, "auto"
+	cfg.S3.AccessKeyID, cfg.S3.SecretAccessKey = "AKID", "secret"
+
+	args := filepath.Join(t.TempDir(), "args")
+	replaceFFprobe(t, `for a in "$@"; do last="$a"; done
+echo "$last" > `+args+`
+echo '{"streams":[{"index":0,"codec_type":"audio","codec_name":"aac","channels":2}],"format":{"duration":"2.0"}}'
+`)
+
+	var resp DryRunResponse
+	rec := dryRun(t, `{"source":{"bucket":"media","key":"clips/a b.mp4"},"dry_run":true}`, nil, &resp)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry run answered %d: %s", rec.Code, rec.Body.String())
+	}
+	probed, _ := os.ReadFile(args)
+	url := strings.TrimSpace(string(probed))
+	if !strings.HasPrefix(url, s3.URL+"/media/clips/a%20b.mp4?") || !strings.Contains(url, "X-Amz-Credential=AKID%2F") || !strings.Contains(url, "&X-Amz-Signature=") {
+		t.Errorf("ffprobe read %q, want a presigned object URL", url)
+	}
+	if resp.SourceSize != 5000 || resp.EstimatedSize == 0 || resp.Probe == nil {
+		t.Errorf("source size %d, estimate %d, probe %v", resp.SourceSize, resp.EstimatedSize, resp.Probe)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+)
+
+// Stable error codes returned in FFmpegResponse.Code. Clients should branch
+// on these rather than on the free-text message.
+const (
+	codeInvalidRequest       = "invalid_request"
+	codeMethodNotAllowed     = "method_not_allowed"
+	codeUnsupportedFormat    = "unsupported_format"
+	codeSourceTooLarge       = "source_too_large"
+	codeOutputTooLarge       = "output_too_large"
+	codeDownloadFailed       = "download_failed"
+	codeStorageNotConfigured = "storage_not_configured"
+	codeInvalidInputMedia    = "invalid_input_media"
+	codeTranscodeTimeout     = "transcode_timeout"
+	codeTranscodeFailed      = "transcode_failed"
+	codeInsufficientStorage  = "insufficient_storage"
+	codeNotFound             = "not_found"
+	codeInvalidSignature     = "invalid_signature"
+	codeLinkExpired          = "link_expired"
+	codeUpstreamFailed       = "upstream_failed"
+	codeDraining             = "draining"
+	codeUnauthorized         = "unauthorized"
+	codeQueueFull            = "queue_full"
+	codeQueueTimeout         = "queue_timeout"
+	codeInterrupted          = "interrupted"
+	codeCanceled             = "canceled"
+	codeIdempotencyConflict  = "idempotency_conflict"
+	codeRequestInProgress    = "request_in_progress"
+	codeAlreadyExists        = "already_exists"
+	codeReadOnly             = "read_only"
+	codeInternal             = "internal_error"
+)
+
+// statusClientClosedRequest is the non-standard status, borrowed from nginx,
+// for a request the client abandoned. The client never reads it; it is for
+// the access log and the metrics.
+const statusClientClosedRequest = 499
+
+// codeStatus maps each error code to its HTTP status
+var codeStatus = map[string]int{
+	codeInvalidRequest:       http.StatusBadRequest,
+	codeMethodNotAllowed:     http.StatusMethodNotAllowed,
+	codeUnsupportedFormat:    http.StatusBadRequest,
+	codeSourceTooLarge:       http.StatusRequestEntityTooLarge,
+	codeOutputTooLarge:       http.StatusRequestEntityTooLarge,
+	codeDownloadFailed:       http.StatusBadGateway,
+	codeStorageNotConfigured: http.StatusServiceUnavailable,
+	codeInvalidInputMedia:    http.StatusUnprocessableEntity,
+	codeTranscodeTimeout:     http.StatusGatewayTimeout,
+	codeTranscodeFailed:      http.StatusInternalServerError,
+	codeInsufficientStorage:  http.StatusInsufficientStorage,
+	codeNotFound:             http.StatusNotFound,
+	codeInvalidSignature:     http.StatusForbidden,
+	codeLinkExpired:          http.StatusForbidden,
+	codeUpstreamFailed:       http.StatusBadGateway,
+	codeDraining:             http.StatusServiceUnavailable,
+	codeUnauthorized:         http.StatusUnauthorized,
+	codeQueueFull:            http.StatusTooManyRequests,
+	codeQueueTimeout:         http.StatusServiceUnavailable,
+	codeInterrupted:          http.StatusServiceUnavailable,
+	codeCanceled:             statusClientClosedRequest,
+	codeIdempotencyConflict:  http.StatusConflict,
+	codeRequestInProgress:    http.StatusConflict,
+	codeAlreadyExists:        http.StatusConflict,
+	codeReadOnly:             http.StatusConflict,
+	codeInternal:             http.StatusInternalServerError,
+}
+
+// apiError is a failure reported to clients with a stable code, a short
+// message and optional details such as FFmpeg's stderr
+type apiError struct {
+	Code      string
+	Message   string
+	Details   string
+	Diagnosis *ffmpegDiagnosis // set for classified FFmpeg failures
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+// Status returns the HTTP status for the error's code
+func (e *apiError) Status() int {
+	if status, ok := codeStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+func newAPIError(code, message string) *apiError {
+	return &apiError{Code: code, Message: message}
+}
+
+func newAPIErrorf(code, format string, args ...any) *apiError {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// withDetails attaches diagnostic output that is too noisy for the message
+func (e *apiError) withDetails(details string) *apiError {
+	e.Details = details
+	return e
+}
+
+// asAPIError returns err as an *apiError, classifying anything else with
+// the fallback code
+func asAPIError(err error, fallback string) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	return newAPIError(fallback, err.Error())
+}
+
+// ffmpegError classifies a failed FFmpeg run: a run stopped by shutdown is a
+// draining error, one stopped because the client went away is cancelled, a
+// deadline is a timeout, a non-zero exit is diagnosed from stderr, anything
+// else is ours. The context is checked first, since a killed FFmpeg exits
+// non-zero with stderr that says nothing about the input.
+func ffmpegError(ctx context.Context, err error, output []byte) *apiError {
+	if errors.Is(ctx.Err(), context.Canceled) {
+		if health.draining.Load() {
+			return newAPIError(codeDraining, "Server shut down before FFmpeg finished, retry on another instance")
+		}
+		return newAPIError(codeCanceled, "Request cancelled before FFmpeg finished")
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		deadline, _ := ctx.Deadline()
+		return newAPIError(codeTranscodeTimeout, "FFmpeg processing timed out. File may be too large for processing.").
+			withDetails(fmt.Sprintf("deadline %s", deadline.Format("15:04:05.000")))
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		diagnosis := diagnoseFFmpeg(string(output))
+		code := codeInvalidInputMedia
+		if !diagnosis.inputFault() {
+			code = codeTranscodeFailed
+		}
+		return &apiError{
+			Code:      code,
+			Message:   diagnosis.Message,
+			Details:   string(output),
+			Diagnosis: diagnosis,
+		}
+	}
+	return newAPIErrorf(codeTranscodeFailed, "Failed to run FFmpeg: %v", err).withDetails(string(output))
+}
+
+// writeError writes err as a JSON FFmpegResponse with the matching status.
+// Errors that are not *apiError are reported as internal errors. Server
+// errors are logged with r's context, so the line carries the request and
+// job IDs.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	apiErr := asAPIError(err, codeInternal)
+	if apiErr.Status() >= 500 {
+		slog.ErrorContext(r.Context(), "Request failed", "code", apiErr.Code, "error", apiErr.Message)
+	}
+
+	writeJSON(w, apiErr.Status(), FFmpegResponse{
+		Success:   false,
+		Error:     apiErr.Message,
+		Code:      apiErr.Code,
+		Details:   apiErr.Details,
+		Diagnosis: apiErr.Diagnosis,
+	})
+}
+
+// writeJSON writes v as a JSON body with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	if rec, ok := w.(jobRecorder); ok {
+		rec.recordOutcome(v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteErrorLogsWithRequestContext(t *testing.T) {
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := withLogAttrs(r.Context(), slog.String("job_id", "job-1"))
+		writeError(w, r.WithContext(ctx), newAPIError(codeInternal, "boom"))
+	}))
+	req := httptest.NewRequest(http.MethodPost, "/v1/extract-audio", nil)
+	req.Header.Set("X-Request-ID", "req-1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", rec.Code)
+	}
+	var line map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("log output %q: %v", buf.String(), err)
+	}
+	if line["msg"] != "Request failed" || line["request_id"] != "req-1" || line["job_id"] != "job-1" || line["code"] != codeInternal {
+		t.Errorf("log line = %v, want the request and job IDs", line)
+	}
+}
+
+func TestWriteErrorDoesNotLogClientErrors(t *testing.T) {
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	rec := httptest.NewRecorder()
+	writeError(rec, httptest.NewRequest(http.MethodPost, "/", nil), newAPIError(codeInvalidRequest, "bad"))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("client error was logged: %s", buf.String())
+	}
+}
+
+func TestErrorTableMatchesCodeStatus(t *testing.T) {
+	readme, err := os.ReadFile("../README.md")
+	if err != nil {
+		t.Skipf("README not available: %v", err)
+	}
+	documented := map[string]int{}
+	row := regexp.MustCompile("(?m)^\\| (`[a-z_]+`(?:, `[a-z_]+`)*) \\| (\\d{3}) \\|$")
+	for _, m := range row.FindAllStringSubmatch(string(readme), -1) {
+		status, _ := strconv.Atoi(m[2])
+		for _, code := range strings.Split(m[1], ", ") {
+			documented[strings.Trim(code, "`")] = status
+		}
+	}
+	for code, status := range codeStatus {
+		if documented[code] != status {
+			t.Errorf("README documents %s as %d, codeStatus maps it to %d", code, documented[code], status)
+		}
+	}
+	for code := range documented {
+		if _, ok := codeStatus[code]; !ok {
+			t.Errorf("README documents unknown code %s", code)
+		}
+	}
+	if status := (&apiError{Code: "no_such_code"}).Status(); status != http.StatusInternalServerError {
+		t.Errorf("unknown code maps to %d, want 500", status)
+	}
+}
+
+func TestCanceledErrorIsNotLogged(t *testing.T) {
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+
+	rec := httptest.NewRecorder()
+	writeError(rec, httptest.NewRequest(http.MethodPost, "/", nil), newAPIError(codeCanceled, "gone"))
+	if rec.Code != statusClientClosedRequest || buf.Len() != 0 {
+		t.Errorf("cancelled request answered %d and logged %q", rec.Code, buf.String())
+	}
+}
+
+func TestClientDisconnectCancelsTheJob(t *testing.T) {
+	setupTestEnv(t)
+	bin := filepath.SplitList(os.Getenv("PATH"))[0]
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte("#!/bin/sh\nexec sleep 10\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	body := `{"video_url":"` + serveVideo(t) + `"}`
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/extract-audio", strings.NewReader(body)).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		extractRoute(strict(trackJob(ffmpegHandler)))(rec, req)
+		close(done)
+	}()
+	waitFor(t, func() bool {
+		running, _ := ffmpegPool.stats()
+		return running > 0
+	})
+	disconnect()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler did not return after the client went away")
+	}
+
+	if rec.Code != statusClientClosedRequest {
+		t.Errorf("answered %d: %s", rec.Code, rec.Body)
+	}
+	st, _ := journal.get(rec.Header().Get("X-Job-ID"))
+	if st.Status != jobFailed || st.Error == nil || st.Error.Code != codeCanceled {
+		t.Errorf("journaled job = %+v, want failed with %s", st, codeCanceled)
+	}
+}
+
+func TestFFmpegError(t *testing.T) {
+	setupTestEnv(t)
+	exitErr := exec.Command("sh", "-c", "exit 1").Run()
+	expired, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	stopped, stop := context.WithCancel(context.Background())
+	stop()
+
+	tests := []struct {
+		name     string
+		ctx      context.Context
+		draining bool
+		err      error
+		stderr   string
+		code     string
+	}{
+		{"unreadable input", context.Background(), false, exitErr, "moov atom not found\nInvalid data found when processing input", codeInvalidInputMedia},
+		{"unrecognised failure", context.Background(), false, exitErr, "something odd happened", codeTranscodeFailed},
+		{"not started", context.Background(), false, errors.New(`exec: "ffmpeg": executable file not found in $PATH`), "", codeTranscodeFailed},
+		{"deadline", expired, false, exitErr, "killed", codeTranscodeTimeout},
+		{"stopped by shutdown", stopped, true, exitErr, "killed", codeDraining},
+		{"client went away", stopped, false, exitErr, "Invalid data found when processing input", codeCanceled},
+		{"client went away before the exit", stopped, false, errors.New("signal: killed"), "", codeCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health.draining.Store(tt.draining)
+			defer health.draining.Store(false)
+			apiErr := ffmpegError(tt.ctx, tt.err, []byte(tt.stderr))
+			if apiErr.Code != tt.code {
+				t.Errorf("ffmpegError() = %s %q, want %s", apiErr.Code, apiErr.Message, tt.code)
+			}
+			if tt.code == codeInvalidInputMedia && (apiErr.Diagnosis == nil || apiErr.Details != tt.stderr) {
+				t.Errorf("diagnosed error = %+v, want the diagnosis and stderr", apiErr)
+			}
+		})
+	}
+}
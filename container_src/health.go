@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"time"
+)
+
+// healthState tracks what the health endpoints report: whether the server is
+// draining for shutdown and how many jobs are in flight
+type healthState struct {
+	started       time.Time
+	draining      atomic.Bool
+	activeJobs    atomic.Int64
+	maxActiveJobs int64         // readiness fails at or above this many jobs
+	drainDelay    time.Duration // how long /readyz reports draining before the listener closes
+}
+
+// health is the process-wide health state
+var health *healthState
+
+// newHealthFromConfig applies the readiness capacity and drain delay from cfg
+func newHealthFromConfig() *healthState {
+	return &healthState{
+		started:       time.Now(),
+		maxActiveJobs: cfg.Health.ReadyMaxActiveJobs,
+		drainDelay:    cfg.Health.DrainDelay.std(),
+	}
+}
+
+// startDraining marks the server as shutting down and waits for the drain
+// delay so load balancers polling /readyz stop routing to it
+func (h *healthState) startDraining() {
+	h.draining.Store(true)
+	slog.Info("Draining: /readyz now reports unavailable", "drain_delay", h.drainDelay.String())
+	time.Sleep(h.drainDelay)
+}
+
+// trackJob counts a processing request as an active job and refuses new jobs
+// once the server is draining or the FFmpeg queue is full. Accepted jobs are
+// journaled under the ID returned in X-Job-ID; a handler that finds the
+// request is a dry run drops it again with untrackDryRun.
+func trackJob(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if health.draining.Load() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, newAPIError(codeDraining, "Server is shutting down, retry on another instance"))
+			return
+		}
+		if rejectIfSaturated(w, r) {
+			return
+		}
+		health.activeJobs.Add(1)
+		defer health.activeJobs.Add(-1)
+		id := jobIDFrom(r.Context()) // assigned up front for idempotent requests
+		if id == "" {
+			id = newJobID()
+		}
+		w.Header().Set("X-Job-ID", id)
+		journal.create(r.Context(), id, r.URL.Path)
+		defer finishJob(id)
+		ctx := context.WithValue(r.Context(), jobIDKey{}, id)
+		next(&jobWriter{ResponseWriter: w, id: id}, r.WithContext(withLogAttrs(ctx, slog.String("job_id", id))))
+	}
+}
+
+type jobIDKey struct{}
+
+// newJobID returns an identifier that ties together the log lines of one job
+func newJobID() string {
+	return "job_" + newRequestID()[:16]
+}
+
+// jobIDFrom returns the job ID assigned by trackJob, or "" outside a job
+func jobIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	return id
+}
+
+// readinessCheck is the outcome of one dependency check
+type readinessCheck struct {
+	Name    string `json:"name"`
+	OK      bool   `json:"ok"`
+	Message string `json:"message,omitempty"`
+}
+
+// healthResponse is the body of /healthz and /readyz
+type healthResponse struct {
+	Status        string           `json:"status"`
+	InstanceID    string           `json:"instance_id,omitempty"`
+	UptimeSeconds int64            `json:"uptime_seconds"`
+	ActiveJobs    int64            `json:"active_jobs"`
+	Checks        []readinessCheck `json:"checks,omitempty"`
+}
+
+func (h *healthState) response(status string) healthResponse {
+	return healthResponse{
+		Status:        status,
+		InstanceID:    os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID"),
+		UptimeSeconds: int64(time.Since(h.started) / time.Second),
+		ActiveJobs:    h.activeJobs.Load(),
+	}
+}
+
+// checks runs every readiness check
+func (h *healthState) checks() []readinessCheck {
+	var checks []readinessCheck
+
+	for _, tool := range []string{"ffmpeg", "ffprobe"} {
+		c := readinessCheck{Name: tool, OK: true}
+		if path, err := exec.LookPath(tool); err != nil {
+			c.OK, c.Message = false, err.Error()
+		} else {
+			c.Message = path
+		}
+		checks = append(checks, c)
+	}
+
+	writable := readinessCheck{Name: "temp_dir_writable", OK: true, Message: tempFiles.dir}
+	if err := probeWritable(tempFiles.dir); err != nil {
+		writable.OK, writable.Message = false, err.Error()
+	}
+	checks = append(checks, writable)
+
+	space := readinessCheck{Name: "temp_dir_free_space", OK: true}
+	if free, err := tempFiles.freeSpace(); err != nil {
+		space.OK, space.Message = false, err.Error()
+	} else {
+		space.OK = free > tempFiles.minFree
+		space.Message = fmt.Sprintf("%.1f MB free, %.1f MB required",
+			float64(free)/(1024*1024), float64(tempFiles.minFree)/(1024*1024))
+	}
+	checks = append(checks, space)
+
+	active := h.activeJobs.Load()
+	checks = append(checks, readinessCheck{
+		Name:    "job_capacity",
+		OK:      active < h.maxActiveJobs,
+		Message: fmt.Sprintf("%d of %d job slots in use", active, h.maxActiveJobs),
+	})
+
+	running, queued := ffmpegPool.stats()
+	checks = append(checks, readinessCheck{
+		Name:    "ffmpeg_queue",
+		OK:      !ffmpegPool.saturated(),
+		Message: fmt.Sprintf("%d running, %d of %d queued", running, queued, ffmpegPool.maxQueue),
+	})
+
+	return checks
+}
+
+// probeWritable creates and removes a file in dir
+func probeWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// healthzHandler reports that the process is alive. It stays 200 while
+// draining so the orchestrator does not restart an instance finishing jobs.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	status := "ok"
+	if health.draining.Load() {
+		status = "draining"
+	}
+	writeJSON(w, http.StatusOK, health.response(status))
+}
+
+// readyzHandler reports whether this instance should receive new jobs: 200
+// when every dependency check passes, 503 when one fails or while draining
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	resp := health.response("ready")
+	resp.Checks = health.checks()
+
+	status := http.StatusOK
+	for _, c := range resp.Checks {
+		if !c.OK {
+			resp.Status = "not_ready"
+			status = http.StatusServiceUnavailable
+		}
+	}
+	if health.draining.Load() {
+		resp.Status = "draining"
+		status = http.StatusServiceUnavailable
+	}
+
+	if status != http.StatusOK {
+		w.Header().Set("Retry-After", "5")
+	}
+	writeJSON(w, status, resp)
+}
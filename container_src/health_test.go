@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(t *testing.T)
+		status string
+		failed []string // the checks that should fail
+	}{
+		{"ready", func(t *testing.T) {}, "ready", nil},
+		{"draining", func(t *testing.T) { health.draining.Store(true) }, "draining", nil},
+		{"ffmpeg missing", func(t *testing.T) { t.Setenv("PATH", t.TempDir()) }, "not_ready", []string{"ffmpeg", "ffprobe"}},
+		{"disk full", func(t *testing.T) { tempFiles.minFree = math.MaxInt64 }, "not_ready", []string{"temp_dir_free_space"}},
+		{"at job capacity", func(t *testing.T) { health.activeJobs.Store(health.maxActiveJobs) }, "not_ready", []string{"job_capacity"}},
+		{"ffmpeg queue full", func(t *testing.T) {
+			cfg.Workers.FFmpegConcurrency, cfg.Workers.QueueSize = 1, 0
+			newWorkPoolsFromConfig()
+			release, err := ffmpegPool.acquire(context.Background(), jobTicket{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(release)
+		}, "not_ready", []string{"ffmpeg_queue"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnv(t)
+			tt.setup(t)
+
+			rec := httptest.NewRecorder()
+			readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			var resp healthResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			wantCode := http.StatusServiceUnavailable
+			if tt.status == "ready" {
+				wantCode = http.StatusOK
+			}
+			if rec.Code != wantCode || resp.Status != tt.status {
+				t.Errorf("readyz = %d %s, want %d %s", rec.Code, resp.Status, wantCode, tt.status)
+			}
+			if (rec.Header().Get("Retry-After") != "") != (wantCode != http.StatusOK) {
+				t.Errorf("Retry-After = %q on a %d", rec.Header().Get("Retry-After"), rec.Code)
+			}
+			if len(resp.Checks) != 6 {
+				t.Errorf("readyz ran %d checks, want 6", len(resp.Checks))
+			}
+			for _, c := range resp.Checks {
+				if c.OK == slices.Contains(tt.failed, c.Name) {
+					t.Errorf("check %s ok=%v: %s", c.Name, c.OK, c.Message)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthzStaysUpWhileDraining(t *testing.T) {
+	setupTestEnv(t)
+	health.activeJobs.Store(2)
+	for _, draining := range []bool{false, true} {
+		health.draining.Store(draining)
+		rec := httptest.NewRecorder()
+		healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		var resp healthResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		want := map[bool]string{false: "ok", true: "draining"}[draining]
+		if rec.Code != http.StatusOK || resp.Status != want || resp.ActiveJobs != 2 || resp.Checks != nil {
+			t.Errorf("healthz while draining=%v = %d %+v, want 200 %s", draining, rec.Code, resp, want)
+		}
+	}
+}
+
+func TestTrackJobRefusesWhileDraining(t *testing.T) {
+	setupTestEnv(t)
+	health.draining.Store(true)
+	ran := false
+	h := trackJob(func(http.ResponseWriter, *http.Request) { ran = true })
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/extract-audio", nil))
+	if ran || rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" || rec.Header().Get("X-Job-ID") != "" {
+		t.Errorf("draining trackJob answered %d %v (handler ran: %v)", rec.Code, rec.Header(), ran)
+	}
+	if health.activeJobs.Load() != 0 {
+		t.Errorf("refused job counted as active")
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// keyBinding ties an Idempotency-Key to the job it started. The job may not
+// be in the journal yet while its request is still being admitted.
+type keyBinding struct {
+	job  string
+	hash string
+}
+
+// idempotencyClaim is the key, its scope and the request hash trackJob
+// journals with a job
+type idempotencyClaim struct {
+	key   string
+	scope string
+	hash  string
+}
+
+type idempotencyKey struct{}
+
+func idempotencyFrom(ctx context.Context) *idempotencyClaim {
+	claim, _ := ctx.Value(idempotencyKey{}).(*idempotencyClaim)
+	return claim
+}
+
+var (
+	errIdempotencyConflict = errors.New("idempotency key reused with a different request")
+	errOutputGone          = errors.New("output no longer cached")
+)
+
+// idempotencyScope namespaces Idempotency-Keys by caller, method and route,
+// so callers that happen to pick the same key never see each other's jobs.
+// The caller is identified by its Authorization header or, without one, by
+// the request's instance_id. The scope is a hash, so no credential is
+// journaled.
+func idempotencyScope(r *http.Request, body []byte) string {
+	caller := "authorization:" + r.Header.Get("Authorization")
+	if r.Header.Get("Authorization") == "" {
+		var tenant struct {
+			InstanceID string `json:"instance_id"`
+		}
+		json.Unmarshal(body, &tenant)
+		caller = "instance_id:" + tenant.InstanceID
+	}
+	sum := sha256.Sum256([]byte(r.Method + " " + r.URL.Path + "\n" + caller))
+	return hex.EncodeToString(sum[:16])
+}
+
+// scopedKey is the name a key is bound under in jobJournal.keys
+func scopedKey(scope, key string) string {
+	return scope + " " + key
+}
+
+// bindKeyLocked points st's key at st unless a newer job already holds it
+func (j *jobJournal) bindKeyLocked(st *jobState) {
+	if st.IdempotencyKey == "" {
+		return
+	}
+	name := scopedKey(st.IdempotencyScope, st.IdempotencyKey)
+	if b, ok := j.keys[name]; ok {
+		if other, ok := j.jobs[b.job]; ok && other.CreatedAt.After(st.CreatedAt) {
+			return
+		}
+	}
+	j.keys[name] = keyBinding{job: st.ID, hash: st.RequestHash}
+}
+
+// unbindKeyLocked drops st's key if it still points at st
+func (j *jobJournal) unbindKeyLocked(st *jobState) {
+	name := scopedKey(st.IdempotencyScope, st.IdempotencyKey)
+	if b, ok := j.keys[name]; ok && b.job == st.ID {
+		delete(j.keys, name)
+	}
+}
+
+// reserveKey looks up the job bound to the scoped key name. If there is none, or it failed,
+// or it succeeded without a replayable result, the key is bound to id and ""
+// is returned so the caller starts a new job. Otherwise the bound job is
+// returned: one still in flight, or one whose result can be replayed.
+// Replays need the output, so a result whose output is neither published
+// nor cached any more, e.g. after a restart with the cache disabled, runs
+// the job again.
+func (j *jobJournal) reserveKey(name, hash, id string) (string, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if b, ok := j.keys[name]; ok {
+		if b.hash != hash {
+			return "", errIdempotencyConflict
+		}
+		st, created := j.jobs[b.job]
+		if !created || !st.Status.final() || replayable(st) {
+			return b.job, nil
+		}
+	}
+	j.keys[name] = keyBinding{job: id, hash: hash}
+	return "", nil
+}
+
+// replayable reports whether a finished job's response can be replayed
+func replayable(st *jobState) bool {
+	if st.Status != jobSucceeded || st.Result == nil {
+		return false
+	}
+	if st.Result.DownloadURL != "" && artifacts.lookup(st.Result.DownloadURL) != nil {
+		return true
+	}
+	return results.contains(st.ResultKey)
+}
+
+// replayResponse rebuilds a finished job's response. A published output gets
+// a freshly signed URL; one the janitor or a restart removed is published
+// again from the result cache, and audio returned inline is read back from
+// it. It fails with errOutputGone if the output left the cache since
+// replayable was checked.
+func replayResponse(st jobState) (FFmpegResponse, error) {
+	resp := *st.Result
+	if resp.DownloadURL != "" {
+		art := artifacts.lookup(resp.DownloadURL)
+		if art == nil {
+			p := audioProfiles[st.Params.Profile]
+			path := filepath.Join(cfg.Storage.ProcessingDir, resp.FileName)
+			if !results.materialize(st.ResultKey, path) {
+				return resp, errOutputGone
+			}
+			art = artifacts.register(path, p, tempFiles.trackOutput(path))
+		}
+		resp.DownloadURL = artifacts.signedURL(art)
+		resp.AudioURL = resp.DownloadURL
+		return resp, nil
+	}
+
+	path := filepath.Join(cfg.Storage.ProcessingDir, "replay_"+st.ID+"_"+strconv.FormatInt(time.Now().UnixNano(), 10))
+	tempFiles.trackInput(path)
+	defer tempFiles.release(path)
+	if !results.materialize(st.ResultKey, path) {
+		return resp, errOutputGone
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return resp, err
+	}
+	resp.AudioData = base64.StdEncoding.EncodeToString(data)
+	return resp, nil
+}
+
+// releaseKey drops a reservation whose request was refused before its job
+// was created, such as one turned away while draining
+func (j *jobJournal) releaseKey(name, id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, created := j.jobs[id]; !created && j.keys[name].job == id {
+		delete(j.keys, name)
+	}
+}
+
+// idempotent lets clients retry a request safely by sending an
+// Idempotency-Key header. The first request with a key runs as usual. A
+// retry with the same key and body gets the job's response again, waiting
+// for the job if it is still running; a retry of a failed job runs it anew.
+// Reusing a key with a different body is refused with 409. Keys are scoped
+// by idempotencyScope.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 || !printableASCII(key) {
+			writeError(w, r, newAPIError(codeInvalidRequest, "Idempotency-Key must be at most 255 printable ASCII characters"))
+			return
+		}
+		if journal == nil {
+			slog.WarnContext(r.Context(), "Ignoring Idempotency-Key, job journal disabled")
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			if bodyTooLarge(err) {
+				writeError(w, r, newAPIError(codeSourceTooLarge, "Request body too large"))
+			} else {
+				writeError(w, r, newAPIErrorf(codeInvalidRequest, "Failed to read request body: %v", err))
+			}
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := requestHash(body)
+		scope := idempotencyScope(r, body)
+		name := scopedKey(scope, key)
+		ctx := withLogAttrs(r.Context(), slog.String("idempotency_key", key))
+
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for waited := false; ; waited = true {
+			id := newJobID()
+			existing, err := journal.reserveKey(name, hash, id)
+			if errors.Is(err, errIdempotencyConflict) {
+				writeError(w, r, newAPIError(codeIdempotencyConflict, "Idempotency-Key was already used with a different request body"))
+				return
+			}
+			if existing == "" {
+				ctx = context.WithValue(ctx, idempotencyKey{}, &idempotencyClaim{key: key, scope: scope, hash: hash})
+				next(w, r.WithContext(context.WithValue(ctx, jobIDKey{}, id)))
+				journal.releaseKey(name, id)
+				return
+			}
+
+			st, _ := journal.get(existing)
+			if st.Status == jobSucceeded && st.Result != nil {
+				resp, err := replayResponse(st)
+				if errors.Is(err, errOutputGone) {
+					// Evicted since reserveKey looked; the next pass runs the job again
+					slog.InfoContext(ctx, "Earlier result no longer replayable", "job_id", existing)
+					continue
+				}
+				if err != nil {
+					writeError(w, r, newAPIErrorf(codeInternal, "Failed to replay earlier result: %v", err))
+					return
+				}
+				slog.InfoContext(ctx, "Replaying result of an earlier request", "job_id", existing)
+				w.Header().Set("X-Job-ID", existing)
+				w.Header().Set("Idempotent-Replayed", "true")
+				writeJSON(w, http.StatusOK, resp)
+				return
+			}
+			if !waited {
+				slog.InfoContext(ctx, "Waiting for the job of an earlier request", "job_id", existing)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				w.Header().Set("X-Job-ID", existing)
+				writeError(w, r, newAPIError(codeRequestInProgress, "The job for this Idempotency-Key is still running; retry later or poll GET /v1/jobs/{id} with the X-Job-ID header"))
+				return
+			}
+		}
+	}
+}
+
+// requestHash hashes a JSON body with its keys sorted and whitespace
+// removed, so a retry that re-encodes the same request still matches.
+// Anything that is not JSON is hashed as is.
+func requestHash(body []byte) string {
+	var v any
+	if err := json.Unmarshal(body, &v); err == nil {
+		if normalized, err := json.Marshal(v); err == nil {
+			body = normalized
+		}
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func printableASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// extract posts body to the extraction route with an Idempotency-Key
+func extract(t *testing.T, key, body string) (*httptest.ResponseRecorder, FFmpegResponse) {
+	t.Helper()
+	h := extractRoute(strict(idempotent(trackJob(ffmpegHandler))))
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/extract-audio", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+
+	var resp FFmpegResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unreadable response %q: %v", rec.Body.String(), err)
+	}
+	if !resp.Success {
+		t.Fatalf("extraction failed: %s (%s)", resp.Error, resp.Code)
+	}
+	return rec, resp
+}
+
+func TestIdempotentRetryRunsFFmpegOnce(t *testing.T) {
+	for _, inline := range []bool{false, true} {
+		name := "download_url"
+		if inline {
+			name = "audio_data"
+		}
+		t.Run(name, func(t *testing.T) {
+			ffmpegRuns := setupTestEnv(t)
+			body, _ := json.Marshal(FFmpegRequest{VideoURL: serveVideo(t), UseR2Storage: inline})
+
+			first, firstResp := extract(t, "retry-"+name, string(body))
+			second, secondResp := extract(t, "retry-"+name, string(body))
+
+			if n := ffmpegRuns(); n != 1 {
+				t.Errorf("ffmpeg ran %d times, want 1", n)
+			}
+			if second.Header().Get("Idempotent-Replayed") != "true" {
+				t.Error("retry was not replayed")
+			}
+			if a, b := first.Header().Get("X-Job-ID"), second.Header().Get("X-Job-ID"); a != b {
+				t.Errorf("retry answered by job %s, want %s", b, a)
+			}
+			if secondResp.AudioData != firstResp.AudioData || secondResp.FileName != firstResp.FileName {
+				t.Errorf("replayed response differs: %+v, want %+v", secondResp, firstResp)
+			}
+		})
+	}
+}
+
+func TestIdempotentReplayAfterOutputLost(t *testing.T) {
+	ffmpegRuns := setupTestEnv(t)
+	body, _ := json.Marshal(FFmpegRequest{VideoURL: serveVideo(t)})
+	_, first := extract(t, "restart", string(body))
+
+	// A restart sweeps the published output and forgets every artifact
+	os.Remove(filepath.Join(cfg.Storage.ProcessingDir, first.FileName))
+	artifacts = newArtifactRegistryFromConfig()
+
+	rec, replayed := extract(t, "restart", string(body))
+	if rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatal("retry was not replayed")
+	}
+	if n := ffmpegRuns(); n != 1 {
+		t.Errorf("ffmpeg ran %d times, want 1", n)
+	}
+	u, err := url.Parse(replayed.DownloadURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimPrefix(u.Path, apiVersionPrefix+"/download/")
+	if _, err := artifacts.resolve(id, u.Query().Get("expires"), u.Query().Get("sig")); err != nil {
+		t.Errorf("replayed download_url does not resolve: %v", err)
+	}
+}
+
+func TestIdempotencyScope(t *testing.T) {
+	request := func(method, path, auth string) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		return r
+	}
+	body := []byte(`{"video_url":"https://example.com/v.mp4","instance_id":"a"}`)
+	base := idempotencyScope(request(http.MethodPost, "/v1/extract-audio", ""), body)
+
+	tests := []struct {
+		name string
+		req  *http.Request
+		body []byte
+		same bool
+	}{
+		{"same caller", request(http.MethodPost, "/v1/extract-audio", ""), []byte(`{"instance_id":"a","video_url":"https://example.com/w.mp4"}`), true},
+		{"other instance_id", request(http.MethodPost, "/v1/extract-audio", ""), []byte(`{"instance_id":"b"}`), false},
+		{"no instance_id", request(http.MethodPost, "/v1/extract-audio", ""), []byte(`{}`), false},
+		{"authorized caller", request(http.MethodPost, "/v1/extract-audio", "Bearer t1"), body, false},
+		{"other route", request(http.MethodPost, "/ffmpeg/extract-audio", ""), body, false},
+		{"other method", request(http.MethodPut, "/v1/extract-audio", ""), body, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := idempotencyScope(tt.req, tt.body); (got == base) != tt.same {
+				t.Errorf("scope %s vs %s, want same=%v", got, base, tt.same)
+			}
+		})
+	}
+
+	// a token identifies the caller whatever instance_id it sends
+	t1 := idempotencyScope(request(http.MethodPost, "/v1/extract-audio", "Bearer t1"), []byte(`{"instance_id":"x"}`))
+	if t1 != idempotencyScope(request(http.MethodPost, "/v1/extract-audio", "Bearer t1"), body) {
+		t.Error("one token got two scopes")
+	}
+	if t1 == idempotencyScope(request(http.MethodPost, "/v1/extract-audio", "Bearer t2"), body) {
+		t.Error("two tokens share a scope")
+	}
+	if strings.Contains(t1, "t1") {
+		t.Error("scope carries the token")
+	}
+}
+
+func TestIdempotencyKeyIsNotSharedBetweenCallers(t *testing.T) {
+	ffmpegRuns := setupTestEnv(t)
+	video := serveVideo(t)
+	post := func(auth, instance string) *httptest.ResponseRecorder {
+		body := `{"video_url":"` + video + `","instance_id":"` + instance + `"}`
+		req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/extract-audio", strings.NewReader(body))
+		req.Header.Set("Idempotency-Key", "shared")
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		extractRoute(strict(idempotent(trackJob(ffmpegHandler))))(rec, req)
+		return rec
+	}
+
+	calls := []struct {
+		auth, instance string
+		replayed       bool
+	}{
+		{"Bearer alice", "a", false},
+		{"Bearer bob", "a", false},  // same body, other caller
+		{"", "a", false},            // no token, so identified by instance_id
+		{"", "b", false},            // another tenant, no conflict with a's body
+		{"Bearer alice", "a", true}, // alice's own retry
+		{"Bearer alice", "other", false},
+	}
+	jobs := map[string]bool{}
+	for i, c := range calls {
+		rec := post(c.auth, c.instance)
+		replayed := rec.Header().Get("Idempotent-Replayed") == "true"
+		if c.auth == "Bearer alice" && c.instance == "other" {
+			// alice reusing her key with another body is still a conflict
+			if rec.Code != http.StatusConflict {
+				t.Errorf("call %d answered %d, want 409: %s", i, rec.Code, rec.Body)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK || replayed != c.replayed {
+			t.Errorf("call %d answered %d replayed=%v, want 200 replayed=%v: %s", i, rec.Code, replayed, c.replayed, rec.Body)
+		}
+		jobs[rec.Header().Get("X-Job-ID")] = true
+	}
+	if len(jobs) != 4 || ffmpegRuns() != 1 {
+		// the result cache still shares the transcode between the four jobs
+		t.Errorf("%d jobs and %d ffmpeg runs, want 4 jobs sharing one run", len(jobs), ffmpegRuns())
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// janitor owns the files under the processing directory. Every input and output is
+// tracked with an expiry, orphans from a previous run are swept on startup,
+// and new jobs are refused once the directory exceeds its disk budget.
+type janitor struct {
+	mu        sync.Mutex
+	dir       string
+	maxBytes  int64 // budget for everything under dir, including the cache
+	minFree   int64 // free space the filesystem must keep after a job
+	outputTTL time.Duration
+	inputTTL  time.Duration
+	artifacts map[string]*trackedFile
+	reserved  map[string]bool // subdirectories managed by someone else
+}
+
+type trackedFile struct {
+	expires time.Time
+	output  bool // finished outputs may be expired early under disk pressure
+}
+
+// tempFiles is the process-wide janitor for the processing directory
+var tempFiles *janitor
+
+// newJanitorFromConfig applies the storage budget and TTLs from cfg
+func newJanitorFromConfig() *janitor {
+	return &janitor{
+		dir:       cfg.Storage.ProcessingDir,
+		maxBytes:  cfg.Storage.TempMaxBytes,
+		minFree:   cfg.Storage.TempMinFreeBytes,
+		outputTTL: cfg.Storage.ArtifactTTL.std(),
+		inputTTL:  cfg.Storage.InputTTL.std(),
+		artifacts: make(map[string]*trackedFile),
+		reserved:  map[string]bool{"cache": true, pendingDir: true, journalDir: true, presetDir: true},
+	}
+}
+
+// trackInput registers a source file that only lives for the duration of a job
+func (j *janitor) trackInput(path string) {
+	j.track(path, j.inputTTL, false)
+}
+
+// trackPending registers an output FFmpeg has yet to finish writing. It
+// expires with the artifact TTL if the job fails, but sweep never expires it
+// early; trackOutput marks it finished once it is published.
+func (j *janitor) trackPending(path string) {
+	j.track(path, j.outputTTL, false)
+}
+
+// trackOutput registers a finished output that stays downloadable for the
+// artifact TTL, returning when it expires
+func (j *janitor) trackOutput(path string) time.Time {
+	return j.track(path, j.outputTTL, true)
+}
+
+func (j *janitor) track(path string, ttl time.Duration, output bool) time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	expires := time.Now().Add(ttl)
+	j.artifacts[path] = &trackedFile{expires: expires, output: output}
+	return expires
+}
+
+// release deletes a file immediately and stops tracking it
+func (j *janitor) release(path string) {
+	j.mu.Lock()
+	delete(j.artifacts, path)
+	j.mu.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Janitor failed to remove file", "path", path, "error", err)
+	}
+}
+
+// sweepOrphans removes everything left in the directory by a previous run,
+// except reserved subdirectories
+func (j *janitor) sweepOrphans() {
+	if err := os.MkdirAll(j.dir, 0755); err != nil {
+		slog.Error("Janitor failed to create directory", "path", j.dir, "error", err)
+		return
+	}
+
+	entries, err := os.ReadDir(j.dir)
+	if err != nil {
+		slog.Error("Janitor failed to read directory", "path", j.dir, "error", err)
+		return
+	}
+
+	removed := 0
+	for _, e := range entries {
+		if j.reserved[e.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(j.dir, e.Name())); err != nil {
+			slog.Warn("Janitor failed to remove orphan", "file", e.Name(), "error", err)
+			continue
+		}
+		removed++
+	}
+	slog.Info("Janitor removed orphaned files", "count", removed, "path", j.dir)
+}
+
+// run sweeps expired files every interval until stop is closed
+func (j *janitor) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.sweep()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// sweep removes expired files, then expires the oldest outputs early while
+// the directory is over its budget
+func (j *janitor) sweep() {
+	now := time.Now()
+
+	j.mu.Lock()
+	var expired []string
+	for path, f := range j.artifacts {
+		if now.After(f.expires) {
+			expired = append(expired, path)
+			delete(j.artifacts, path)
+		}
+	}
+	j.mu.Unlock()
+
+	for _, path := range expired {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Warn("Janitor failed to remove file", "path", path, "error", err)
+		}
+	}
+	if len(expired) > 0 {
+		slog.Info("Janitor removed expired files", "count", len(expired))
+	}
+
+	usage := j.usage()
+	if usage <= j.maxBytes {
+		return
+	}
+
+	j.mu.Lock()
+	var outputs []string
+	for path, f := range j.artifacts {
+		if f.output {
+			outputs = append(outputs, path)
+		}
+	}
+	sort.Slice(outputs, func(a, b int) bool {
+		return j.artifacts[outputs[a]].expires.Before(j.artifacts[outputs[b]].expires)
+	})
+	j.mu.Unlock()
+
+	for _, path := range outputs {
+		if usage <= j.maxBytes {
+			break
+		}
+		info, err := os.Stat(path)
+		if err == nil {
+			usage -= info.Size()
+		}
+		j.release(path)
+		slog.Warn("Janitor expired file early, disk usage over budget", "path", path)
+	}
+}
+
+// usage returns the bytes currently used under the directory
+func (j *janitor) usage() int64 {
+	var total int64
+	filepath.WalkDir(j.dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
+
+// freeSpace returns the bytes available to us on the directory's filesystem
+func (j *janitor) freeSpace() (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(j.dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
+
+// admit checks that a job needing roughly expected bytes fits both the
+// directory budget and the free space on disk
+func (j *janitor) admit(expected int64) error {
+	usage := j.usage()
+	if usage+expected > j.maxBytes {
+		return fmt.Errorf("insufficient storage: job needs %.1f MB but only %.1f MB of the %.1f MB processing budget is free",
+			float64(expected)/(1024*1024), float64(max(j.maxBytes-usage, 0))/(1024*1024), float64(j.maxBytes)/(1024*1024))
+	}
+
+	free, err := j.freeSpace()
+	if err != nil {
+		slog.Warn("Janitor could not check free space", "error", err)
+		return nil
+	}
+	if free-expected < j.minFree {
+		return fmt.Errorf("insufficient storage: job needs %.1f MB but only %.1f MB is free on disk",
+			float64(expected)/(1024*1024), float64(free)/(1024*1024))
+	}
+	return nil
+}
+
+// refuseIfNoSpace writes a 507 response and returns true when a job needing
+// expected bytes cannot be admitted
+func refuseIfNoSpace(ctx context.Context, w http.ResponseWriter, r *http.Request, expected int64) bool {
+	err := tempFiles.admit(expected)
+	if err == nil {
+		return false
+	}
+
+	slog.WarnContext(ctx, "Refusing job", "error", err)
+	writeError(w, r.WithContext(ctx), newAPIError(codeInsufficientStorage, err.Error()))
+	return true
+}
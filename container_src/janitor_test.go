@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSweepSkipsPendingOutputs(t *testing.T) {
+	setupTestEnv(t)
+	tempFiles.maxBytes = 1
+
+	write := func(name string) string {
+		path := filepath.Join(tempFiles.dir, name)
+		if err := os.WriteFile(path, make([]byte, 1024), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	pending, finished := write("encoding.mp3"), write("done.mp3")
+	tempFiles.trackPending(pending)
+	tempFiles.trackOutput(finished)
+
+	tempFiles.sweep()
+	if _, err := os.Stat(pending); err != nil {
+		t.Errorf("sweep removed an output still being encoded: %v", err)
+	}
+	if _, err := os.Stat(finished); !os.IsNotExist(err) {
+		t.Errorf("sweep kept a finished output while over budget")
+	}
+
+	// Once published the output may be expired early like any other
+	tempFiles.trackOutput(pending)
+	tempFiles.sweep()
+	if _, err := os.Stat(pending); !os.IsNotExist(err) {
+		t.Errorf("sweep kept a published output while over budget")
+	}
+}
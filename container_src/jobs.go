@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// journalDir is the reserved subdirectory of the processing directory that
+// holds the job journal
+const journalDir = "jobs"
+
+// jobStatus is where a job is in its lifecycle. Succeeded and failed are
+// final; every other status means the job was still in flight.
+type jobStatus string
+
+const (
+	jobAccepted  jobStatus = "accepted"  // request received, not yet waiting for a worker
+	jobQueued    jobStatus = "queued"    // waiting for a worker slot
+	jobRunning   jobStatus = "running"   // downloading or transcoding
+	jobSuspended jobStatus = "suspended" // saved at shutdown, resumed after restart
+	jobSucceeded jobStatus = "succeeded"
+	jobFailed    jobStatus = "failed"
+)
+
+func (s jobStatus) final() bool {
+	return s == jobSucceeded || s == jobFailed
+}
+
+// jobParams are the request parameters worth keeping. URLs are stored with
+// their query string redacted, since presigned URLs carry credentials there.
+type jobParams struct {
+	Route    string        `json:"route"`
+	Tenant   string        `json:"instance_id,omitempty"`
+	Priority string        `json:"priority,omitempty"`
+	Profile  string        `json:"output_format,omitempty"`
+	Quality  string        `json:"audio_quality,omitempty"`
+	Preset   string        `json:"preset,omitempty"`
+	Filename string        `json:"filename,omitempty"`
+	VideoURL string        `json:"video_url,omitempty"`
+	Source   *ObjectSource `json:"source,omitempty"`
+}
+
+// jobArtifact is an output a job produced, as returned to the client
+type jobArtifact struct {
+	FileName    string `json:"file_name,omitempty"`
+	DownloadURL string `json:"download_url,omitempty"`
+	CacheHit    bool   `json:"cache_hit,omitempty"`
+}
+
+// jobError is why a job failed, using the API error codes
+type jobError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// jobState is a job as reported by GET /v1/jobs/{id}
+type jobState struct {
+	ID        string        `json:"id" openapi:"required"`
+	Status    jobStatus     `json:"status" openapi:"required" doc:"accepted, queued, running, suspended, succeeded or failed"`
+	Params    jobParams     `json:"params"`
+	Artifacts []jobArtifact `json:"artifacts,omitempty"`
+	Error     *jobError     `json:"error,omitempty"`
+	Callback  *jobCallback  `json:"callback,omitempty"`
+	CreatedAt time.Time     `json:"created_at" openapi:"required"`
+	UpdatedAt time.Time     `json:"updated_at" openapi:"required"`
+
+	QueuePosition int `json:"queue_position,omitempty" doc:"1-based place in line for a worker slot while the job is queued"`
+
+	IdempotencyKey   string          `json:"idempotency_key,omitempty"`
+	IdempotencyScope string          `json:"idempotency_scope,omitempty"` // caller, method and route the key belongs to
+	RequestHash      string          `json:"request_hash,omitempty"`      // hash of the normalized request body
+	Result           *FFmpegResponse `json:"result,omitempty" doc:"The response of a job submitted with an Idempotency-Key, replayed to retries"`
+	ResultKey        string          `json:"result_key,omitempty"` // result cache key of the output, to rebuild a replay
+}
+
+// journalRecord is one line of the journal. Each record changes one job;
+// a snapshot carries a whole job and is what compaction writes.
+type journalRecord struct {
+	Job      string       `json:"job"`
+	At       time.Time    `json:"at"`
+	Event    string       `json:"event"` // created, params, status, artifact, callback, delivery, discarded or snapshot
+	Status   jobStatus    `json:"status,omitempty"`
+	Params   *jobParams   `json:"params,omitempty"`
+	Artifact *jobArtifact `json:"artifact,omitempty"`
+	Error    *jobError    `json:"error,omitempty"`
+	Snapshot *jobState    `json:"snapshot,omitempty"`
+
+	Key       string          `json:"key,omitempty"` // created: the Idempotency-Key, its scope and the request hash
+	Scope     string          `json:"scope,omitempty"`
+	Hash      string          `json:"hash,omitempty"`
+	Result    *FFmpegResponse `json:"result,omitempty"`
+	ResultKey string          `json:"result_key,omitempty"`
+
+	Callback       *jobCallback     `json:"callback,omitempty"`
+	Delivery       *callbackAttempt `json:"delivery,omitempty"`
+	CallbackStatus string           `json:"callback_status,omitempty"`
+}
+
+// jobJournal is an append-only log of job records. Replaying it rebuilds the
+// state of every job, so job status survives a container restart. The log
+// is rewritten as one snapshot per job on startup and whenever it has grown
+// well past the number of jobs it describes.
+type jobJournal struct {
+	mu        sync.Mutex
+	path      string
+	file      *os.File
+	jobs      map[string]*jobState
+	keys      map[string]keyBinding // Idempotency-Key to the latest job submitted with it
+	records   int                   // records in the file, snapshots included
+	retention time.Duration
+}
+
+// journal is the process-wide job journal; nil when job tracking is disabled
+var journal *jobJournal
+
+// newJobJournalFromConfig opens the journal under the processing directory,
+// keeping finished jobs for storage.job_retention (0 disables the journal)
+func newJobJournalFromConfig() *jobJournal {
+	retention := cfg.Storage.JobRetention.std()
+	if retention == 0 {
+		slog.Info("Job journal disabled")
+		return nil
+	}
+
+	j, err := openJobJournal(filepath.Join(cfg.Storage.ProcessingDir, journalDir), retention)
+	if err != nil {
+		slog.Warn("Job journal disabled", "error", err)
+		return nil
+	}
+	return j
+}
+
+// openJobJournal replays the journal in dir and compacts it. Jobs the
+// previous process left in flight are marked failed, except suspended jobs
+// whose saved state is still on disk: resumePendingJobs finishes those.
+func openJobJournal(dir string, retention time.Duration) (*jobJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %v", err)
+	}
+
+	j := &jobJournal{
+		path:      filepath.Join(dir, "journal.log"),
+		jobs:      make(map[string]*jobState),
+		keys:      make(map[string]keyBinding),
+		retention: retention,
+	}
+	if err := j.replay(); err != nil {
+		return nil, err
+	}
+
+	interrupted := 0
+	now := time.Now().UTC()
+	for _, st := range j.jobs {
+		if st.Status.final() {
+			continue
+		}
+		if st.Status == jobSuspended {
+			if _, err := os.Stat(filepath.Join(pendingPath(), st.ID+".json")); err == nil {
+				continue
+			}
+		}
+		st.Status = jobFailed
+		st.Error = &jobError{Code: codeInterrupted, Message: "The container restarted before the job finished; retry the request"}
+		st.UpdatedAt = now
+		interrupted++
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := j.compactLocked(); err != nil {
+		return nil, err
+	}
+	slog.Info("Job journal ready", "jobs", len(j.jobs), "interrupted", interrupted, "retention", retention.String())
+	return j, nil
+}
+
+// replay applies every record in the journal file. A line that does not
+// parse, such as one cut short by a crash, is skipped.
+func (j *jobJournal) replay() error {
+	f, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer f.Close()
+
+	skipped := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Job == "" {
+			skipped++
+			continue
+		}
+		j.apply(rec)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read journal: %v", err)
+	}
+	if skipped > 0 {
+		slog.Warn("Skipped unreadable journal records", "records", skipped)
+	}
+	return nil
+}
+
+// apply updates the in-memory state with one record
+func (j *jobJournal) apply(rec journalRecord) {
+	if rec.Event == "snapshot" {
+		if rec.Snapshot != nil {
+			st := *rec.Snapshot
+			st.QueuePosition = 0 // the queue did not survive the restart
+			j.jobs[rec.Job] = &st
+			j.bindKeyLocked(&st)
+		}
+		return
+	}
+	if rec.Event == "created" {
+		st := &jobState{ID: rec.Job, Status: jobAccepted, CreatedAt: rec.At,
+			IdempotencyKey: rec.Key, IdempotencyScope: rec.Scope, RequestHash: rec.Hash}
+		j.jobs[rec.Job] = st
+		j.bindKeyLocked(st)
+	}
+	if rec.Event == "discarded" {
+		if st, ok := j.jobs[rec.Job]; ok {
+			j.unbindKeyLocked(st)
+		}
+		delete(j.jobs, rec.Job)
+		return
+	}
+
+	st, ok := j.jobs[rec.Job]
+	if !ok {
+		return
+	}
+	switch rec.Event {
+	case "created", "params":
+		if rec.Params != nil {
+			st.Params = *rec.Params
+		}
+	case "artifact":
+		if rec.Artifact != nil {
+			st.Artifacts = append(st.Artifacts, *rec.Artifact)
+		}
+	case "callback":
+		if rec.Callback != nil {
+			cb := *rec.Callback
+			st.Callback = &cb
+		}
+	case "delivery":
+		if st.Callback != nil && rec.Delivery != nil {
+			st.Callback.Attempts = append(st.Callback.Attempts, *rec.Delivery)
+			st.Callback.Status = rec.CallbackStatus
+		}
+	}
+	if rec.Status != "" {
+		st.Status = rec.Status
+		if rec.Status != jobQueued {
+			st.QueuePosition = 0
+		}
+	}
+	if rec.Error != nil {
+		st.Error = rec.Error
+	}
+	if rec.Result != nil {
+		st.Result = rec.Result
+		st.ResultKey = rec.ResultKey
+	}
+	st.UpdatedAt = rec.At
+}
+
+// append applies a record and writes it to the journal. Final and suspended
+// statuses are synced to disk; an intermediate record lost in a crash
+// belongs to a job that replay marks failed anyway.
+func (j *jobJournal) append(rec journalRecord) {
+	if j == nil || rec.Job == "" {
+		return
+	}
+	rec.At = time.Now().UTC()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.jobs[rec.Job]; !ok && rec.Event != "created" {
+		return
+	}
+	j.apply(rec)
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Warn("Failed to encode journal record", "job_id", rec.Job, "error", err)
+		return
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		slog.Warn("Failed to write journal record", "job_id", rec.Job, "error", err)
+		return
+	}
+	j.records++
+	if rec.Status.final() || rec.Status == jobSuspended {
+		j.file.Sync()
+	}
+
+	if j.records > 1024 && j.records > 4*len(j.jobs) {
+		if err := j.compactLocked(); err != nil {
+			slog.Warn("Failed to compact job journal", "error", err)
+		}
+	}
+}
+
+// compactLocked drops finished jobs older than the retention and rewrites
+// the journal as one snapshot per remaining job
+func (j *jobJournal) compactLocked() error {
+	cutoff := time.Now().Add(-j.retention)
+	for id, st := range j.jobs {
+		if st.Status.final() && st.UpdatedAt.Before(cutoff) {
+			delete(j.jobs, id)
+			j.unbindKeyLocked(st)
+		}
+	}
+
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create journal: %v", err)
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for id, st := range j.jobs {
+		if err = enc.Encode(journalRecord{Job: id, At: st.UpdatedAt, Event: "snapshot", Snapshot: st}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write journal: %v", err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %v", err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.records = len(j.jobs)
+	return nil
+}
+
+// close flushes the journal at shutdown
+func (j *jobJournal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.file.Sync()
+	j.file.Close()
+}
+
+// get returns a copy of the job's state
+func (j *jobJournal) get(id string) (jobState, bool) {
+	if j == nil {
+		return jobState{}, false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	st, ok := j.jobs[id]
+	if !ok || (st.Status.final() && time.Since(st.UpdatedAt) > j.retention) {
+		return jobState{}, false
+	}
+	copied := *st
+	copied.Artifacts = append([]jobArtifact(nil), st.Artifacts...)
+	if st.Callback != nil {
+		cb := *st.Callback
+		cb.Attempts = append([]callbackAttempt(nil), cb.Attempts...)
+		copied.Callback = &cb
+	}
+	return copied, true
+}
+
+// status returns the job's current status, or "" for an unknown job
+func (j *jobJournal) status(id string) jobStatus {
+	st, _ := j.get(id)
+	return st.Status
+}
+
+// create records a new job, binding it to the request's Idempotency-Key
+// when it has one
+func (j *jobJournal) create(ctx context.Context, id, route string) {
+	rec := journalRecord{Job: id, Event: "created", Params: &jobParams{Route: route}}
+	if claim := idempotencyFrom(ctx); claim != nil {
+		rec.Key, rec.Scope, rec.Hash = claim.key, claim.scope, claim.hash
+	}
+	j.append(rec)
+}
+
+// describe records the job's parameters once the handler has validated them
+func (j *jobJournal) describe(ctx context.Context, p jobParams) {
+	if j == nil {
+		return
+	}
+	id := jobIDFrom(ctx)
+	if st, ok := j.get(id); ok {
+		p.Route = st.Params.Route
+	}
+	if p.VideoURL != "" {
+		p.VideoURL = redactURL(p.VideoURL)
+	}
+	j.append(journalRecord{Job: id, Event: "params", Params: &p})
+}
+
+// discard forgets a job that turned out not to be one, such as a dry run.
+// Later records for it are ignored.
+func (j *jobJournal) discard(id string) {
+	j.append(journalRecord{Job: id, Event: "discarded"})
+}
+
+// setStatus records a transition, skipping it when the status is unchanged
+// or the job has already ended
+func (j *jobJournal) setStatus(id string, status jobStatus) {
+	if current := j.status(id); current == status || current.final() {
+		return
+	}
+	j.append(journalRecord{Job: id, Event: "status", Status: status})
+}
+
+// setQueuePosition updates a queued job's place in line. The position
+// changes often and means nothing after a restart, so it is kept in memory
+// only and not journaled.
+func (j *jobJournal) setQueuePosition(id string, position int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if st, ok := j.jobs[id]; ok && st.Status == jobQueued {
+		st.QueuePosition = position
+	}
+}
+
+// succeed records the job's output from its response, if it has one. Jobs
+// with an Idempotency-Key also keep the response for replays, with the
+// result cache key of its output. Audio returned inline is too large to
+// journal, so it is dropped and rebuilt from the cache when replayed.
+func (j *jobJournal) succeed(id string, resp *FFmpegResponse, resultKey string) {
+	rec := journalRecord{Job: id, Event: "status", Status: jobSucceeded}
+	if resp != nil {
+		rec.Event = "artifact"
+		rec.Artifact = &jobArtifact{FileName: resp.FileName, DownloadURL: resp.DownloadURL, CacheHit: resp.CacheHit}
+		if st, ok := j.get(id); ok && st.IdempotencyKey != "" {
+			result := *resp
+			result.AudioData = ""
+			rec.Result, rec.ResultKey = &result, resultKey
+		}
+	}
+	j.append(rec)
+}
+
+// addArtifact records one output of a job that produces several
+func (j *jobJournal) addArtifact(id string, a jobArtifact) {
+	j.append(journalRecord{Job: id, Event: "artifact", Artifact: &a})
+}
+
+// fail records the job's error with any URLs redacted. A suspended job is
+// left alone: the error the client saw only says the job was saved for later.
+func (j *jobJournal) fail(id string, e jobError) {
+	if current := j.status(id); current == jobSuspended || current.final() {
+		return
+	}
+	e.Message = redactURLs(e.Message)
+	j.append(journalRecord{Job: id, Event: "status", Status: jobFailed, Error: &e})
+}
+
+// startCallback opens the job's callback delivery log
+func (j *jobJournal) startCallback(id string, cb *jobCallback) {
+	j.append(journalRecord{Job: id, Event: "callback", Callback: cb})
+}
+
+// recordDelivery adds an attempt to the job's callback log
+func (j *jobJournal) recordDelivery(id string, a callbackAttempt, status string) {
+	j.append(journalRecord{Job: id, Event: "delivery", Delivery: &a, CallbackStatus: status})
+}
+
+// jobWriter is the response writer trackJob hands to handlers. writeJSON
+// reports each response to it so the job's outcome is journaled and, if the
+// request named a callback_url, delivered there.
+type jobWriter struct {
+	http.ResponseWriter
+	id          string
+	callbackURL string
+	resultKey   string
+}
+
+// jobRecorder is implemented by writers that journal a job's outcome
+type jobRecorder interface {
+	recordOutcome(v any)
+}
+
+func (w *jobWriter) recordOutcome(v any) {
+	switch resp := v.(type) {
+	case FFmpegResponse:
+		if resp.Success {
+			journal.succeed(w.id, &resp, w.resultKey)
+		} else {
+			journal.fail(w.id, jobError{Code: resp.Code, Message: resp.Error})
+		}
+	case RecipeResponse:
+		// Its artifacts were journaled as the steps produced them
+		journal.succeed(w.id, nil, "")
+	default:
+		return
+	}
+	// A job saved at shutdown has not finished yet; its callback is sent
+	// when it is resumed
+	if w.callbackURL != "" && journal.status(w.id) != jobSuspended {
+		webhooks.deliver(w.id, w.callbackURL, v)
+	}
+}
+
+// recordResultKey names the result cache entry holding the job's output, so
+// a replay of its response can be rebuilt after the output is gone
+func recordResultKey(w http.ResponseWriter, key string) {
+	if jw, ok := w.(*jobWriter); ok {
+		jw.resultKey = key
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *jobWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finishJob marks a job that ended without a recorded outcome, such as one
+// whose handler panicked, as failed
+func finishJob(id string) {
+	if current := journal.status(id); current != "" && current != jobSuspended && !current.final() {
+		journal.fail(id, jobError{Code: codeInternal, Message: "The job ended without a result"})
+	}
+}
+
+// jobHandler serves GET /v1/jobs/{id}
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if journal == nil {
+		writeError(w, r, newAPIError(codeNotFound, "Job tracking is disabled"))
+		return
+	}
+	st, ok := journal.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, newAPIError(codeNotFound, "Job not found"))
+		return
+	}
+	writeJSON(w, http.StatusOK, st)
+}
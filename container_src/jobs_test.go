@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournalRecoversJobsAfterRestart(t *testing.T) {
+	setupTestEnv(t)
+	dir := filepath.Join(cfg.Storage.ProcessingDir, journalDir+"-test")
+	j, err := openJobJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	j.append(journalRecord{Job: "done", Event: "created", Key: "key-1", Hash: "h1", Params: &jobParams{Route: "/v1/extract-audio"}})
+	j.append(journalRecord{Job: "done", Event: "params", Params: &jobParams{Route: "/v1/extract-audio", Profile: "mp3", VideoURL: "https://example.com/v.mp4"}})
+	j.setStatus("done", jobRunning)
+	j.succeed("done", &FFmpegResponse{Success: true, FileName: "a.mp3", DownloadURL: "/v1/download/a"}, "cache-key")
+
+	j.append(journalRecord{Job: "failed", Event: "created"})
+	j.fail("failed", jobError{Code: codeInvalidInputMedia, Message: "bad input"})
+
+	for _, id := range []string{"accepted", "queued", "running", "suspended", "saved"} {
+		j.append(journalRecord{Job: id, Event: "created"})
+	}
+	j.setStatus("queued", jobQueued)
+	j.setQueuePosition("queued", 3)
+	j.setStatus("running", jobRunning)
+	j.setStatus("suspended", jobSuspended)
+	j.setStatus("saved", jobSuspended)
+	if err := os.MkdirAll(pendingPath(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(pendingPath(), "saved.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	j.append(journalRecord{Job: "gone", Event: "created"})
+	j.discard("gone")
+	j.setStatus("gone", jobRunning)
+
+	// a job that finished before the retention, and a record cut short by a crash
+	old := time.Now().Add(-2 * time.Hour).UTC()
+	expired, _ := json.Marshal(journalRecord{Job: "expired", At: old, Event: "snapshot",
+		Snapshot: &jobState{ID: "expired", Status: jobSucceeded, CreatedAt: old, UpdatedAt: old, IdempotencyKey: "key-2"}})
+	j.file.Write(append(expired, '\n'))
+	j.file.Write([]byte(`{"job":"running","event":"sta`))
+	j.close()
+
+	j, err = openJobJournal(dir, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+
+	tests := []struct {
+		id     string
+		status jobStatus
+		code   string
+	}{
+		{"done", jobSucceeded, ""},
+		{"failed", jobFailed, codeInvalidInputMedia},
+		{"accepted", jobFailed, codeInterrupted},
+		{"queued", jobFailed, codeInterrupted},
+		{"running", jobFailed, codeInterrupted},
+		{"suspended", jobFailed, codeInterrupted}, // its saved state is gone
+		{"saved", jobSuspended, ""},
+	}
+	for _, tt := range tests {
+		st, ok := j.get(tt.id)
+		if !ok || st.Status != tt.status || st.QueuePosition != 0 {
+			t.Errorf("%s after restart = %+v, want %s", tt.id, st, tt.status)
+			continue
+		}
+		if (st.Error == nil) != (tt.code == "") || (st.Error != nil && st.Error.Code != tt.code) {
+			t.Errorf("%s error = %+v, want %q", tt.id, st.Error, tt.code)
+		}
+	}
+	for _, id := range []string{"gone", "expired"} {
+		if _, ok := j.get(id); ok {
+			t.Errorf("%s came back after restart", id)
+		}
+	}
+
+	st, _ := j.get("done")
+	if st.Params.Route != "/v1/extract-audio" || st.Params.Profile != "mp3" || len(st.Artifacts) != 1 ||
+		st.Artifacts[0].FileName != "a.mp3" || st.Result == nil || st.ResultKey != "cache-key" {
+		t.Errorf("done after restart = %+v", st)
+	}
+	if b, ok := j.keys[scopedKey("", "key-1")]; !ok || b.job != "done" || b.hash != "h1" {
+		t.Errorf("Idempotency-Key binding after restart = %+v, %v", b, ok)
+	}
+	if _, ok := j.keys[scopedKey("", "key-2")]; ok {
+		t.Error("expired job's Idempotency-Key is still bound")
+	}
+
+	// compaction left one snapshot per surviving job
+	f, err := os.Open(j.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	snapshots := map[string]jobStatus{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec journalRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil || rec.Event != "snapshot" || rec.Snapshot == nil {
+			t.Fatalf("compacted journal holds %s", scanner.Text())
+		}
+		snapshots[rec.Job] = rec.Snapshot.Status
+	}
+	if len(snapshots) != len(tests) || j.records != len(tests) {
+		t.Errorf("compacted journal = %v (%d records), want %d jobs", snapshots, j.records, len(tests))
+	}
+	for _, tt := range tests {
+		if snapshots[tt.id] != tt.status {
+			t.Errorf("snapshot of %s = %q, want %s", tt.id, snapshots[tt.id], tt.status)
+		}
+	}
+}
+
+func TestJournalCompactsWhenItGrows(t *testing.T) {
+	setupTestEnv(t)
+	j, err := openJobJournal(filepath.Join(cfg.Storage.ProcessingDir, journalDir+"-test"), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.close()
+
+	j.append(journalRecord{Job: "busy", Event: "created"})
+	for i := 0; i < 1100; i++ {
+		j.setStatus("busy", jobQueued)
+		j.setStatus("busy", jobRunning)
+	}
+	if j.records > 1024 {
+		t.Errorf("journal holds %d records for one job, want it compacted", j.records)
+	}
+	j.close()
+
+	j, err = openJobJournal(filepath.Dir(j.path), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, ok := j.get("busy"); !ok || st.Status != jobFailed || st.Error.Code != codeInterrupted {
+		t.Errorf("busy after restart = %+v, want interrupted", st)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log lines carry attrs in addition to
+// those already attached. An attr replaces an earlier one with the same key,
+// so a job can move from stage to stage.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	merged := make([]slog.Attr, 0, len(existing)+len(attrs))
+	for _, a := range existing {
+		if !slices.ContainsFunc(attrs, func(b slog.Attr) bool { return b.Key == a.Key }) {
+			merged = append(merged, a)
+		}
+	}
+	merged = append(merged, attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, merged)
+}
+
+// withStage tags a context's log lines with the job stage
+func withStage(ctx context.Context, stage string) context.Context {
+	return withLogAttrs(ctx, slog.String("stage", stage))
+}
+
+// contextHandler adds the attrs attached with withLogAttrs to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// urlPattern finds URLs embedded in free text such as error messages
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s"'<>]+`)
+
+// redactURL strips credentials, the query string and the fragment from a
+// URL, which may carry signatures or tokens
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	if u.User != nil {
+		u.User = url.User("redacted")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "redacted"
+	}
+	u.Fragment, u.RawFragment = "", ""
+	return u.String()
+}
+
+// redactURLs applies redactURL to every URL in s. Punctuation ending a URL,
+// such as the colon before an error, is taken to belong to the text.
+func redactURLs(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	return urlPattern.ReplaceAllStringFunc(s, func(match string) string {
+		u := strings.TrimRight(match, ".,:;)")
+		return redactURL(u) + match[len(u):]
+	})
+}
+
+// redactAttr is the ReplaceAttr hook that keeps URLs in messages, string
+// attrs and errors from leaking secrets into the logs
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	switch a.Value.Kind() {
+	case slog.KindString:
+		if s := a.Value.String(); strings.Contains(s, "://") {
+			return slog.String(a.Key, redactURLs(s))
+		}
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redactURLs(err.Error()))
+		}
+	}
+	return a
+}
+
+// setupLogging installs the process-wide logger with the configured level
+// (debug, info, warn or error) and format (json or text). The standard log
+// package is routed through the same handler.
+func setupLogging() {
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.Logging.Level)) // checked by config validation
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redactAttr}
+	var h slog.Handler
+	if cfg.Logging.Format == "text" {
+		h = slog.NewTextHandler(os.Stderr, opts)
+	} else {
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{h}))
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
-	"encoding/json"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -30,131 +33,117 @@ func errorHandler(w http.ResponseWriter, r *http.Request) {
 func readmeHandler(w http.ResponseWriter, r *http.Request) {
 	// GitHub raw content URL for README.md
 	githubURL := "https://raw.githubusercontent.com/torarnehave1/vegvisr-container/main/README.md"
-	
-	log.Printf("Fetching README.md from GitHub: %s", githubURL)
-	
+
+	slog.InfoContext(r.Context(), "Fetching README.md from GitHub", "url", githubURL)
+
 	// Create HTTP client with timeout
 	client := &http.Client{
-		Timeout: 30 * time.Second,
+		Timeout: cfg.Server.ReadmeTimeout.std(),
 	}
-	
+
 	// Fetch README from GitHub
 	resp, err := client.Get(githubURL)
 	if err != nil {
-		log.Printf("Failed to fetch README from GitHub: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to fetch README: %v", err), http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Failed to fetch README from GitHub", "error", err)
+		writeError(w, r, newAPIErrorf(codeUpstreamFailed, "Failed to fetch README: %v", err))
 		return
 	}
 	defer resp.Body.Close()
-	
+
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("GitHub returned non-200 status: %d", resp.StatusCode)
-		http.Error(w, fmt.Sprintf("GitHub returned status: %d", resp.StatusCode), resp.StatusCode)
+		slog.ErrorContext(r.Context(), "GitHub returned non-200 status", "status", resp.StatusCode)
+		writeError(w, r, newAPIErrorf(codeUpstreamFailed, "GitHub returned status: %d", resp.StatusCode))
 		return
 	}
-	
+
 	// Set headers for markdown file download
 	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
 	w.Header().Set("Content-Disposition", "attachment; filename=\"README.md\"")
-	
+
 	// Copy the content directly from GitHub to the response
 	_, err = io.Copy(w, resp.Body)
 	if err != nil {
-		log.Printf("Failed to copy README content: %v", err)
+		slog.ErrorContext(r.Context(), "Failed to copy README content", "error", err)
 		return
 	}
-	
-	log.Printf("Successfully served README.md from GitHub")
+
+	slog.InfoContext(r.Context(), "Successfully served README.md from GitHub")
 }
 
 // uploadBase64Handler handles file uploads sent as base64 JSON from the TypeScript worker
 func uploadBase64Handler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Upload base64 handler called")
-	
+	ctx := startStage(r.Context(), "receive")
+	slog.InfoContext(ctx, "Upload base64 handler called")
+
 	// Only allow POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, newAPIError(codeMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 
 	// Parse JSON request
-	var req struct {
-		VideoData    string `json:"video_data"`
-		Filename     string `json:"filename"`
-		FileSize     int64  `json:"file_size"`
-		OutputFormat string `json:"output_format"`
-		InstanceId   string `json:"instance_id"`
+	var req UploadBase64Request
+	if apiErr := decodeJSON(r, &req); apiErr != nil {
+		slog.WarnContext(ctx, "Failed to parse JSON request", "error", apiErr)
+		writeError(w, r, apiErr)
+		return
 	}
-
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		log.Printf("Failed to parse JSON request: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to parse request: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
+	if apiErr := req.validate(); apiErr != nil {
+		writeError(w, r, apiErr)
 		return
 	}
+	if req.DryRun {
+		untrackDryRun(w, r)
+	}
 
-	log.Printf("Received base64 upload: %s, size: %d bytes (%.2f MB)", req.Filename, req.FileSize, float64(req.FileSize)/(1024*1024))
+	slog.InfoContext(ctx, "Received base64 upload", "filename", req.Filename, "bytes", req.FileSize)
 
-	// Check file size (50MB limit for testing)
-	const maxFileSize = 50 * 1024 * 1024 // 50MB
-	if req.FileSize > maxFileSize {
-		log.Printf("File too large: %d bytes (max: %d)", req.FileSize, maxFileSize)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("File too large (%.1f MB). Maximum supported: 50MB", float64(req.FileSize)/(1024*1024)),
-		}
-		json.NewEncoder(w).Encode(response)
+	// Check file size
+	if maxBytes := cfg.Limits.MaxBase64UploadBytes; req.FileSize > maxBytes {
+		slog.WarnContext(ctx, "File too large", "bytes", req.FileSize, "max_bytes", maxBytes)
+		writeError(w, r, newAPIErrorf(codeSourceTooLarge, "File too large (%.1f MB). Maximum supported: %dMB", float64(req.FileSize)/(1024*1024), maxBytes/(1024*1024)))
 		return
 	}
 
-	// Validate output format
-	outputFormat := req.OutputFormat
-	if outputFormat == "" {
-		outputFormat = "mp3"
-	}
-	validFormats := map[string]bool{"mp3": true, "wav": true, "aac": true, "flac": true}
-	if !validFormats[outputFormat] {
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Unsupported output format: %s. Supported: mp3, wav, aac, flac", outputFormat),
-		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
+	// Output format was validated above
+	profile, _ := lookupProfile(req.OutputFormat)
+	outputFormat := profile.Name
 
 	instanceId := req.InstanceId
 	if instanceId == "" {
 		instanceId = "upload"
 	}
+	ctx = withLogAttrs(startStage(ctx, "decode"), slog.String("instance_id", instanceId))
+	class, _ := parsePriority(req.Priority) // validated above
+	ticket := jobTicket{tenant: instanceId, class: class}
+	if !req.DryRun {
+		journal.describe(ctx, jobParams{Tenant: instanceId, Priority: class.String(), Profile: profile.Name, Filename: req.Filename})
+		requestCallback(w, req.CallbackURL)
+	}
 
 	// Decode base64 video data
-	log.Printf("Decoding base64 video data...")
+	slog.DebugContext(ctx, "Decoding base64 video data")
 	videoData, err := base64.StdEncoding.DecodeString(req.VideoData)
 	if err != nil {
-		log.Printf("Failed to decode base64 video data: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to decode video data: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
+		slog.WarnContext(ctx, "Failed to decode base64 video data", "error", err)
+		writeError(w, r, newAPIErrorf(codeInvalidRequest, "Failed to decode video data: %v", err))
+		return
+	}
+
+	inputSize.observe(float64(len(videoData)), "upload_base64")
+
+	// Refuse the job up front if the video and its output won't fit on disk
+	if refuseIfNoSpace(ctx, w, r, 2*int64(len(videoData))) {
 		return
 	}
 
 	// Create temp directory
-	tempDir := "/tmp/processing"
+	tempDir := cfg.Storage.ProcessingDir
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		log.Printf("Failed to create temp directory: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to create temp directory: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to create temp directory", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to create temp directory: %v", err))
 		return
 	}
 
@@ -163,145 +152,165 @@ func uploadBase64Handler(w http.ResponseWriter, r *http.Request) {
 	videoFile := filepath.Join(tempDir, fmt.Sprintf("upload_%s_%d%s", instanceId, timestamp, filepath.Ext(req.Filename)))
 	audioFile := filepath.Join(tempDir, fmt.Sprintf("audio_%s_%d.%s", instanceId, timestamp, outputFormat))
 
-	log.Printf("Saving video to: %s", videoFile)
-
-	// Save video data to file
-	err = os.WriteFile(videoFile, videoData, 0644)
-	if err != nil {
-		log.Printf("Failed to save video file: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to save video file: %v", err),
+	// A dry run saves the video only for as long as it takes to probe it
+	if req.DryRun {
+		tempFiles.trackInput(videoFile)
+		defer tempFiles.release(videoFile)
+		if err := os.WriteFile(videoFile, videoData, 0644); err != nil {
+			writeError(w, r, newAPIErrorf(codeInternal, "Failed to save video file: %v", err))
+			return
+		}
+		media, apiErr := probeUpload(ctx, videoFile)
+		if apiErr != nil {
+			writeError(w, r, apiErr)
+			return
 		}
-		json.NewEncoder(w).Encode(response)
+		writeDryRun(w, profile, "", "", videoFile, audioFile, media, int64(len(videoData)))
 		return
 	}
-	defer os.Remove(videoFile) // Clean up
-
-	log.Printf("Video saved successfully, starting FFmpeg processing")
 
-	// Process with FFmpeg
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// The janitor deletes the input when this job ends and the output once
+	// its artifact TTL expires
+	tempFiles.trackInput(videoFile)
+	defer tempFiles.release(videoFile)
+	tempFiles.trackPending(audioFile)
+
+	// Serve an identical earlier result from the cache if there is one
+	resultKey := cacheKey(hashBytes(videoData), profile, "")
+	cacheHit := results.materialize(resultKey, audioFile)
+	if cacheHit {
+		slog.InfoContext(ctx, "Cache hit for upload, skipping FFmpeg", "filename", req.Filename)
+	} else {
+		ctx := startStage(ctx, "save")
+		slog.DebugContext(ctx, "Saving video", "path", videoFile)
 
-	log.Printf("Starting FFmpeg processing with %s format (file size: %.2f MB), timeout: 30s", 
-		outputFormat, float64(req.FileSize)/(1024*1024))
+		// Save video data to file
+		err = os.WriteFile(videoFile, videoData, 0644)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to save video file", "error", err)
+			writeError(w, r, newAPIErrorf(codeInternal, "Failed to save video file: %v", err))
+			return
+		}
+		slog.DebugContext(ctx, "Video saved, starting FFmpeg processing")
+
+		// Process with FFmpeg once a worker slot is free; the FFmpeg timeout
+		// only starts counting when the job leaves the queue. A job still
+		// queued at shutdown is saved with its input and resumed on restart.
+		ticket.resume = &pendingJob{ID: jobIDFrom(ctx), Tenant: instanceId, Priority: class.String(),
+			Profile: profile.Name, CacheKey: resultKey, Input: videoFile, CallbackURL: req.CallbackURL}
+		release, ok := waitForSlot(ctx, w, r, ffmpegPool, ticket)
+		if !ok {
+			return
+		}
+		defer release()
+		ctx, cancel := context.WithTimeout(startStage(ctx, "transcode"), cfg.FFmpeg.UploadTimeout.std())
+		defer cancel()
 
-	var cmd *exec.Cmd
-	switch outputFormat {
-	case "wav":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "pcm_s16le", "-ar", "44100", "-y", audioFile)
-	case "flac":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "flac", "-ar", "44100", "-y", audioFile)
-	case "aac":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "aac", "-ab", "192k", "-ar", "44100", "-y", audioFile)
-	default: // mp3
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "mp3", "-ab", "192k", "-ar", "44100", "-y", audioFile)
-	}
+		slog.InfoContext(ctx, "Starting FFmpeg processing", "format", outputFormat, "bytes", len(videoData), "timeout", cfg.FFmpeg.UploadTimeout.std().String())
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("FFmpeg failed: %v, output: %s", err, string(output))
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("ffmpeg failed: %v, stderr: %s", err, string(output)),
+		output, err := profile.runFFmpeg(ctx, videoFile, audioFile, "")
+		release()
+		if err != nil {
+			slog.ErrorContext(ctx, "FFmpeg failed", "error", err, "stderr", string(output))
+			writeError(w, r, ffmpegError(ctx, err, output))
+			return
 		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 
-	log.Printf("FFmpeg processing completed successfully")
+		slog.InfoContext(ctx, "FFmpeg processing completed")
+		results.put(resultKey, audioFile, profile)
+	}
 
 	// Read processed audio and return as base64
+	ctx = startStage(ctx, "publish")
 	audioInfo, err := os.Stat(audioFile)
 	if err != nil {
-		log.Printf("Failed to get audio file info: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to get audio file info: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to get audio file info", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to get audio file info: %v", err))
 		return
 	}
-	
+
 	audioSize := audioInfo.Size()
-	audioSizeMB := float64(audioSize) / (1024 * 1024)
+	outputSize.observe(float64(audioSize), profile.Name)
 	audioFileName := fmt.Sprintf("audio_%s_%d.%s", instanceId, timestamp, outputFormat)
-	
-	log.Printf("Processed audio file: %s (size: %.2f MB)", audioFileName, audioSizeMB)
-	
+
+	slog.InfoContext(ctx, "Processed audio file", "file", audioFileName, "bytes", audioSize)
+
 	// Read and encode audio file
 	audioData, err := os.ReadFile(audioFile)
 	if err != nil {
-		log.Printf("Failed to read processed audio file: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to read processed audio: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to read processed audio file", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to read processed audio: %v", err))
 		return
 	}
-	defer os.Remove(audioFile) // Clean up
-	
 	// Encode audio data as base64
-	audioBase64 := base64.StdEncoding.EncodeToString(audioData)
-	
+	audioBase64 := encodeBase64(ctx, audioData)
+	downloadURL := publishOutput(audioFile, profile)
+
 	response := FFmpegResponse{
 		Success:     true,
 		Message:     "Audio extracted from uploaded file successfully",
-		DownloadURL: fmt.Sprintf("/download/%s", audioFileName),
+		CacheHit:    cacheHit,
+		DownloadURL: downloadURL,
 		FileName:    audioFileName,
 		R2Key:       audioFileName,
-		AudioURL:    fmt.Sprintf("/download/%s", audioFileName),
+		AudioURL:    downloadURL,
 		AudioData:   audioBase64,
 	}
-	
-	log.Printf("Upload processing completed: %s", audioFileName)
-	json.NewEncoder(w).Encode(response)
+
+	slog.InfoContext(ctx, "Upload processing completed", "file", audioFileName)
+	writeJSON(w, http.StatusOK, response)
 }
 
 // uploadHandler handles direct file uploads from frontend
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	log.Printf("Upload handler called")
-	
+	ctx := startStage(r.Context(), "receive")
+	slog.InfoContext(ctx, "Upload handler called")
+
 	// Only allow POST requests
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, newAPIError(codeMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
-	// Parse the multipart form (64MB max memory to handle larger files)
-	log.Printf("Starting multipart form parsing...")
-	err := r.ParseMultipartForm(64 << 20) // 64MB
+	// Parse the multipart form, spooling what does not fit in memory to disk
+	slog.DebugContext(ctx, "Starting multipart form parsing")
+	err := r.ParseMultipartForm(cfg.Limits.UploadMemoryBytes)
 	if err != nil {
-		log.Printf("Failed to parse multipart form: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to parse form: %v", err), http.StatusBadRequest)
+		slog.WarnContext(ctx, "Failed to parse multipart form", "error", err)
+		if bodyTooLarge(err) {
+			writeError(w, r, newAPIErrorf(codeSourceTooLarge, "File too large. Maximum size is %dMB", cfg.Limits.MaxUploadBytes/(1024*1024)))
+			return
+		}
+		writeError(w, r, newAPIErrorf(codeInvalidRequest, "Failed to parse form: %v", err))
 		return
 	}
-	log.Printf("Multipart form parsed successfully")
+	slog.DebugContext(ctx, "Multipart form parsed")
+
+	if apiErr := validateUploadForm(r); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.FormValue("dry_run")) // validated above
+	if dryRun {
+		untrackDryRun(w, r)
+	}
 
 	// Get the uploaded file
-	log.Printf("Getting file from form...")
+	slog.DebugContext(ctx, "Getting file from form")
 	file, header, err := r.FormFile("video")
 	if err != nil {
-		log.Printf("Failed to get file from form: %v", err)
-		http.Error(w, fmt.Sprintf("Failed to get uploaded file: %v", err), http.StatusBadRequest)
+		slog.WarnContext(ctx, "Failed to get file from form", "error", err)
+		writeError(w, r, newAPIErrorf(codeInvalidRequest, "Failed to get uploaded file: %v", err))
 		return
 	}
 	defer file.Close()
 
-	log.Printf("Received file upload: %s, size: %d bytes (%.2f MB)", header.Filename, header.Size, float64(header.Size)/(1024*1024))
+	slog.InfoContext(ctx, "Received file upload", "filename", header.Filename, "bytes", header.Size)
 
-	// Check file size (200MB limit)
-	const maxFileSize = 200 * 1024 * 1024 // 200MB
-	if header.Size > maxFileSize {
-		log.Printf("File too large: %d bytes (max: %d)", header.Size, maxFileSize)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("File too large (%.1f MB). Maximum supported: 200MB", float64(header.Size)/(1024*1024)),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	// Check file size
+	if maxBytes := cfg.Limits.MaxUploadBytes; header.Size > maxBytes {
+		slog.WarnContext(ctx, "File too large", "bytes", header.Size, "max_bytes", maxBytes)
+		writeError(w, r, newAPIErrorf(codeSourceTooLarge, "File too large (%.1f MB). Maximum supported: %dMB", float64(header.Size)/(1024*1024), maxBytes/(1024*1024)))
 		return
 	}
 
@@ -312,14 +321,9 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate output format
-	validFormats := map[string]bool{"mp3": true, "wav": true, "aac": true, "flac": true}
-	if !validFormats[outputFormat] {
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Unsupported output format: %s. Supported: mp3, wav, aac, flac", outputFormat),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+	profile, ok := lookupProfile(outputFormat)
+	if !ok {
+		writeError(w, r, newAPIErrorf(codeUnsupportedFormat, "Unsupported output format: %s. Supported: %s", outputFormat, profileList()))
 		return
 	}
 
@@ -328,17 +332,26 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	if instanceId == "" {
 		instanceId = "upload"
 	}
+	ctx = withLogAttrs(ctx, slog.String("instance_id", instanceId))
+	class, _ := parsePriority(r.FormValue("priority")) // validated above
+	ticket := jobTicket{tenant: instanceId, class: class}
+	if !dryRun {
+		journal.describe(ctx, jobParams{Tenant: instanceId, Priority: class.String(), Profile: profile.Name, Filename: header.Filename})
+		requestCallback(w, r.FormValue("callback_url"))
+	}
+
+	inputSize.observe(float64(header.Size), "upload")
+
+	// Refuse the job up front if the video and its output won't fit on disk
+	if refuseIfNoSpace(ctx, w, r, 2*header.Size) {
+		return
+	}
 
 	// Create temp directory
-	tempDir := "/tmp/processing"
+	tempDir := cfg.Storage.ProcessingDir
 	if err := os.MkdirAll(tempDir, 0755); err != nil {
-		log.Printf("Failed to create temp directory: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to create temp directory: %v", err),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to create temp directory", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to create temp directory: %v", err))
 		return
 	}
 
@@ -347,257 +360,341 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	videoFile := filepath.Join(tempDir, fmt.Sprintf("upload_%s_%d%s", instanceId, timestamp, filepath.Ext(header.Filename)))
 	audioFile := filepath.Join(tempDir, fmt.Sprintf("audio_%s_%d.%s", instanceId, timestamp, outputFormat))
 
-	log.Printf("Saving uploaded file to: %s", videoFile)
+	// The janitor deletes the input when this job ends and the output once
+	// its artifact TTL expires
+	tempFiles.trackInput(videoFile)
+	defer tempFiles.release(videoFile)
+	tempFiles.trackPending(audioFile)
+
+	ctx = startStage(ctx, "save")
+	slog.DebugContext(ctx, "Saving uploaded file", "path", videoFile)
 
 	// Save uploaded file to temp location
 	videoFileHandle, err := os.Create(videoFile)
 	if err != nil {
-		log.Printf("Failed to create temp file: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to create temp file: %v", err),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to create temp file", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to create temp file: %v", err))
 		return
 	}
 	defer videoFileHandle.Close()
-	defer os.Remove(videoFile) // Clean up
 
-	// Copy uploaded file to temp location with progress logging
-	log.Printf("Starting file copy operation...")
-	bytesWritten, err := io.Copy(videoFileHandle, file)
+	// Copy uploaded file to temp location with progress logging, hashing it
+	// on the way for the result cache
+	slog.DebugContext(ctx, "Starting file copy operation")
+	hasher := sha256.New()
+	bytesWritten, err := io.Copy(io.MultiWriter(videoFileHandle, hasher), file)
 	if err != nil {
-		log.Printf("Failed to save uploaded file: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to save uploaded file: %v", err),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to save uploaded file", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to save uploaded file: %v", err))
 		return
 	}
 	videoFileHandle.Close() // Close before FFmpeg processing
 
-	log.Printf("File saved successfully! Wrote %d bytes, starting FFmpeg processing", bytesWritten)
+	if dryRun {
+		media, apiErr := probeUpload(ctx, videoFile)
+		if apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		writeDryRun(w, profile, "", "", videoFile, audioFile, media, bytesWritten)
+		return
+	}
+
+	slog.DebugContext(ctx, "File saved, starting FFmpeg processing", "bytes", bytesWritten)
 
 	// Process with FFmpeg using same logic as URL-based processing
 	w.Header().Set("Content-Type", "application/json")
 
-	// Process the uploaded video file with FFmpeg
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second) // Shorter timeout for testing
-	defer cancel()
-
-	log.Printf("Starting FFmpeg processing with %s format (file size: %.2f MB), timeout: 30s", 
-		outputFormat, float64(header.Size)/(1024*1024))
+	// Serve an identical earlier result from the cache if there is one
+	resultKey := cacheKey("sha256:"+hex.EncodeToString(hasher.Sum(nil)), profile, "")
+	cacheHit := results.materialize(resultKey, audioFile)
+	if cacheHit {
+		slog.InfoContext(ctx, "Cache hit for upload, skipping FFmpeg", "filename", header.Filename)
+	} else {
+		// Process the uploaded video file with FFmpeg once a worker slot is
+		// free, saving the job for resumption if it is still queued at shutdown
+		ticket.resume = &pendingJob{ID: jobIDFrom(ctx), Tenant: instanceId, Priority: class.String(),
+			Profile: profile.Name, CacheKey: resultKey, Input: videoFile, CallbackURL: r.FormValue("callback_url")}
+		release, ok := waitForSlot(ctx, w, r, ffmpegPool, ticket)
+		if !ok {
+			return
+		}
+		defer release()
+		ctx, cancel := context.WithTimeout(startStage(ctx, "transcode"), cfg.FFmpeg.UploadTimeout.std()) // Shorter timeout for testing
+		defer cancel()
 
-	var cmd *exec.Cmd
-	switch outputFormat {
-	case "wav":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "pcm_s16le", "-ar", "44100", "-y", audioFile)
-	case "flac":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "flac", "-ar", "44100", "-y", audioFile)
-	case "aac":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "aac", "-ab", "192k", "-ar", "44100", "-y", audioFile)
-	default: // mp3
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "mp3", "-ab", "192k", "-ar", "44100", "-y", audioFile)
-	}
+		slog.InfoContext(ctx, "Starting FFmpeg processing", "format", outputFormat, "bytes", header.Size, "timeout", cfg.FFmpeg.UploadTimeout.std().String())
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Printf("FFmpeg failed: %v, output: %s", err, string(output))
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("ffmpeg failed: %v, stderr: %s", err, string(output)),
+		output, err := profile.runFFmpeg(ctx, videoFile, audioFile, "")
+		release()
+		if err != nil {
+			slog.ErrorContext(ctx, "FFmpeg failed", "error", err, "stderr", string(output))
+			writeError(w, r, ffmpegError(ctx, err, output))
+			return
 		}
-		json.NewEncoder(w).Encode(response)
-		return
-	}
 
-	log.Printf("FFmpeg processing completed successfully")
+		slog.InfoContext(ctx, "FFmpeg processing completed")
+		results.put(resultKey, audioFile, profile)
+	}
 
 	// Read the processed audio file and encode as base64 for R2 upload
 	// But only for smaller files to avoid Cloudflare limits
+	ctx = startStage(ctx, "publish")
 	audioInfo, err := os.Stat(audioFile)
 	if err != nil {
-		log.Printf("Failed to get audio file info: %v", err)
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Failed to get audio file info: %v", err),
-		}
-		json.NewEncoder(w).Encode(response)
+		slog.ErrorContext(ctx, "Failed to get audio file info", "error", err)
+		writeError(w, r, newAPIErrorf(codeInternal, "Failed to get audio file info: %v", err))
 		return
 	}
-	
+
 	audioSize := audioInfo.Size()
+	outputSize.observe(float64(audioSize), profile.Name)
 	audioSizeMB := float64(audioSize) / (1024 * 1024)
 	audioFileName := fmt.Sprintf("audio_%s_%d.%s", instanceId, timestamp, outputFormat)
-	
-	log.Printf("Processed audio file: %s (size: %.2f MB)", audioFileName, audioSizeMB)
-	
-	// If audio file is small enough (< 10MB), include it in response for R2 upload
+
+	slog.InfoContext(ctx, "Processed audio file", "file", audioFileName, "bytes", audioSize)
+
+	// If audio file is small enough, include it in response for R2 upload
 	// Otherwise, we'll need to implement direct R2 upload from container
-	if audioSize < 10*1024*1024 { // 10MB limit
+	if audioSize < cfg.Limits.MaxInlineAudioBytes {
 		audioData, err := os.ReadFile(audioFile)
 		if err != nil {
-			log.Printf("Failed to read processed audio file: %v", err)
-			response := FFmpegResponse{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to read processed audio: %v", err),
-			}
-			json.NewEncoder(w).Encode(response)
+			slog.ErrorContext(ctx, "Failed to read processed audio file", "error", err)
+			writeError(w, r, newAPIErrorf(codeInternal, "Failed to read processed audio: %v", err))
 			return
 		}
-		
+
 		// Encode audio data as base64 for transfer
-		audioBase64 := base64.StdEncoding.EncodeToString(audioData)
-		
+		audioBase64 := encodeBase64(ctx, audioData)
+		downloadURL := publishOutput(audioFile, profile)
+
 		response := FFmpegResponse{
 			Success:     true,
 			Message:     "Audio extracted from uploaded file and ready for storage",
-			DownloadURL: fmt.Sprintf("/download/%s", audioFileName),
+			CacheHit:    cacheHit,
+			DownloadURL: downloadURL,
 			FileName:    audioFileName,
 			R2Key:       audioFileName,
-			AudioURL:    fmt.Sprintf("/download/%s", audioFileName),
+			AudioURL:    downloadURL,
 			AudioData:   audioBase64,
 		}
-		
-		log.Printf("Upload processing completed: %s (included in response)", audioFileName)
-		json.NewEncoder(w).Encode(response)
+
+		slog.InfoContext(ctx, "Upload processing completed, audio included in response", "file", audioFileName)
+		writeJSON(w, http.StatusOK, response)
 	} else {
 		// File too large for response - need direct R2 upload or return error
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("Processed audio too large (%.1f MB) for direct upload. Use URL-based processing for large files.", audioSizeMB),
-		}
-		json.NewEncoder(w).Encode(response)
+		writeError(w, r, newAPIErrorf(codeOutputTooLarge, "Processed audio too large (%.1f MB) for direct upload. Use URL-based processing for large files.", audioSizeMB))
 	}
-	
-	// Clean up the audio file
-	defer os.Remove(audioFile)
 }
 
 // ProgressCallback is a function type for progress updates
 type ProgressCallback func(stage, message string, progress float64)
 
+// downloadSource fetches a request's video URL or object into path and
+// records the download metrics. It returns the video_source reported to
+// clients and the size of the downloaded file. Extraction, recipes and
+// resumed jobs all download through it.
+func downloadSource(ctx context.Context, videoURL string, source *ObjectSource, path string, progress ProgressCallback) (videoSource string, size int64, err error) {
+	start := time.Now()
+	if source != nil {
+		// Fetch straight from object storage with parallel ranged GETs
+		slog.InfoContext(ctx, "Downloading from object storage", "source", source.String())
+		videoSource = "object_storage"
+		var client *s3Client
+		if client, err = newS3ClientFromConfig(); err == nil {
+			err = client.downloadObjectWithProgress(ctx, *source, path, progress)
+		}
+	} else {
+		slog.InfoContext(ctx, "Downloading from URL", "url", videoURL)
+		videoSource = "direct"
+		err = downloadDirectURLWithProgress(ctx, videoURL, path, progress)
+	}
+	if err != nil {
+		return videoSource, 0, err
+	}
+	if info, statErr := os.Stat(path); statErr == nil {
+		size = info.Size()
+	}
+	downloadDuration.observe(time.Since(start).Seconds(), videoSource)
+	downloadBytes.add(float64(size), videoSource)
+	return videoSource, size, nil
+}
+
 // downloadDirectURL downloads a video from a direct URL with chunked downloading and progress updates
-func downloadDirectURLWithProgress(url, outputPath string, progressCallback ProgressCallback) error {
-	log.Printf("Starting chunked download from: %s", url)
-	log.Printf("Target path: %s", outputPath)
-	
+func downloadDirectURLWithProgress(ctx context.Context, url, outputPath string, progressCallback ProgressCallback) error {
+	slog.InfoContext(ctx, "Starting chunked download", "url", url, "path", outputPath)
+
 	progressCallback("info", "Getting file information...", 0)
-	
+
 	// First, get the file size with a HEAD request
 	client := &http.Client{
-		Timeout: 5 * time.Second,
+		Timeout: cfg.Download.HeadTimeout.std(),
 	}
-	
-	headResp, err := client.Head(url)
+
+	probeCtx, probeSpan := startSpan(ctx, "HEAD source", spanKindClient)
+	headReq, err := http.NewRequestWithContext(probeCtx, http.MethodHead, url, nil)
+	if err != nil {
+		probeSpan.finish()
+		return fmt.Errorf("failed to get file info: %v", err)
+	}
+	injectTraceparent(probeCtx, headReq)
+	headResp, err := client.Do(headReq)
+	probeSpan.fail(err)
+	probeSpan.finish()
 	if err != nil {
-		log.Printf("HEAD request failed: %v", err)
+		slog.WarnContext(ctx, "HEAD request failed", "error", err)
 		return fmt.Errorf("failed to get file info: %v", err)
 	}
-	
+	headResp.Body.Close()
+
 	fileSize := headResp.ContentLength
 	fileSizeMB := float64(fileSize) / (1024 * 1024)
-	log.Printf("File size: %d bytes (%.2f MB)", fileSize, fileSizeMB)
-	
+	slog.InfoContext(ctx, "Source size", "bytes", fileSize)
+
 	progressCallback("info", fmt.Sprintf("File size: %.2f MB", fileSizeMB), 5)
-	
+
 	// Check if file is too large (chunking allows much larger files)
-	if fileSize > 200*1024*1024 { // 200MB limit - chunked download makes this feasible
-		return fmt.Errorf("video file too large (%.1f MB). Maximum supported: 200MB", fileSizeMB)
+	if maxBytes := cfg.Limits.MaxDownloadBytes; fileSize > maxBytes { // chunked download makes large files feasible
+		return newAPIErrorf(codeSourceTooLarge, "video file too large (%.1f MB). Maximum supported: %dMB", fileSizeMB, maxBytes/(1024*1024))
 	}
-	
+
 	// Create output file
 	videoFileHandle, err := os.Create(outputPath)
 	if err != nil {
 		return fmt.Errorf("failed to create temp file: %v", err)
 	}
 	defer videoFileHandle.Close()
-	
-	// Download in 5MB chunks
-	chunkSize := int64(5 * 1024 * 1024) // 5MB chunks
+
+	// Download in fixed-size chunks
+	chunkSize := cfg.Download.ChunkSize
 	var totalWritten int64
 	totalChunks := (fileSize + chunkSize - 1) / chunkSize
-	
+
 	progressCallback("download", "Starting chunked download...", 10)
-	
+
 	for chunkNum, start := int64(1), int64(0); start < fileSize; chunkNum, start = chunkNum+1, start+chunkSize {
 		end := start + chunkSize - 1
 		if end >= fileSize {
 			end = fileSize - 1
 		}
-		
+
 		chunkSizeMB := float64(end-start+1) / (1024 * 1024)
 		progressMsg := fmt.Sprintf("Downloading chunk %d/%d (%.1f MB)", chunkNum, totalChunks, chunkSizeMB)
 		progress := 10 + (float64(chunkNum-1)/float64(totalChunks))*50 // 10-60% for download
-		
+
 		progressCallback("download", progressMsg, progress)
-		log.Printf("Downloading chunk %d/%d: %d-%d", chunkNum, totalChunks, start, end)
-		
-		// Create range request
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			return fmt.Errorf("failed to create range request: %v", err)
-		}
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-		
-		// Download chunk with timeout
-		chunkClient := &http.Client{
-			Timeout: 15 * time.Second, // Longer timeout for larger chunks
-		}
-		
-		resp, err := chunkClient.Do(req)
-		if err != nil {
-			log.Printf("Chunk download failed: %v", err)
-			return fmt.Errorf("failed to download chunk %d: %v", chunkNum, err)
-		}
-		
-		if resp.StatusCode != 206 && resp.StatusCode != 200 { // 206 = Partial Content
-			resp.Body.Close()
-			return fmt.Errorf("server doesn't support range requests or failed: HTTP %d", resp.StatusCode)
-		}
-		
-		// Copy chunk to file
-		written, err := io.Copy(videoFileHandle, resp.Body)
-		resp.Body.Close()
-		
+		slog.DebugContext(ctx, "Downloading chunk", "chunk", chunkNum, "chunks", totalChunks, "start", start, "end", end)
+
+		written, err := downloadChunk(ctx, url, videoFileHandle, chunkNum, start, end)
 		if err != nil {
-			log.Printf("Failed to write chunk %d: %v", chunkNum, err)
-			return fmt.Errorf("failed to write chunk %d: %v", chunkNum, err)
+			return err
 		}
-		
+
 		totalWritten += written
 		completedPct := float64(totalWritten) / float64(fileSize) * 100
-		log.Printf("Chunk %d written: %d bytes (total: %.1f%% - %d/%d bytes)", 
-			chunkNum, written, completedPct, totalWritten, fileSize)
+		slog.DebugContext(ctx, "Chunk written", "chunk", chunkNum, "bytes", written,
+			"total_bytes", totalWritten, "percent", completedPct)
 	}
-	
+
 	progressCallback("download", "Download completed!", 60)
-	log.Printf("Download completed: %d bytes written", totalWritten)
+	slog.InfoContext(ctx, "Download completed", "bytes", totalWritten)
 	return nil
 }
 
+// downloadChunk fetches bytes start..end (inclusive) of url into f under a
+// child span of the download stage
+func downloadChunk(ctx context.Context, url string, f io.Writer, chunkNum, start, end int64) (int64, error) {
+	ctx, span := startSpan(ctx, "GET chunk", spanKindClient)
+	defer span.finish()
+	span.setAttr("chunk.index", chunkNum)
+	span.setAttr("http.request.header.range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	// Create range request
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		span.fail(err)
+		return 0, fmt.Errorf("failed to create range request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	injectTraceparent(ctx, req)
+
+	// Download chunk with timeout
+	chunkClient := &http.Client{
+		Timeout: cfg.Download.ChunkTimeout.std(), // Longer timeout for larger chunks
+	}
+
+	resp, err := chunkClient.Do(req)
+	if err != nil {
+		span.fail(err)
+		slog.WarnContext(ctx, "Chunk download failed", "chunk", chunkNum, "error", err)
+		return 0, fmt.Errorf("failed to download chunk %d: %v", chunkNum, err)
+	}
+	defer resp.Body.Close()
+	span.setAttr("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode != 206 && resp.StatusCode != 200 { // 206 = Partial Content
+		err := fmt.Errorf("server doesn't support range requests or failed: HTTP %d", resp.StatusCode)
+		span.fail(err)
+		return 0, err
+	}
+
+	// Copy chunk to file
+	written, err := io.Copy(f, resp.Body)
+	span.setAttr("chunk.bytes", written)
+	if err != nil {
+		span.fail(err)
+		slog.ErrorContext(ctx, "Failed to write chunk", "chunk", chunkNum, "error", err)
+		return written, fmt.Errorf("failed to write chunk %d: %v", chunkNum, err)
+	}
+	return written, nil
+}
+
+// encodeBase64 encodes an output for the JSON response under its own span,
+// since large files make this a noticeable part of a request
+func encodeBase64(ctx context.Context, data []byte) string {
+	_, span := startSpan(ctx, "encode base64", spanKindInternal)
+	defer span.finish()
+	span.setAttr("bytes", len(data))
+	return base64.StdEncoding.EncodeToString(data)
+}
+
 // Backward compatibility wrapper
 func downloadDirectURL(url, outputPath string) error {
-	return downloadDirectURLWithProgress(url, outputPath, func(stage, message string, progress float64) {
+	ctx := context.Background()
+	return downloadDirectURLWithProgress(ctx, url, outputPath, func(stage, message string, progress float64) {
 		// Silent progress - just log
-		log.Printf("[%s] %.1f%% - %s", stage, progress, message)
+		slog.DebugContext(withStage(ctx, stage), message, "progress", progress)
 	})
 }
 
 type FFmpegRequest struct {
-	VideoURL     string `json:"video_url"`
-	UseR2Storage bool   `json:"use_r2_storage"`
-	InstanceID   string `json:"instance_id"`
-	AudioFormat  string `json:"audio_format,omitempty"` // mp3, wav, etc.
-	AudioQuality string `json:"audio_quality,omitempty"` // 192k, 320k, etc.
+	VideoURL     string        `json:"video_url" doc:"Direct HTTP/HTTPS URL to the video; required unless source is set"`
+	Source       *ObjectSource `json:"source,omitempty" doc:"Object in S3-compatible storage to fetch instead of video_url"` // fetched from object storage instead of video_url
+	UseR2Storage bool          `json:"use_r2_storage" doc:"Return the audio base64-encoded in audio_data instead of a download URL"`
+	InstanceID   string        `json:"instance_id" doc:"Caller-chosen identifier for the job; jobs are scheduled fairly across instance IDs"`
+	Priority     string        `json:"priority,omitempty" doc:"Scheduling class: interactive (default) or batch"`
+	AudioFormat  string        `json:"audio_format,omitempty" doc:"Output format: mp3, wav, aac, flac or opus (default mp3)"` // mp3, wav, etc.
+	AudioQuality string        `json:"audio_quality,omitempty" doc:"Bitrate for lossy formats, such as 192k (default)"`       // 192k, 320k, etc.
+	Preset       string        `json:"preset,omitempty" doc:"Named preset from /v1/presets to use instead of audio_format and audio_quality"`
+	CallbackURL  string        `json:"callback_url,omitempty" doc:"URL the final response is POSTed to, signed in the X-Webhook-Signature header"`
+	DryRun       bool          `json:"dry_run,omitempty" doc:"Validate the request and probe the source, returning the planned FFmpeg command instead of running it"`
+}
+
+// UploadBase64Request is the JSON body of /ffmpeg/upload-base64
+type UploadBase64Request struct {
+	VideoData    string `json:"video_data" openapi:"required" doc:"Base64-encoded video file"`
+	Filename     string `json:"filename" doc:"Original file name; its extension is kept for FFmpeg"`
+	FileSize     int64  `json:"file_size" doc:"Size of the decoded video in bytes"`
+	OutputFormat string `json:"output_format" doc:"Output format: mp3, wav, aac, flac or opus (default mp3)"`
+	InstanceId   string `json:"instance_id" doc:"Caller-chosen identifier used in output file names; jobs are scheduled fairly across instance IDs"`
+	Priority     string `json:"priority,omitempty" doc:"Scheduling class: interactive (default) or batch"`
+	CallbackURL  string `json:"callback_url,omitempty" doc:"URL the final response is POSTed to, signed in the X-Webhook-Signature header"`
+	DryRun       bool   `json:"dry_run,omitempty" doc:"Validate the request and probe the video, returning the planned FFmpeg command instead of running it"`
 }
 
 type FFmpegResponse struct {
-	Success       bool   `json:"success"`
-	Message       string `json:"message"`
+	Success       bool   `json:"success" openapi:"required"`
+	Message       string `json:"message" openapi:"required"`
 	AudioData     string `json:"audio_data,omitempty"`
 	AudioURL      string `json:"audio_url,omitempty"`
 	DownloadURL   string `json:"download_url,omitempty"`
@@ -610,11 +707,16 @@ type FFmpegResponse struct {
 	Progress      string `json:"progress,omitempty"`
 	FileSize      string `json:"file_size,omitempty"`
 	DownloadSpeed string `json:"download_speed,omitempty"`
+	Code          string `json:"code,omitempty"`    // machine-readable error code, see errors.go
+	Details       string `json:"details,omitempty"` // diagnostic output such as FFmpeg stderr
+
+	Diagnosis *ffmpegDiagnosis `json:"diagnosis,omitempty"` // classified FFmpeg failure
+	CacheHit  bool             `json:"cache_hit,omitempty"`
 }
 
 func ffmpegHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, r, newAPIError(codeMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
@@ -622,130 +724,172 @@ func ffmpegHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Parse request body
 	var req FFmpegRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		response := FFmpegResponse{
-			Success: false,
-			Error:   "Invalid JSON payload",
-		}
-		json.NewEncoder(w).Encode(response)
+	if apiErr := decodeJSON(r, &req); apiErr != nil {
+		writeError(w, r, apiErr)
 		return
 	}
-
-	if req.VideoURL == "" {
-		response := FFmpegResponse{
-			Success: false,
-			Error:   "video_url is required",
-		}
-		json.NewEncoder(w).Encode(response)
+	if apiErr := req.validate(); apiErr != nil {
+		writeError(w, r, apiErr)
 		return
 	}
+	if req.DryRun {
+		untrackDryRun(w, r)
+	}
 
 	// Create unique filenames
 	instanceId := os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID")
 	if instanceId == "" {
 		instanceId = "default"
 	}
-	
-	timestamp := time.Now().Unix()
-	videoFile := filepath.Join("/tmp/processing", fmt.Sprintf("video_%s_%d.tmp", instanceId, timestamp))
-	
+	logInstance := req.InstanceID
+	if logInstance == "" {
+		logInstance = instanceId
+	}
+	ctx := withLogAttrs(startStage(r.Context(), "probe"), slog.String("instance_id", logInstance))
+	class, _ := parsePriority(req.Priority) // validated above
+	ticket := jobTicket{tenant: logInstance, class: class}
+
+	// The source size is unknown until the download starts, so only refuse
+	// here when the processing directory is already out of space
+	if refuseIfNoSpace(ctx, w, r, 0) {
+		return
+	}
+
+	timestamp := time.Now().UnixNano() // unique across batch items started together
+	videoFile := filepath.Join(cfg.Storage.ProcessingDir, fmt.Sprintf("video_%s_%d.tmp", instanceId, timestamp))
+
 	// Set audio format and quality defaults
 	audioFormat := req.AudioFormat
 	if audioFormat == "" {
 		audioFormat = "mp3"
 	}
-	
+
 	audioQuality := req.AudioQuality
 	if audioQuality == "" {
 		audioQuality = "192k"
 	}
-	
-	audioFile := filepath.Join("/tmp/processing", fmt.Sprintf("audio_%s_%d.%s", instanceId, timestamp, audioFormat))
+
+	profile, apiErr := outputProfile(audioFormat, req.Preset)
+	if apiErr != nil {
+		// The preset was deleted since the request was validated
+		writeError(w, r, apiErr)
+		return
+	}
+	if req.Preset != "" {
+		audioQuality = profile.Bitrate
+	}
+	audioFormat = profile.Name
+
+	audioFile := filepath.Join(cfg.Storage.ProcessingDir, fmt.Sprintf("audio_%s_%d.%s", instanceId, timestamp, audioFormat))
+
+	// A dry run stops at the plan: the source is probed, never downloaded
+	if req.DryRun {
+		media, sourceSize, apiErr := probeSource(ctx, req)
+		if apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		writeDryRun(w, profile, req.Preset, audioQuality, videoFile, audioFile, media, sourceSize)
+		return
+	}
+	journal.describe(ctx, jobParams{Tenant: logInstance, Priority: class.String(), Profile: profile.Name, Quality: audioQuality,
+		Preset: req.Preset, VideoURL: req.VideoURL, Source: req.Source})
+	requestCallback(w, req.CallbackURL)
+
+	// The janitor deletes the input when this job ends and the output once
+	// its artifact TTL expires
+	tempFiles.trackInput(videoFile)
+	defer tempFiles.release(videoFile)
+	tempFiles.trackPending(audioFile)
 
 	var videoTitle, duration, videoSource string
 
-	// Download from direct URL with progress updates
-	log.Printf("Downloading from URL: %s", req.VideoURL)
-	videoSource = "direct"
-	
 	// Send initial progress response
 	w.Header().Set("Content-Type", "application/json")
-	
+
 	progressCallback := func(stage, message string, progress float64) {
 		// For now, just log progress. In a real implementation, you might use Server-Sent Events
-		log.Printf("Progress: %.1f%% - %s", progress, message)
+		slog.DebugContext(withStage(ctx, stage), message, "progress", progress)
 	}
-	
-	err := downloadDirectURLWithProgress(req.VideoURL, videoFile, progressCallback)
-	if err != nil {
-		response := FFmpegResponse{
-			Success: false,
-			Error:   err.Error(),
+
+	// Identify the source cheaply (URL or object key plus ETag) so a repeated
+	// request can be answered from the cache before downloading anything
+	var resultKey string
+	if results != nil {
+		if id := sourceIdentity(ctx, req); id != "" {
+			resultKey = cacheKey(id, profile, audioQuality)
 		}
-		json.NewEncoder(w).Encode(response)
-		return
 	}
+	cacheHit := results.materialize(resultKey, audioFile)
 
-	// Clean up video file after processing
-	defer os.Remove(videoFile)
-
-	// Extract audio using FFmpeg with configurable format and quality
-	// Use context with timeout for FFmpeg processing (longer for larger files)
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second) // 1 minute for larger files
-	defer cancel()
-
-	// Get file info for progress calculation
-	fileInfo, _ := os.Stat(videoFile)
 	var fileSize int64
-	if fileInfo != nil {
-		fileSize = fileInfo.Size()
-	}
-	
-	log.Printf("Starting FFmpeg processing with %s format (file size: %.2f MB)", 
-		audioFormat, float64(fileSize)/(1024*1024))
-
-	var cmd *exec.Cmd
-	switch audioFormat {
-	case "wav":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "pcm_s16le", "-ar", "44100", "-y", audioFile)
-	case "flac":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "flac", "-ar", "44100", "-y", audioFile)
-	case "aac":
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "aac", "-ab", audioQuality, "-ar", "44100", "-y", audioFile)
-	default: // mp3
-		cmd = exec.CommandContext(ctx, "ffmpeg", "-i", videoFile, "-vn", "-acodec", "mp3", "-ab", audioQuality, "-ar", "44100", "-y", audioFile)
-	}
-	
-	log.Printf("Processing audio extraction (%.2f MB video → %s audio)...", 
-		float64(fileSize)/(1024*1024), audioFormat)
-	
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if ctx.Err() == context.DeadlineExceeded {
-			response := FFmpegResponse{
-				Success: false,
-				Error:   "FFmpeg processing timed out (60s limit). File may be too large for processing.",
-				Progress: "Processing failed - timeout",
+	if cacheHit {
+		slog.InfoContext(ctx, "Cache hit, skipping download and FFmpeg", "file", audioFile)
+	} else {
+		// A job still queued at shutdown is saved and resumed on restart
+		ticket.resume = &pendingJob{ID: jobIDFrom(ctx), Tenant: logInstance, Priority: class.String(),
+			Profile: profile.Name, Preset: req.Preset, Quality: audioQuality, CacheKey: resultKey, Request: &req, CallbackURL: req.CallbackURL}
+		release, ok := waitForSlot(ctx, w, r, downloadPool, ticket)
+		if !ok {
+			return
+		}
+		defer release()
+		ctx = startStage(ctx, "download")
+		var err error
+		videoSource, fileSize, err = downloadSource(ctx, req.VideoURL, req.Source, videoFile, progressCallback)
+		release()
+		if err != nil {
+			writeError(w, r, asAPIError(err, codeDownloadFailed))
+			return
+		}
+		inputSize.observe(float64(fileSize), "extract")
+
+		// Without an ETag the cache key has to come from the downloaded bytes
+		if results != nil && resultKey == "" {
+			if h, err := hashFile(videoFile); err == nil {
+				resultKey = cacheKey(h, profile, audioQuality)
+				cacheHit = results.materialize(resultKey, audioFile)
 			}
-			json.NewEncoder(w).Encode(response)
+		}
+	}
+
+	if !cacheHit {
+		// Extract audio using FFmpeg with configurable format and quality
+		// once a worker slot is free. Use context with timeout for FFmpeg
+		// processing (longer for larger files)
+		if ticket.resume != nil {
+			ticket.resume.Input, ticket.resume.CacheKey = videoFile, resultKey
+		}
+		release, ok := waitForSlot(ctx, w, r, ffmpegPool, ticket)
+		if !ok {
 			return
 		}
-		response := FFmpegResponse{
-			Success: false,
-			Error:   fmt.Sprintf("FFmpeg failed: %v, output: %s", err, string(output)),
+		defer release()
+		ctx, cancel := context.WithTimeout(startStage(ctx, "transcode"), cfg.FFmpeg.ExtractTimeout.std()) // longer for larger files
+		defer cancel()
+
+		slog.InfoContext(ctx, "Starting FFmpeg processing", "format", audioFormat, "quality", audioQuality, "bytes", fileSize)
+
+		output, err := profile.runFFmpeg(ctx, videoFile, audioFile, audioQuality)
+		release()
+		if err != nil {
+			slog.ErrorContext(ctx, "FFmpeg failed", "error", err, "stderr", string(output))
+			writeError(w, r, ffmpegError(ctx, err, output))
+			return
 		}
-		json.NewEncoder(w).Encode(response)
-		return
+
+		results.put(resultKey, audioFile, profile)
 	}
+	recordResultKey(w, resultKey)
+
+	ctx = startStage(ctx, "publish")
 
 	// Check if audio file was created
-	if _, err := os.Stat(audioFile); os.IsNotExist(err) {
-		response := FFmpegResponse{
-			Success: false,
-			Error:   "Audio file was not created",
-		}
-		json.NewEncoder(w).Encode(response)
+	if info, err := os.Stat(audioFile); os.IsNotExist(err) {
+		writeError(w, r, newAPIError(codeTranscodeFailed, "Audio file was not created"))
 		return
+	} else if err == nil {
+		outputSize.observe(float64(info.Size()), profile.Name)
 	}
 
 	// If using R2 storage, return base64 encoded data
@@ -753,19 +897,12 @@ func ffmpegHandler(w http.ResponseWriter, r *http.Request) {
 		// Read the audio file
 		audioData, err := os.ReadFile(audioFile)
 		if err != nil {
-			response := FFmpegResponse{
-				Success: false,
-				Error:   fmt.Sprintf("Failed to read audio file: %v", err),
-			}
-			json.NewEncoder(w).Encode(response)
+			writeError(w, r, newAPIErrorf(codeInternal, "Failed to read audio file: %v", err))
 			return
 		}
 
 		// Encode to base64
-		base64Data := base64.StdEncoding.EncodeToString(audioData)
-
-		// Clean up the local file immediately
-		os.Remove(audioFile)
+		base64Data := encodeBase64(ctx, audioData)
 
 		// Get audio file info
 		audioInfo, _ := os.Stat(audioFile)
@@ -773,18 +910,22 @@ func ffmpegHandler(w http.ResponseWriter, r *http.Request) {
 		if audioInfo != nil {
 			audioSize = fmt.Sprintf("%.2f MB", float64(audioInfo.Size())/(1024*1024))
 		}
-		
+
+		// Clean up the local file immediately
+		tempFiles.release(audioFile)
+
 		response := FFmpegResponse{
 			Success:     true,
-			Message:     fmt.Sprintf("Audio extracted successfully (%.2f MB video → %s audio)", float64(fileSize)/(1024*1024), audioSize),
+			Message:     extractionMessage(fileSize, audioSize, cacheHit),
 			AudioData:   base64Data,
 			VideoTitle:  videoTitle,
 			VideoSource: videoSource,
 			Duration:    duration,
 			FileSize:    fmt.Sprintf("%.2f MB", float64(fileSize)/(1024*1024)),
 			Progress:    "100%",
+			CacheHit:    cacheHit,
 		}
-		json.NewEncoder(w).Encode(response)
+		writeJSON(w, http.StatusOK, response)
 		return
 	}
 
@@ -794,55 +935,90 @@ func ffmpegHandler(w http.ResponseWriter, r *http.Request) {
 	if audioInfo != nil {
 		audioSize = fmt.Sprintf("%.2f MB", float64(audioInfo.Size())/(1024*1024))
 	}
-	
-	// For traditional download, return the download URL
+
+	// For traditional download, return a signed download URL
+	downloadURL := publishOutput(audioFile, profile)
+	slog.InfoContext(ctx, "Extraction completed", "file", filepath.Base(audioFile), "cache_hit", cacheHit)
 	response := FFmpegResponse{
 		Success:     true,
-		Message:     fmt.Sprintf("Audio extracted successfully (%.2f MB video → %s audio)", float64(fileSize)/(1024*1024), audioSize),
-		AudioURL:    fmt.Sprintf("/download/%s", filepath.Base(audioFile)),
+		Message:     extractionMessage(fileSize, audioSize, cacheHit),
+		AudioURL:    downloadURL,
+		DownloadURL: downloadURL,
+		FileName:    filepath.Base(audioFile),
 		VideoTitle:  videoTitle,
 		VideoSource: videoSource,
 		FileSize:    fmt.Sprintf("%.2f MB", float64(fileSize)/(1024*1024)),
 		Progress:    "100%",
 		Duration:    duration,
+		CacheHit:    cacheHit,
 	}
 
-	json.NewEncoder(w).Encode(response)
+	writeJSON(w, http.StatusOK, response)
+}
+
+// extractionMessage describes a finished extraction for FFmpegResponse.Message
+func extractionMessage(videoSize int64, audioSize string, cacheHit bool) string {
+	if cacheHit {
+		return fmt.Sprintf("Audio served from cache (%s audio)", audioSize)
+	}
+	return fmt.Sprintf("Audio extracted successfully (%.2f MB video → %s audio)", float64(videoSize)/(1024*1024), audioSize)
 }
 
+// downloadHandler serves finished outputs by opaque artifact ID. Requests
+// must carry a valid, unexpired signature from FFmpegResponse.DownloadURL.
+// Content types come from the output profile, and Range, conditional
+// requests and HEAD are supported.
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	filename := r.URL.Path[len("/download/"):]
-	if filename == "" {
-		http.Error(w, "Filename required", http.StatusBadRequest)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, newAPIError(codeMethodNotAllowed, "Method not allowed"))
 		return
 	}
 
-	filePath := filepath.Join("/tmp/processing", filename)
-	
-	// Security check - ensure file is in our processing directory
-	if !filepath.HasPrefix(filePath, "/tmp/processing/") {
-		http.Error(w, "Invalid file path", http.StatusBadRequest)
+	id := r.PathValue("id")
+	if id == "" {
+		writeError(w, r, newAPIError(codeInvalidRequest, "Artifact ID required"))
 		return
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		http.Error(w, "File not found", http.StatusNotFound)
+	art, err := artifacts.resolve(id, r.URL.Query().Get("expires"), r.URL.Query().Get("sig"))
+	switch {
+	case errors.Is(err, errArtifactNotFound):
+		writeError(w, r, newAPIError(codeNotFound, "File not found"))
+		return
+	case errors.Is(err, errSignatureExpired):
+		writeError(w, r, newAPIError(codeLinkExpired, err.Error()))
+		return
+	case err != nil:
+		slog.WarnContext(r.Context(), "Rejected download", "artifact_id", id, "error", err)
+		writeError(w, r, newAPIError(codeInvalidSignature, err.Error()))
 		return
 	}
 
-	// Set headers for MP3 download
-	w.Header().Set("Content-Type", "audio/mpeg")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	f, err := os.Open(art.Path)
+	if err != nil {
+		writeError(w, r, newAPIError(codeNotFound, "File not found"))
+		return
+	}
+	defer f.Close()
 
-	// Serve the file
-	http.ServeFile(w, r, filePath)
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		writeError(w, r, newAPIError(codeNotFound, "File not found"))
+		return
+	}
 
-	// Clean up file after serving (optional)
-	go func() {
-		time.Sleep(5 * time.Minute) // Give some time for download
-		os.Remove(filePath)
-	}()
+	filename := filepath.Base(art.Path)
+	w.Header().Set("Content-Type", art.Profile.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	if art.ETag != "" {
+		w.Header().Set("ETag", art.ETag)
+	}
+
+	// ServeContent handles Range, If-None-Match, If-Modified-Since and HEAD.
+	// Outputs are never deleted on access; the janitor removes them when
+	// their artifact TTL expires.
+	http.ServeContent(w, r, filename, art.Modified, f)
 }
 
 func main() {
@@ -850,40 +1026,102 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
+	// Every other component reads its settings from cfg, so an invalid
+	// configuration stops the process before anything starts
+	loaded, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	cfg = loaded
+
+	setupLogging()
+	setupTracing()
+
+	// Start the janitor before anything else writes to the processing directory
+	tempFiles = newJanitorFromConfig()
+	tempFiles.sweepOrphans()
+	stopJanitor := make(chan struct{})
+	go tempFiles.run(time.Minute, stopJanitor)
+	defer close(stopJanitor)
+
+	health = newHealthFromConfig()
+	results = newResultCacheFromConfig()
+	journal = newJobJournalFromConfig()
+	defer journal.close()
+	webhooks = newWebhookSenderFromConfig()
+	newWorkPoolsFromConfig()
+	artifacts = newArtifactRegistryFromConfig()
+	presets = newPresetRegistryFromConfig()
+
+	// Probe FFmpeg once so profiles it cannot produce are disabled before
+	// the first request is accepted
+	probeCapabilities()
+
+	// Every request and resumed job derives from jobsCtx, so cancelling it
+	// at the end of the drain period stops whatever is still running
+	jobsCtx, cancelJobs := context.WithCancel(context.Background())
+	defer cancelJobs()
+	resumePendingJobs(jobsCtx)
+	batches = newBatchRegistryFromConfig(jobsCtx)
+
 	router := http.NewServeMux()
+	registerV1Routes(router)
+	registerLegacyRoutes(router)
+	router.HandleFunc("GET /admin/config", configHandler)
+	router.HandleFunc("GET /healthz", healthzHandler)
+	router.HandleFunc("GET /metrics", metricsHandler)
+	router.HandleFunc("GET /readyz", readyzHandler)
+	router.HandleFunc("/capabilities", capabilitiesHandler)
 	router.HandleFunc("/readme", readmeHandler)
-	router.HandleFunc("/ffmpeg/extract-audio", ffmpegHandler)
-	router.HandleFunc("/ffmpeg/upload", uploadHandler)
-	router.HandleFunc("/ffmpeg/upload-base64", uploadBase64Handler)
-	router.HandleFunc("/download/", downloadHandler)
 	router.HandleFunc("/error", errorHandler)
 	router.HandleFunc("/container", handler)
 	router.HandleFunc("/", handler)
 
 	server := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Addr:        fmt.Sprintf(":%d", cfg.Server.Port),
+		Handler:     chain(router, withRequestID, withTracing, logRequests, recoverPanics),
+		BaseContext: func(net.Listener) context.Context { return jobsCtx },
 	}
 
 	go func() {
-		log.Printf("Server listening on %s\n", server.Addr)
+		slog.Info("Server listening", "addr", server.Addr)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatal(err)
+			slog.Error("Server failed", "error", err)
+			os.Exit(1)
 		}
 	}()
 
 	// Wait to receive a signal
 	sig := <-stop
 
-	log.Printf("Received signal (%s), shutting down server...", sig)
+	slog.Info("Received signal, shutting down server", "signal", sig.String())
+	health.startDraining()
+
+	// Let running and queued jobs finish within the drain period. Jobs still
+	// queued after it are saved for the next process; running FFmpeg
+	// processes get SIGTERM, then SIGKILL after the kill grace.
+	if health.waitForJobs(cfg.Server.DrainTimeout.std()) {
+		slog.Info("All jobs finished")
+	} else {
+		slog.Warn("Drain period over, saving queued jobs and stopping running ones", "active_jobs", health.activeJobs.Load())
+	}
+	ffmpegPool.close()
+	downloadPool.close()
+	cancelJobs()
 
-	// Give the server 5 seconds to shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Give stopped jobs the kill grace to exit and the shutdown timeout to
+	// send their responses
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.FFmpeg.KillGrace.std()+cfg.Server.ShutdownTimeout.std())
 	defer cancel()
 
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatal(err)
+		slog.Error("Server shutdown failed", "error", err)
+		os.Exit(1)
 	}
 
-	log.Println("Server shutdown successfully")
+	// Webhook retries still waiting for their backoff are abandoned
+	webhooks.close()
+	tracer.shutdown(ctx)
+	slog.Info("Server shutdown successfully")
 }
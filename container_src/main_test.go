@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeFFmpeg stands in for ffmpeg and ffprobe: ffmpeg copies its -i input to
+// its last argument and logs one line per run, ffprobe reports a short clip
+// with one audio stream
+const fakeFFmpeg = `#!/bin/sh
+if [ "$(basename "$0")" = ffprobe ]; then
+  echo '{"streams":[{"index":0,"codec_type":"audio","codec_name":"aac","channels":2}],"format":{"duration":"2.0"}}'
+  exit 0
+fi
+for a in "$@"; do last="$a"; done
+while [ $# -gt 0 ]; do
+  if [ "$1" = -i ]; then in="$2"; fi
+  shift
+done
+echo run >> "$FFMPEG_RUNS"
+cp "$in" "$last"
+`
+
+// setupTestEnv points the process-wide components at a fresh processing
+// directory and puts fake ffmpeg and ffprobe binaries on PATH. It returns
+// a function counting the ffmpeg runs so far.
+func setupTestEnv(t *testing.T) (ffmpegRuns func() int) {
+	t.Helper()
+	dir := t.TempDir()
+
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ffmpeg", "ffprobe"} {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(fakeFFmpeg), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	runs := filepath.Join(dir, "ffmpeg_runs")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("FFMPEG_RUNS", runs)
+
+	saved := cfg
+	cfg = defaultConfig()
+	cfg.Storage.ProcessingDir = filepath.Join(dir, "processing")
+	cfg.Storage.TempMinFreeBytes = 0
+	t.Cleanup(func() { cfg = saved })
+
+	tempFiles = newJanitorFromConfig()
+	tempFiles.sweepOrphans()
+	health = newHealthFromConfig()
+	results = newResultCacheFromConfig()
+	journal = newJobJournalFromConfig()
+	t.Cleanup(func() { journal.close() })
+	webhooks = nil
+	newWorkPoolsFromConfig()
+	artifacts = newArtifactRegistryFromConfig()
+
+	return func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "run\n")
+	}
+}
+
+// serveVideo serves a fake video, supporting the HEAD and Range requests
+// the downloader makes
+func serveVideo(t *testing.T) string {
+	t.Helper()
+	video := bytes.Repeat([]byte("video"), 1000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "v.mp4", time.Time{}, bytes.NewReader(video))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/v.mp4"
+}
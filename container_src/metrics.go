@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus text-format implementation: counters, gauges and
+// histograms with labels, enough to be scraped without a client library.
+
+// collector writes one metric family in the text exposition format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// metricsRegistry holds every collector in registration order
+type metricsRegistry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+func (reg *metricsRegistry) register(c collector) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.collectors = append(reg.collectors, c)
+}
+
+// series is one labelled time series of a metric family
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64 // histograms only, non-cumulative
+	sum     float64
+	count   uint64
+}
+
+// metricVec is a metric family keyed by its label values
+type metricVec struct {
+	mu      sync.Mutex
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	labels  []string
+	bounds  []float64 // histogram upper bounds
+	series  map[string]*series
+	valueFn func() float64 // gauges computed at scrape time
+}
+
+func newMetricVec(kind, name, help string, labels ...string) *metricVec {
+	v := &metricVec{name: name, help: help, kind: kind, labels: labels, series: map[string]*series{}}
+	metrics.register(v)
+	return v
+}
+
+func newCounter(name, help string, labels ...string) *metricVec {
+	return newMetricVec("counter", name, help, labels...)
+}
+
+func newGauge(name, help string, labels ...string) *metricVec {
+	return newMetricVec("gauge", name, help, labels...)
+}
+
+// newGaugeFunc registers an unlabelled gauge whose value is read on scrape
+func newGaugeFunc(name, help string, fn func() float64) *metricVec {
+	v := newMetricVec("gauge", name, help)
+	v.valueFn = fn
+	return v
+}
+
+func newHistogram(name, help string, bounds []float64, labels ...string) *metricVec {
+	v := newMetricVec("histogram", name, help, labels...)
+	v.bounds = bounds
+	return v
+}
+
+// with returns the series for labelValues, creating it on first use.
+// The caller must hold v.mu.
+func (v *metricVec) with(labelValues []string) *series {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values, want %d", v.name, len(labelValues), len(v.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string(nil), labelValues...)}
+		if v.kind == "histogram" {
+			s.buckets = make([]uint64, len(v.bounds))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// add adds delta to a counter or gauge
+func (v *metricVec) add(delta float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.with(labelValues).value += delta
+}
+
+func (v *metricVec) inc(labelValues ...string) {
+	v.add(1, labelValues...)
+}
+
+func (v *metricVec) dec(labelValues ...string) {
+	v.add(-1, labelValues...)
+}
+
+// set sets a gauge
+func (v *metricVec) set(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.with(labelValues).value = value
+}
+
+// observe records one histogram sample
+func (v *metricVec) observe(value float64, labelValues ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.with(labelValues)
+	if i := sort.SearchFloat64s(v.bounds, value); i < len(v.bounds) {
+		s.buckets[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+func (v *metricVec) write(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.kind)
+
+	if v.valueFn != nil {
+		fmt.Fprintf(w, "%s %s\n", v.name, formatFloat(v.valueFn()))
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// Unlabelled counters and gauges report zero before their first update
+	if len(v.labels) == 0 && v.kind != "histogram" && len(v.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", v.name)
+		return
+	}
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		if v.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.labels, "", ""), formatFloat(s.value))
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range v.bounds {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labels, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", v.name, formatLabels(v.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", v.name, formatLabels(v.labels, s.labels, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", v.name, formatLabels(v.labels, s.labels, "", ""), s.count)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders {name="value",...}, appending an extra label such as le
+func formatLabels(names, values []string, extraName, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+	parts := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		parts = append(parts, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	if extraName != "" {
+		parts = append(parts, extraName+`="`+extraValue+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metrics is the process-wide registry served at /metrics
+var metrics = &metricsRegistry{}
+
+var (
+	durationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+	sizeBuckets     = []float64{64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 128 << 20, 256 << 20}
+
+	httpRequests = newCounter("vegvisr_http_requests_total",
+		"HTTP requests by route pattern, method and status.", "route", "method", "status")
+	httpDuration = newHistogram("vegvisr_http_request_duration_seconds",
+		"HTTP request latency by route pattern.", durationBuckets, "route")
+
+	downloadBytes = newCounter("vegvisr_download_bytes_total",
+		"Bytes downloaded from video sources.", "source")
+	downloadDuration = newHistogram("vegvisr_download_duration_seconds",
+		"Time to download a video source.", durationBuckets, "source")
+	chunkRetries = newCounter("vegvisr_download_chunk_retries_total",
+		"Chunk downloads retried after a transient failure.", "source")
+
+	ffmpegDuration = newHistogram("vegvisr_ffmpeg_duration_seconds",
+		"FFmpeg run time by output profile and outcome.", durationBuckets, "profile", "outcome")
+	ffmpegActive = newGauge("vegvisr_ffmpeg_active_processes",
+		"FFmpeg processes currently running.")
+
+	inputSize = newHistogram("vegvisr_job_input_bytes",
+		"Size of job input videos.", sizeBuckets, "route")
+	outputSize = newHistogram("vegvisr_job_output_bytes",
+		"Size of produced audio files by profile.", sizeBuckets, "profile")
+
+	queueDepth = newGauge("vegvisr_job_queue_depth",
+		"Jobs waiting for a worker slot by pool.", "pool")
+	queueRejections = newCounter("vegvisr_job_queue_rejections_total",
+		"Jobs refused because the queue was full, by pool.", "pool")
+	webhookAttempts = newCounter("vegvisr_webhook_attempts_total",
+		"Webhook delivery attempts by outcome: delivered, retry or failed.", "outcome")
+	_ = newGaugeFunc("vegvisr_jobs_in_flight",
+		"Processing requests currently being handled.", func() float64 {
+			if health == nil {
+				return 0
+			}
+			return float64(health.activeJobs.Load())
+		})
+	_ = newGaugeFunc("vegvisr_temp_dir_usage_bytes",
+		"Bytes used under the processing directory, cache included.", func() float64 {
+			if tempFiles == nil {
+				return 0
+			}
+			return float64(tempFiles.usage())
+		})
+)
+
+// metricsHandler serves every registered metric in the Prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	metrics.mu.Lock()
+	collectors := append([]collector(nil), metrics.collectors...)
+	metrics.mu.Unlock()
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	bw.Flush()
+}
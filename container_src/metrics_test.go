@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// exposition renders one metric family as /metrics would
+func exposition(v *metricVec) string {
+	var sb strings.Builder
+	w := bufio.NewWriter(&sb)
+	v.write(w)
+	w.Flush()
+	return sb.String()
+}
+
+func TestMetricExposition(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric func() *metricVec
+		want   string
+	}{
+		{"unlabelled counter before its first update", func() *metricVec {
+			return &metricVec{name: "jobs_total", help: "Jobs.", kind: "counter", series: map[string]*series{}}
+		}, "# HELP jobs_total Jobs.\n# TYPE jobs_total counter\njobs_total 0\n"},
+		{"labelled counter", func() *metricVec {
+			v := &metricVec{name: "requests_total", help: "Requests.", kind: "counter", labels: []string{"route", "status"}, series: map[string]*series{}}
+			v.inc("/b", "200")
+			v.add(2, "/a", "500")
+			v.inc("/a", "500")
+			return v
+		}, "# HELP requests_total Requests.\n# TYPE requests_total counter\n" +
+			"requests_total{route=\"/a\",status=\"500\"} 3\nrequests_total{route=\"/b\",status=\"200\"} 1\n"},
+		{"escaped label values", func() *metricVec {
+			v := &metricVec{name: "errors_total", help: "Errors.", kind: "counter", labels: []string{"msg"}, series: map[string]*series{}}
+			v.inc("say \"hi\"\\\n")
+			return v
+		}, "# HELP errors_total Errors.\n# TYPE errors_total counter\nerrors_total{msg=\"say \\\"hi\\\"\\\\\\n\"} 1\n"},
+		{"gauge", func() *metricVec {
+			v := &metricVec{name: "depth", help: "Depth.", kind: "gauge", labels: []string{"pool"}, series: map[string]*series{}}
+			v.set(4, "ffmpeg")
+			v.dec("ffmpeg")
+			v.set(0.5, "download")
+			return v
+		}, "# HELP depth Depth.\n# TYPE depth gauge\ndepth{pool=\"download\"} 0.5\ndepth{pool=\"ffmpeg\"} 3\n"},
+		{"gauge read on scrape", func() *metricVec {
+			return &metricVec{name: "usage_bytes", help: "Usage.", kind: "gauge", valueFn: func() float64 { return 1 << 20 }}
+		}, "# HELP usage_bytes Usage.\n# TYPE usage_bytes gauge\nusage_bytes 1.048576e+06\n"},
+		{"histogram", func() *metricVec {
+			v := &metricVec{name: "seconds", help: "Latency.", kind: "histogram", labels: []string{"route"}, bounds: []float64{0.5, 1}, series: map[string]*series{}}
+			for _, s := range []float64{0.1, 0.5, 0.75, 3} {
+				v.observe(s, "/x")
+			}
+			return v
+		}, "# HELP seconds Latency.\n# TYPE seconds histogram\n" +
+			"seconds_bucket{route=\"/x\",le=\"0.5\"} 2\nseconds_bucket{route=\"/x\",le=\"1\"} 3\nseconds_bucket{route=\"/x\",le=\"+Inf\"} 4\n" +
+			"seconds_sum{route=\"/x\"} 4.35\nseconds_count{route=\"/x\"} 4\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := exposition(tt.metric()); got != tt.want {
+				t.Errorf("exposition\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricWrongLabelCountPanics(t *testing.T) {
+	v := &metricVec{name: "requests_total", kind: "counter", labels: []string{"route"}, series: map[string]*series{}}
+	defer func() {
+		if recover() == nil {
+			t.Error("inc with a missing label value did not panic")
+		}
+	}()
+	v.inc()
+}
+
+func TestMetricsHandlerServesEveryFamily(t *testing.T) {
+	setupTestEnv(t)
+	health.activeJobs.Store(3)
+	queueRejections.inc("test")
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, c := range metrics.collectors {
+		v := c.(*metricVec)
+		if !strings.Contains(body, "# TYPE "+v.name+" "+v.kind+"\n") {
+			t.Errorf("/metrics lacks %s", v.name)
+		}
+	}
+	for _, line := range []string{"vegvisr_jobs_in_flight 3\n", "vegvisr_job_queue_rejections_total{pool=\"test\"} "} {
+		if !strings.Contains(body, line) {
+			t.Errorf("/metrics lacks %q", line)
+		}
+	}
+}
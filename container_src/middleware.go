@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// middleware wraps a handler with cross-cutting behaviour
+type middleware func(http.Handler) http.Handler
+
+// chain applies middlewares so the first one listed is the outermost
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// statusWriter records whether a response has started so a recovered panic
+// knows if it can still send a clean error. Interim 1xx responses, such as
+// queue position updates, do not count.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+type requestIDKey struct{}
+
+// requestIDPattern bounds client-supplied IDs so they are safe to log and echo
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// withRequestID propagates X-Request-ID, generating one when the client did
+// not send a usable value, and echoes it on the response
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, id)
+		ctx = withLogAttrs(ctx, slog.String("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// requestIDFrom returns the request ID stored in ctx, or "" outside a request
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logRequests writes one access log line per request once it completes
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+		elapsed := time.Since(start)
+		slog.Log(r.Context(), level, "Request completed", "method", r.Method, "path", r.URL.Path,
+			"status", status, "duration_ms", elapsed.Milliseconds())
+
+		// The mux records the matched pattern on the request; label by it
+		// rather than the raw path to keep the series bounded
+		route := r.Pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.inc(route, r.Method, strconv.Itoa(status))
+		httpDuration.observe(elapsed.Seconds(), route)
+	})
+}
+
+// recoverPanics turns a panicking handler into a JSON 500. If the response
+// had already started the connection is aborted instead, so the client never
+// mistakes a half-written body for a complete one.
+func recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			slog.ErrorContext(r.Context(), "Panic serving request", "method", r.Method, "path", r.URL.Path, "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+			if sw.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			writeError(sw, r, newAPIError(codeInternal, "Internal server error"))
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// withLimits bounds a route's request body to maxBody bytes and its context
+// to timeout; zero disables either limit
+func withLimits(timeout time.Duration, maxBody int64, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if maxBody > 0 {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		}
+		if timeout > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		next(w, r)
+	}
+}
+
+// bodyTooLarge reports whether err came from exceeding a route's body limit
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// schemaBuilder derives OpenAPI 3 schemas from Go types via their json tags,
+// collecting named structs as reusable components
+type schemaBuilder struct {
+	components map[string]any
+}
+
+// ref returns a schema for t, registering structs under components/schemas
+func (b *schemaBuilder) ref(t reflect.Type) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.ref(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.ref(t.Elem())}
+	case reflect.Struct:
+		if t.PkgPath() == "time" && t.Name() == "Time" {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+		name := schemaName(t)
+		if _, ok := b.components[name]; !ok {
+			b.components[name] = nil // placeholder to stop recursion
+			b.components[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// object builds the schema for a struct's exported, json-tagged fields
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+
+		prop := b.ref(f.Type)
+		if doc := f.Tag.Get("doc"); doc != "" {
+			if _, isRef := prop["$ref"]; isRef {
+				prop = map[string]any{"allOf": []any{prop}, "description": doc}
+			} else {
+				prop["description"] = doc
+			}
+		}
+		properties[name] = prop
+
+		if f.Tag.Get("openapi") == "required" {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// schemaName exports a Go type name for use as a component name
+func schemaName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// strictSchema returns a component reference for a request body, closing the
+// component to unknown properties to match strict decoding
+func (b *schemaBuilder) strictSchema(v any) map[string]any {
+	ref := b.ref(reflect.TypeOf(v))
+	name := strings.TrimPrefix(ref["$ref"].(string), "#/components/schemas/")
+	b.components[name].(map[string]any)["additionalProperties"] = false
+	return ref
+}
+
+// buildOpenAPI generates the OpenAPI document for the /v1 API and the
+// deprecated legacy aliases
+func buildOpenAPI() map[string]any {
+	b := &schemaBuilder{components: map[string]any{}}
+
+	response := b.ref(reflect.TypeOf(FFmpegResponse{}))
+	jsonContent := func(schema map[string]any) map[string]any {
+		return map[string]any{"application/json": map[string]any{"schema": schema}}
+	}
+	errorResponses := func(statuses ...int) map[string]any {
+		responses := map[string]any{}
+		for _, s := range statuses {
+			responses[strconv.Itoa(s)] = map[string]any{
+				"description": http.StatusText(s) + " (see the code field)",
+				"content":     jsonContent(response),
+			}
+		}
+		return responses
+	}
+	// Every extraction route answers a dry run with the planned command
+	dryRun := b.ref(reflect.TypeOf(DryRunResponse{}))
+	withOK := func(description string, errs map[string]any) map[string]any {
+		errs["200"] = map[string]any{"description": description + ", or the plan of a dry run",
+			"content": jsonContent(map[string]any{"oneOf": []any{response, dryRun}})}
+		return errs
+	}
+
+	extract := map[string]any{
+		"summary":     "Extract audio from a video URL or an object in S3-compatible storage",
+		"operationId": "extractAudio",
+		"parameters": []any{
+			map[string]any{"name": "Idempotency-Key", "in": "header", "schema": map[string]any{"type": "string", "maxLength": 255},
+				"description": "Makes retries safe: a retry with the same key and body gets the first job's response"},
+		},
+		"requestBody": map[string]any{
+			"required": true,
+			"content":  jsonContent(b.strictSchema(FFmpegRequest{})),
+		},
+		"responses": withOK("Audio extracted", errorResponses(http.StatusBadRequest, http.StatusConflict, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity,
+			http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInsufficientStorage)),
+	}
+
+	upload := map[string]any{
+		"summary":     "Extract audio from an uploaded video file",
+		"operationId": "uploadVideo",
+		"requestBody": map[string]any{
+			"required": true,
+			"content": map[string]any{
+				"multipart/form-data": map[string]any{
+					"schema": map[string]any{
+						"type":     "object",
+						"required": []string{"video"},
+						"properties": map[string]any{
+							"video":         map[string]any{"type": "string", "format": "binary"},
+							"output_format": map[string]any{"type": "string", "enum": profileNames()},
+							"instance_id":   map[string]any{"type": "string"},
+							"priority":      map[string]any{"type": "string", "enum": []string{"interactive", "batch"}},
+							"callback_url":  map[string]any{"type": "string", "format": "uri"},
+							"dry_run":       map[string]any{"type": "boolean"},
+						},
+					},
+				},
+			},
+		},
+		"responses": withOK("Audio extracted", errorResponses(http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity,
+			http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInsufficientStorage)),
+	}
+
+	uploadBase64 := map[string]any{
+		"summary":     "Extract audio from a base64-encoded video",
+		"operationId": "uploadVideoBase64",
+		"requestBody": map[string]any{
+			"required": true,
+			"content":  jsonContent(b.strictSchema(UploadBase64Request{})),
+		},
+		"responses": withOK("Audio extracted", errorResponses(http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity,
+			http.StatusTooManyRequests, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInsufficientStorage)),
+	}
+
+	// withStatus adds a success response with the given schema, or no body
+	withStatus := func(status int, description string, schema map[string]any, errs map[string]any) map[string]any {
+		ok := map[string]any{"description": description}
+		if schema != nil {
+			ok["content"] = jsonContent(schema)
+		}
+		errs[strconv.Itoa(status)] = ok
+		return errs
+	}
+	presetSchema := b.ref(reflect.TypeOf(Preset{}))
+
+	recipeResponses := errorResponses(http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity,
+		http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInsufficientStorage)
+	recipeResponses["200"] = map[string]any{"description": "Every step finished", "content": jsonContent(b.ref(reflect.TypeOf(RecipeResponse{})))}
+	recipe := map[string]any{
+		"summary":     "Run a multi-step recipe (probe, trim, loudnorm, encode, waveform) on one source",
+		"operationId": "runRecipe",
+		"requestBody": map[string]any{
+			"required": true,
+			"content":  jsonContent(b.strictSchema(RecipeRequest{})),
+		},
+		"responses": recipeResponses,
+	}
+
+	batchResponses := errorResponses(http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusServiceUnavailable)
+	batchResponses["202"] = map[string]any{"description": "Batch accepted; poll the Location header for progress",
+		"content": jsonContent(b.ref(reflect.TypeOf(batchState{})))}
+	batch := map[string]any{
+		"summary":     "Extract audio from many sources with shared defaults, optionally packaged as one ZIP",
+		"operationId": "createBatch",
+		"requestBody": map[string]any{
+			"required": true,
+			"content":  jsonContent(b.strictSchema(BatchRequest{})),
+		},
+		"responses": batchResponses,
+	}
+
+	download := map[string]any{
+		"summary":     "Download a finished output through a signed URL",
+		"operationId": "downloadArtifact",
+		"parameters": []any{
+			map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			map[string]any{"name": "expires", "in": "query", "required": true, "schema": map[string]any{"type": "integer"}},
+			map[string]any{"name": "sig", "in": "query", "required": true, "schema": map[string]any{"type": "string"}},
+		},
+		"responses": map[string]any{
+			"200": map[string]any{"description": "The audio file", "content": map[string]any{"audio/*": map[string]any{}}},
+			"206": map[string]any{"description": "Partial content for Range requests"},
+			"304": map[string]any{"description": "Not modified (If-None-Match)"},
+			"403": map[string]any{"description": "Invalid or expired signature", "content": jsonContent(response)},
+			"404": map[string]any{"description": "Unknown or expired artifact", "content": jsonContent(response)},
+		},
+	}
+
+	paths := map[string]any{
+		apiVersionPrefix + "/extract-audio": map[string]any{"post": extract},
+		apiVersionPrefix + "/upload":        map[string]any{"post": upload},
+		apiVersionPrefix + "/upload-base64": map[string]any{"post": uploadBase64},
+		apiVersionPrefix + "/download/{id}": map[string]any{"get": download, "head": headOperation(download)},
+		apiVersionPrefix + "/jobs/{id}": map[string]any{"get": map[string]any{
+			"summary":     "Report the status, parameters, outputs and error of a job by the ID from its X-Job-ID response header",
+			"operationId": "getJob",
+			"parameters": []any{
+				map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			},
+			"responses": map[string]any{
+				"200": map[string]any{"description": "The job", "content": jsonContent(b.ref(reflect.TypeOf(jobState{})))},
+				"404": map[string]any{"description": "Unknown or expired job", "content": jsonContent(response)},
+			},
+		}},
+		apiVersionPrefix + "/presets": map[string]any{
+			"get": map[string]any{
+				"summary":     "List the built-in and custom presets",
+				"operationId": "listPresets",
+				"responses":   map[string]any{"200": map[string]any{"description": "Every preset", "content": jsonContent(b.ref(reflect.TypeOf(presetList{})))}},
+			},
+			"post": map[string]any{
+				"summary":     "Create a preset; needs the admin token when ADMIN_TOKEN is set",
+				"operationId": "createPreset",
+				"requestBody": map[string]any{"required": true, "content": jsonContent(b.strictSchema(Preset{}))},
+				"responses": withStatus(http.StatusCreated, "Preset created", presetSchema,
+					errorResponses(http.StatusBadRequest, http.StatusUnauthorized, http.StatusConflict)),
+			},
+		},
+		apiVersionPrefix + "/presets/{name}": map[string]any{
+			"parameters": []any{
+				map[string]any{"name": "name", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			},
+			"get": map[string]any{
+				"summary":     "Get a preset",
+				"operationId": "getPreset",
+				"responses":   withStatus(http.StatusOK, "The preset", presetSchema, errorResponses(http.StatusNotFound)),
+			},
+			"put": map[string]any{
+				"summary":     "Replace a custom preset; needs the admin token when ADMIN_TOKEN is set",
+				"operationId": "updatePreset",
+				"requestBody": map[string]any{"required": true, "content": jsonContent(presetSchema)},
+				"responses": withStatus(http.StatusOK, "Preset replaced", presetSchema,
+					errorResponses(http.StatusBadRequest, http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict)),
+			},
+			"delete": map[string]any{
+				"summary":     "Delete a custom preset; needs the admin token when ADMIN_TOKEN is set",
+				"operationId": "deletePreset",
+				"responses": withStatus(http.StatusNoContent, "Preset deleted", nil,
+					errorResponses(http.StatusUnauthorized, http.StatusNotFound, http.StatusConflict)),
+			},
+		},
+		apiVersionPrefix + "/recipe": map[string]any{"post": recipe},
+		apiVersionPrefix + "/batch":  map[string]any{"post": batch},
+		apiVersionPrefix + "/batch/{id}": map[string]any{"get": map[string]any{
+			"summary":     "Report the aggregate status, per-item results and archive of a batch",
+			"operationId": "getBatch",
+			"parameters": []any{
+				map[string]any{"name": "id", "in": "path", "required": true, "schema": map[string]any{"type": "string"}},
+			},
+			"responses": map[string]any{
+				"200": map[string]any{"description": "The batch", "content": jsonContent(b.ref(reflect.TypeOf(batchState{})))},
+				"404": map[string]any{"description": "Unknown or expired batch", "content": jsonContent(response)},
+			},
+		}},
+		apiVersionPrefix + "/capabilities": map[string]any{"get": map[string]any{
+			"summary":     "Report supported output profiles, limits and optional features of this FFmpeg build",
+			"operationId": "getCapabilities",
+			"responses": map[string]any{"200": map[string]any{
+				"description": "Capabilities probed at startup",
+				"content":     jsonContent(b.ref(reflect.TypeOf(capabilities{}))),
+			}},
+		}},
+		apiVersionPrefix + "/openapi.json": map[string]any{"get": map[string]any{
+			"summary":     "This document",
+			"operationId": "getOpenAPI",
+			"responses":   map[string]any{"200": map[string]any{"description": "OpenAPI 3 document"}},
+		}},
+	}
+
+	legacy := map[string]string{
+		"/ffmpeg/extract-audio": apiVersionPrefix + "/extract-audio",
+		"/ffmpeg/upload":        apiVersionPrefix + "/upload",
+		"/ffmpeg/upload-base64": apiVersionPrefix + "/upload-base64",
+		"/download/{id}":        apiVersionPrefix + "/download/{id}",
+	}
+	for path, successor := range legacy {
+		item := map[string]any{}
+		for method, op := range paths[successor].(map[string]any) {
+			alias := map[string]any{}
+			for k, v := range op.(map[string]any) {
+				alias[k] = v
+			}
+			alias["operationId"] = op.(map[string]any)["operationId"].(string) + "Legacy"
+			alias["deprecated"] = true
+			alias["description"] = "Deprecated alias of " + successor + ". Unknown request fields are ignored rather than rejected."
+			item[method] = alias
+		}
+		paths[path] = item
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "Vegvisr Container API",
+			"version": "1.0.0",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": b.components},
+	}
+}
+
+// headOperation copies a GET operation for HEAD, which needs its own operationId
+func headOperation(get map[string]any) map[string]any {
+	head := map[string]any{}
+	for k, v := range get {
+		head[k] = v
+	}
+	head["operationId"] = get["operationId"].(string) + "Head"
+	return head
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// openAPIHandler serves the generated OpenAPI document
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIJSON)
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// presetDir is the reserved subdirectory of the processing directory that
+// holds the presets created through the API
+const presetDir = "presets"
+
+// Preset is a named set of output settings that a request can reference
+// instead of giving audio_format and audio_quality
+type Preset struct {
+	Name        string     `json:"name" openapi:"required" doc:"Lowercase letters, digits and '-', up to 64 characters"`
+	Description string     `json:"description,omitempty"`
+	Format      string     `json:"format" openapi:"required" doc:"Output format from the profile registry, as audio_format"`
+	Bitrate     string     `json:"bitrate,omitempty" doc:"Bitrate for lossy formats such as 64k; defaults to the format's"`
+	SampleRate  int        `json:"sample_rate,omitempty" doc:"Output sample rate in Hz; defaults to the format's"`
+	Channels    int        `json:"channels,omitempty" doc:"1 for mono or 2 for stereo; defaults to the source's"`
+	Loudness    *float64   `json:"loudness,omitempty" doc:"Normalise to this integrated loudness in LUFS, -70 to -5, with loudnorm"`
+	BuiltIn     bool       `json:"built_in" doc:"Read-only; built-in presets cannot be changed or deleted"`
+	UpdatedAt   *time.Time `json:"updated_at,omitempty"`
+}
+
+// presetList is the body of GET /v1/presets
+type presetList struct {
+	Presets []Preset `json:"presets"`
+}
+
+var presetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+
+// builtinPresets are named after the formats and produce exactly what
+// requesting that audio_format without an audio_quality does
+func builtinPresets() map[string]Preset {
+	builtin := make(map[string]Preset)
+	for _, name := range []string{"mp3", "wav", "aac", "flac"} {
+		p := audioProfiles[name]
+		rate, _ := strconv.Atoi(p.SampleRate)
+		builtin[name] = Preset{Name: name, Description: "Default " + name + " output", Format: name,
+			Bitrate: p.Bitrate, SampleRate: rate, BuiltIn: true}
+	}
+	return builtin
+}
+
+// presetRegistry holds the built-in presets and those created through the
+// API, which are saved to one JSON file so they survive restarts
+type presetRegistry struct {
+	mu      sync.RWMutex
+	path    string
+	builtin map[string]Preset
+	custom  map[string]Preset
+}
+
+// presets is the process-wide preset registry
+var presets *presetRegistry
+
+// newPresetRegistryFromConfig loads the presets saved by earlier runs
+func newPresetRegistryFromConfig() *presetRegistry {
+	r := &presetRegistry{
+		path:    filepath.Join(cfg.Storage.ProcessingDir, presetDir, "presets.json"),
+		builtin: builtinPresets(),
+		custom:  make(map[string]Preset),
+	}
+	data, err := os.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return r
+	}
+	var saved []Preset
+	if err == nil {
+		err = json.Unmarshal(data, &saved)
+	}
+	if err != nil {
+		slog.Warn("Failed to load presets, starting with the built-in ones", "path", r.path, "error", err)
+		return r
+	}
+	for _, p := range saved {
+		if _, clash := r.builtin[p.Name]; clash || !presetNamePattern.MatchString(p.Name) {
+			slog.Warn("Ignoring saved preset", "preset", p.Name)
+			continue
+		}
+		r.custom[p.Name] = p
+	}
+	slog.Info("Presets loaded", "custom", len(r.custom))
+	return r
+}
+
+// validate checks a preset against the profile registry and the filters of
+// this FFmpeg build
+func (p *Preset) validate() *apiError {
+	if !presetNamePattern.MatchString(p.Name) {
+		return newAPIError(codeInvalidRequest, "name may only contain lowercase letters, digits and '-', up to 64 characters")
+	}
+	if len(p.Description) > 256 {
+		return newAPIError(codeInvalidRequest, "description must be at most 256 characters")
+	}
+	profile, ok := lookupProfile(p.Format)
+	if !ok || p.Format == "" {
+		return newAPIErrorf(codeUnsupportedFormat, "Unsupported output format: %s. Supported: %s", p.Format, profileList())
+	}
+	if p.Bitrate != "" {
+		if profile.Bitrate == "" {
+			return newAPIErrorf(codeInvalidRequest, "%s is lossless and takes no bitrate", profile.Name)
+		}
+		if !audioQualityPattern.MatchString(p.Bitrate) {
+			return newAPIError(codeInvalidRequest, "bitrate must be such as 64k or 192k")
+		}
+	}
+	if p.SampleRate != 0 {
+		rate := strconv.Itoa(p.SampleRate)
+		if p.SampleRate < 8000 || p.SampleRate > 192000 {
+			return newAPIError(codeInvalidRequest, "sample_rate must be between 8000 and 192000")
+		}
+		if profile.SampleRates != nil && !slices.Contains(profile.SampleRates, rate) {
+			return newAPIErrorf(codeInvalidRequest, "%s supports sample rates %v", profile.Name, profile.SampleRates)
+		}
+	}
+	if p.Channels < 0 || p.Channels > 2 {
+		return newAPIError(codeInvalidRequest, "channels must be 1 (mono) or 2 (stereo)")
+	}
+	if p.Loudness != nil {
+		if *p.Loudness < -70 || *p.Loudness > -5 {
+			return newAPIError(codeInvalidRequest, "loudness must be between -70 and -5")
+		}
+		if !filterAvailable("loudnorm") {
+			return newAPIError(codeInvalidRequest, "loudness needs the loudnorm filter, which this FFmpeg build lacks")
+		}
+	}
+	return nil
+}
+
+// profile returns the transcoding profile the preset describes
+func (p Preset) profile() (audioProfile, *apiError) {
+	profile, ok := lookupProfile(p.Format)
+	if !ok {
+		return audioProfile{}, newAPIErrorf(codeUnsupportedFormat, "Preset %s uses format %s, which is not available. Supported: %s", p.Name, p.Format, profileList())
+	}
+	if p.Bitrate != "" {
+		profile.Bitrate = p.Bitrate
+	}
+	if p.SampleRate != 0 {
+		profile.SampleRate = strconv.Itoa(p.SampleRate)
+	}
+	if p.Channels != 0 {
+		profile.Channels = strconv.Itoa(p.Channels)
+	}
+	if p.Loudness != nil {
+		profile.Filter = fmt.Sprintf("loudnorm=I=%g:TP=-1.5:LRA=11", *p.Loudness)
+	}
+	return profile, nil
+}
+
+// get returns a preset by name
+func (r *presetRegistry) get(name string) (Preset, bool) {
+	if p, ok := r.builtin[name]; ok {
+		return p, true
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.custom[name]
+	return p, ok
+}
+
+// list returns every preset ordered by name
+func (r *presetRegistry) list() []Preset {
+	r.mu.RLock()
+	all := make([]Preset, 0, len(r.builtin)+len(r.custom))
+	for _, p := range r.custom {
+		all = append(all, p)
+	}
+	r.mu.RUnlock()
+	for _, p := range r.builtin {
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// put saves a custom preset. With create set an existing preset is refused;
+// otherwise only an existing one is replaced.
+func (r *presetRegistry) put(p Preset, create bool) *apiError {
+	if _, ok := r.builtin[p.Name]; ok {
+		return newAPIErrorf(codeReadOnly, "%s is a built-in preset and cannot be changed", p.Name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, exists := r.custom[p.Name]
+	switch {
+	case create && exists:
+		return newAPIErrorf(codeAlreadyExists, "Preset %s already exists; use PUT to replace it", p.Name)
+	case !create && !exists:
+		return newAPIError(codeNotFound, "Preset not found")
+	}
+	p.BuiltIn = false
+	now := time.Now().UTC()
+	p.UpdatedAt = &now
+	previous, hadPrevious := r.custom[p.Name]
+	r.custom[p.Name] = p
+	if err := r.saveLocked(); err != nil {
+		if hadPrevious {
+			r.custom[p.Name] = previous
+		} else {
+			delete(r.custom, p.Name)
+		}
+		return newAPIErrorf(codeInternal, "Failed to save presets: %v", err)
+	}
+	return nil
+}
+
+// remove deletes a custom preset
+func (r *presetRegistry) remove(name string) *apiError {
+	if _, ok := r.builtin[name]; ok {
+		return newAPIErrorf(codeReadOnly, "%s is a built-in preset and cannot be deleted", name)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.custom[name]
+	if !ok {
+		return newAPIError(codeNotFound, "Preset not found")
+	}
+	delete(r.custom, name)
+	if err := r.saveLocked(); err != nil {
+		r.custom[name] = p
+		return newAPIErrorf(codeInternal, "Failed to save presets: %v", err)
+	}
+	return nil
+}
+
+// saveLocked writes the custom presets atomically
+func (r *presetRegistry) saveLocked() error {
+	saved := make([]Preset, 0, len(r.custom))
+	for _, p := range r.custom {
+		saved = append(saved, p)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(r.path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(r.path+".tmp", r.path)
+}
+
+// outputProfile returns the profile a request asks for: that of its preset
+// when one is named, otherwise that of its format
+func outputProfile(format, preset string) (audioProfile, *apiError) {
+	if preset != "" {
+		p, ok := presets.get(preset)
+		if !ok {
+			return audioProfile{}, newAPIErrorf(codeInvalidRequest, "Unknown preset: %s", preset)
+		}
+		return p.profile()
+	}
+	profile, ok := lookupProfile(format)
+	if !ok {
+		return audioProfile{}, newAPIErrorf(codeUnsupportedFormat, "Unsupported output format: %s. Supported: %s", format, profileList())
+	}
+	return profile, nil
+}
+
+// presetsHandler serves GET and POST /v1/presets
+func presetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, presetList{Presets: presets.list()})
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	var p Preset
+	if apiErr := decodeJSON(r, &p); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if apiErr := p.validate(); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if apiErr := presets.put(p, true); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	slog.InfoContext(r.Context(), "Preset created", "preset", p.Name, "format", p.Format)
+	saved, _ := presets.get(p.Name)
+	w.Header().Set("Location", apiVersionPrefix+"/presets/"+p.Name)
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+// presetHandler serves GET, PUT and DELETE /v1/presets/{name}
+func presetHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	switch r.Method {
+	case http.MethodGet:
+		p, ok := presets.get(name)
+		if !ok {
+			writeError(w, r, newAPIError(codeNotFound, "Preset not found"))
+			return
+		}
+		writeJSON(w, http.StatusOK, p)
+		return
+	case http.MethodDelete:
+		if !adminAuthorized(w, r) {
+			return
+		}
+		if apiErr := presets.remove(name); apiErr != nil {
+			writeError(w, r, apiErr)
+			return
+		}
+		slog.InfoContext(r.Context(), "Preset deleted", "preset", name)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !adminAuthorized(w, r) {
+		return
+	}
+	var p Preset
+	if apiErr := decodeJSON(r, &p); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if p.Name == "" {
+		p.Name = name
+	}
+	if p.Name != name {
+		writeError(w, r, newAPIError(codeInvalidRequest, "name does not match the preset in the path"))
+		return
+	}
+	if apiErr := p.validate(); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if apiErr := presets.put(p, false); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	slog.InfoContext(r.Context(), "Preset updated", "preset", p.Name, "format", p.Format)
+	saved, _ := presets.get(p.Name)
+	writeJSON(w, http.StatusOK, saved)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// setupPresets gives the test a preset registry saving under a fresh
+// processing directory
+func setupPresets(t *testing.T) {
+	t.Helper()
+	setupTestEnv(t)
+	saved := presets
+	presets = newPresetRegistryFromConfig()
+	t.Cleanup(func() { presets = saved })
+}
+
+func TestPresetsSurviveReload(t *testing.T) {
+	setupPresets(t)
+
+	if apiErr := presets.put(Preset{Name: "voice", Format: "mp3", Bitrate: "64k"}, true); apiErr != nil {
+		t.Fatalf("create: %v", apiErr)
+	}
+	if apiErr := presets.put(Preset{Name: "voice", Format: "mp3"}, true); apiErr == nil || apiErr.Code != codeAlreadyExists {
+		t.Fatalf("second create = %v, want %s", apiErr, codeAlreadyExists)
+	}
+	if apiErr := presets.put(Preset{Name: "missing", Format: "mp3"}, false); apiErr == nil || apiErr.Code != codeNotFound {
+		t.Fatalf("replace of a missing preset = %v, want %s", apiErr, codeNotFound)
+	}
+	if apiErr := presets.put(Preset{Name: "voice", Format: "aac", Bitrate: "96k"}, false); apiErr != nil {
+		t.Fatalf("replace: %v", apiErr)
+	}
+	if apiErr := presets.put(Preset{Name: "archive", Format: "flac"}, true); apiErr != nil {
+		t.Fatalf("create: %v", apiErr)
+	}
+	if apiErr := presets.remove("archive"); apiErr != nil {
+		t.Fatalf("remove: %v", apiErr)
+	}
+
+	if _, err := os.Stat(presets.path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+	data, err := os.ReadFile(presets.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var onDisk []Preset
+	if err := json.Unmarshal(data, &onDisk); err != nil {
+		t.Fatalf("saved presets are not valid JSON: %v", err)
+	}
+	if len(onDisk) != 1 || onDisk[0].Name != "voice" {
+		t.Fatalf("saved presets = %+v, want only voice", onDisk)
+	}
+
+	presets = newPresetRegistryFromConfig()
+	p, ok := presets.get("voice")
+	if !ok || p.Format != "aac" || p.Bitrate != "96k" || p.BuiltIn || p.UpdatedAt == nil {
+		t.Errorf("voice after reload = %+v, %v", p, ok)
+	}
+	if _, ok := presets.get("archive"); ok {
+		t.Error("deleted preset came back after reload")
+	}
+	if _, ok := presets.get("mp3"); !ok {
+		t.Error("built-in mp3 preset missing after reload")
+	}
+}
+
+func TestPresetSaveFailureRollsBack(t *testing.T) {
+	setupPresets(t)
+
+	if apiErr := presets.put(Preset{Name: "voice", Format: "mp3", Bitrate: "64k"}, true); apiErr != nil {
+		t.Fatalf("create: %v", apiErr)
+	}
+	// a directory where the temporary file goes makes every save fail
+	if err := os.Mkdir(presets.path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if apiErr := presets.put(Preset{Name: "voice", Format: "aac"}, false); apiErr == nil || apiErr.Code != codeInternal {
+		t.Fatalf("replace = %v, want %s", apiErr, codeInternal)
+	}
+	if p, _ := presets.get("voice"); p.Format != "mp3" || p.Bitrate != "64k" {
+		t.Errorf("failed replace left %+v, want the previous preset", p)
+	}
+	if apiErr := presets.put(Preset{Name: "music", Format: "flac"}, true); apiErr == nil {
+		t.Fatal("create succeeded although the save failed")
+	}
+	if _, ok := presets.get("music"); ok {
+		t.Error("failed create left the preset behind")
+	}
+	if apiErr := presets.remove("voice"); apiErr == nil {
+		t.Fatal("remove succeeded although the save failed")
+	}
+	if _, ok := presets.get("voice"); !ok {
+		t.Error("failed remove dropped the preset")
+	}
+
+	// the file on disk still holds the last successful save
+	reloaded := newPresetRegistryFromConfig()
+	if p, ok := reloaded.get("voice"); !ok || p.Format != "mp3" {
+		t.Errorf("voice on disk = %+v, %v, want the mp3 preset", p, ok)
+	}
+}
+
+func TestBuiltinPresetsAreReadOnly(t *testing.T) {
+	setupPresets(t)
+
+	for _, create := range []bool{true, false} {
+		if apiErr := presets.put(Preset{Name: "mp3", Format: "mp3", Bitrate: "64k"}, create); apiErr == nil || apiErr.Code != codeReadOnly {
+			t.Errorf("put(create=%v) of mp3 = %v, want %s", create, apiErr, codeReadOnly)
+		}
+	}
+	if apiErr := presets.remove("wav"); apiErr == nil || apiErr.Code != codeReadOnly {
+		t.Errorf("remove of wav = %v, want %s", apiErr, codeReadOnly)
+	}
+	if p, _ := presets.get("mp3"); !p.BuiltIn || p.Bitrate != audioProfiles["mp3"].Bitrate {
+		t.Errorf("mp3 = %+v, want the unchanged built-in", p)
+	}
+
+	// a built-in name in the saved file is ignored on load
+	if err := os.MkdirAll(filepath.Dir(presets.path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(presets.path, []byte(`[{"name":"mp3","format":"mp3","bitrate":"32k"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newPresetRegistryFromConfig()
+	if p, _ := reloaded.get("mp3"); !p.BuiltIn || p.Bitrate == "32k" {
+		t.Errorf("mp3 after loading a clashing file = %+v", p)
+	}
+}
+
+func TestPresetValidateSampleRate(t *testing.T) {
+	tests := []struct {
+		format string
+		rate   int
+		ok     bool
+	}{
+		{"mp3", 44100, true},
+		{"mp3", 22050, true},
+		{"opus", 48000, true},
+		{"opus", 16000, true},
+		{"opus", 44100, false},
+		{"opus", 22050, false},
+		{"mp3", 4000, false},
+		{"mp3", 96000, false},
+		{"mp3", 44000, false},
+		{"aac", 48000, true},
+		{"aac", 96000, true},
+		{"aac", 192000, false},
+		{"aac", 50000, false},
+		{"wav", 96000, true},
+		{"flac", 384000, false},
+	}
+	for _, tt := range tests {
+		p := Preset{Name: "p", Format: tt.format, SampleRate: tt.rate}
+		apiErr := p.validate()
+		if (apiErr == nil) != tt.ok {
+			t.Errorf("%s at %d Hz: validate() = %v, want ok=%v", tt.format, tt.rate, apiErr, tt.ok)
+		}
+		if apiErr != nil && apiErr.Code != codeInvalidRequest {
+			t.Errorf("%s at %d Hz: code = %s, want %s", tt.format, tt.rate, apiErr.Code, codeInvalidRequest)
+		}
+	}
+}
+
+func TestCreatePresetRefusesUnsupportedSampleRate(t *testing.T) {
+	setupPresets(t)
+	for _, body := range []string{
+		`{"name":"hires-mp3","format":"mp3","sample_rate":96000}`,
+		`{"name":"hires-aac","format":"aac","sample_rate":192000}`,
+	} {
+		rec := httptest.NewRecorder()
+		presetsHandler(rec, httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/presets", strings.NewReader(body)))
+		var resp FFmpegResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		if rec.Code != http.StatusBadRequest || resp.Code != codeInvalidRequest || !strings.Contains(resp.Error, "supports sample rates") {
+			t.Errorf("%s answered %d: %s", body, rec.Code, rec.Body.String())
+		}
+	}
+	if custom := len(presets.list()) - len(presets.builtin); custom != 0 {
+		t.Errorf("%d presets saved with unsupported sample rates", custom)
+	}
+}
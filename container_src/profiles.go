@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// audioProfile describes how one output format is produced by FFmpeg
+type audioProfile struct {
+	Name        string
+	Extension   string
+	Codec       string
+	ContentType string
+	Bitrate     string // default bitrate, empty for lossless codecs
+	SampleRate  string
+	SampleRates []string // rates the encoder accepts, nil for any
+
+	// Set by presets; empty keeps the source's channels and applies no filter
+	Channels string
+	Filter   string
+}
+
+// audioProfiles is the registry of supported output formats
+var audioProfiles = map[string]audioProfile{
+	"mp3": {
+		Name:        "mp3",
+		Extension:   "mp3",
+		Codec:       "mp3",
+		ContentType: "audio/mpeg",
+		Bitrate:     "192k",
+		SampleRate:  "44100",
+		SampleRates: []string{"8000", "11025", "12000", "16000", "22050", "24000", "32000", "44100", "48000"},
+	},
+	"wav": {
+		Name:        "wav",
+		Extension:   "wav",
+		Codec:       "pcm_s16le",
+		ContentType: "audio/wav",
+		SampleRate:  "44100",
+	},
+	"aac": {
+		Name:        "aac",
+		Extension:   "aac",
+		Codec:       "aac",
+		ContentType: "audio/aac",
+		Bitrate:     "192k",
+		SampleRate:  "44100",
+		SampleRates: []string{"7350", "8000", "11025", "12000", "16000", "22050", "24000", "32000", "44100", "48000", "64000", "88200", "96000"},
+	},
+	"flac": {
+		Name:        "flac",
+		Extension:   "flac",
+		Codec:       "flac",
+		ContentType: "audio/flac",
+		SampleRate:  "44100",
+	},
+	"opus": {
+		Name:        "opus",
+		Extension:   "opus",
+		Codec:       "libopus",
+		ContentType: "audio/ogg",
+		Bitrate:     "96k",
+		SampleRate:  "48000",
+		SampleRates: []string{"8000", "12000", "16000", "24000", "48000"},
+	},
+}
+
+var (
+	disabledMu       sync.RWMutex
+	disabledProfiles = map[string]string{} // profile name -> reason
+)
+
+// disableProfile removes a profile from service, e.g. because the FFmpeg
+// build lacks its encoder
+func disableProfile(name, reason string) {
+	disabledMu.Lock()
+	defer disabledMu.Unlock()
+	disabledProfiles[name] = reason
+}
+
+// profileDisabledReason returns why a profile is disabled, or "" if it is enabled
+func profileDisabledReason(name string) string {
+	disabledMu.RLock()
+	defer disabledMu.RUnlock()
+	return disabledProfiles[name]
+}
+
+// lookupProfile returns the profile for a format name, defaulting to mp3.
+// Disabled profiles are reported as unsupported.
+func lookupProfile(format string) (audioProfile, bool) {
+	if format == "" {
+		format = "mp3"
+	}
+	format = strings.ToLower(format)
+	p, ok := audioProfiles[format]
+	if !ok || profileDisabledReason(format) != "" {
+		return audioProfile{}, false
+	}
+	return p, true
+}
+
+// profileNames returns the enabled format names in a stable order
+func profileNames() []string {
+	var names []string
+	for _, name := range allProfileNames() {
+		if profileDisabledReason(name) == "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// allProfileNames returns every registered format name, enabled or not
+func allProfileNames() []string {
+	names := make([]string, 0, len(audioProfiles))
+	for name := range audioProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// profileList returns the supported format names for error messages
+func profileList() string {
+	return strings.Join(profileNames(), ", ")
+}
+
+// bitrate returns the effective bitrate for a requested quality; lossless
+// profiles ignore the quality entirely
+func (p audioProfile) bitrate(quality string) string {
+	if p.Bitrate == "" {
+		return ""
+	}
+	if quality == "" {
+		return p.Bitrate
+	}
+	return quality
+}
+
+// ffmpegArgs returns the FFmpeg arguments that extract audio from input into output
+func (p audioProfile) ffmpegArgs(input, output, quality string) []string {
+	args := []string{"-i", input, "-vn"}
+	if p.Filter != "" {
+		args = append(args, "-af", p.Filter)
+	}
+	args = append(args, "-acodec", p.Codec)
+	if b := p.bitrate(quality); b != "" {
+		args = append(args, "-ab", b)
+	}
+	if p.Channels != "" {
+		args = append(args, "-ac", p.Channels)
+	}
+	return append(args, "-ar", p.SampleRate, "-y", output)
+}
+
+// runFFmpeg runs FFmpeg to produce this profile, returning its combined
+// output and recording its run time
+func (p audioProfile) runFFmpeg(ctx context.Context, input, output, quality string) ([]byte, error) {
+	if span := spanFromContext(ctx); span != nil {
+		span.setAttr("ffmpeg.profile", p.Name)
+	}
+	return runFFmpeg(ctx, p.Name, p.ffmpegArgs(input, output, quality))
+}
+
+// runFFmpeg runs FFmpeg with args, recording its run time under label. When
+// ctx ends FFmpeg gets SIGTERM so it can exit cleanly, and SIGKILL if it is
+// still running after the kill grace.
+func runFFmpeg(ctx context.Context, label string, args []string) ([]byte, error) {
+	ffmpegActive.inc()
+	defer ffmpegActive.dec()
+
+	start := time.Now()
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = cfg.FFmpeg.KillGrace.std()
+	out, err := cmd.CombinedOutput()
+
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	ffmpegDuration.observe(time.Since(start).Seconds(), label, outcome)
+	return out, err
+}
+
+// normalizedParams returns a canonical description of the transcoding
+// parameters, used to key cached results
+func (p audioProfile) normalizedParams(quality string) string {
+	params := []string{"codec=" + p.Codec, "bitrate=" + p.bitrate(quality), "ar=" + p.SampleRate, "ext=" + p.Extension}
+	// Only presets set these, so plain requests keep their existing keys
+	if p.Channels != "" {
+		params = append(params, "ac="+p.Channels)
+	}
+	if p.Filter != "" {
+		params = append(params, "af="+p.Filter)
+	}
+	return strings.Join(params, ";")
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RecipeRequest is the JSON body of /v1/recipe: a source and the steps that
+// turn it into one or more outputs
+type RecipeRequest struct {
+	VideoURL    string        `json:"video_url" doc:"Direct HTTP/HTTPS URL to the video; required unless source is set"`
+	Source      *ObjectSource `json:"source,omitempty" doc:"Object in S3-compatible storage to fetch instead of video_url"`
+	InstanceID  string        `json:"instance_id" doc:"Caller-chosen identifier for the job; jobs are scheduled fairly across instance IDs"`
+	Priority    string        `json:"priority,omitempty" doc:"Scheduling class: interactive (default) or batch"`
+	CallbackURL string        `json:"callback_url,omitempty" doc:"URL the final response is POSTed to, signed in the X-Webhook-Signature header"`
+	Steps       []RecipeStep  `json:"steps" openapi:"required" doc:"Steps run in order; each reads the source or the output of an earlier step"`
+}
+
+// RecipeStep is one operation of a recipe. Only the fields of its op may be set.
+type RecipeStep struct {
+	Name  string `json:"name" openapi:"required" doc:"Unique step name, which later steps use to read its output"`
+	Op    string `json:"op" openapi:"required" doc:"probe, trim, loudnorm, encode or waveform"`
+	Input string `json:"input,omitempty" doc:"Name of the earlier step whose output this step reads, or source (default)"`
+
+	Start    string `json:"start,omitempty" doc:"trim: offset to start at, in seconds or HH:MM:SS[.ms]"`
+	Duration string `json:"duration,omitempty" doc:"trim: length to keep, in seconds or HH:MM:SS[.ms]"`
+
+	Loudness      *float64 `json:"loudness,omitempty" doc:"loudnorm: integrated loudness target in LUFS, -70 to -5 (default -16)"`
+	TruePeak      *float64 `json:"true_peak,omitempty" doc:"loudnorm: maximum true peak in dBTP, -9 to 0 (default -1.5)"`
+	LoudnessRange *float64 `json:"loudness_range,omitempty" doc:"loudnorm: loudness range target in LU, 1 to 50 (default 11)"`
+
+	Format  string `json:"format,omitempty" doc:"encode: output format, as audio_format (default mp3)"`
+	Quality string `json:"quality,omitempty" doc:"encode: bitrate for lossy formats, as audio_quality"`
+
+	Width  int    `json:"width,omitempty" doc:"waveform: image width in pixels, up to 4096 (default 1200)"`
+	Height int    `json:"height,omitempty" doc:"waveform: image height in pixels, up to 1024 (default 240)"`
+	Color  string `json:"color,omitempty" doc:"waveform: colour of the wave as #rrggbb (default #1e88e5)"`
+}
+
+// RecipeResponse is the result of a recipe that ran to completion. Failures
+// are reported as an FFmpegResponse naming the step that failed.
+type RecipeResponse struct {
+	Success     bool               `json:"success" openapi:"required"`
+	Message     string             `json:"message" openapi:"required"`
+	Steps       []recipeStepResult `json:"steps"`
+	Artifacts   []recipeArtifact   `json:"artifacts" doc:"Every output the recipe published, in step order"`
+	VideoSource string             `json:"video_source,omitempty"`
+	FileSize    string             `json:"file_size,omitempty"`
+}
+
+// recipeStepResult reports one finished step
+type recipeStepResult struct {
+	Name       string     `json:"name"`
+	Op         string     `json:"op"`
+	DurationMs int64      `json:"duration_ms"`
+	Probe      *mediaInfo `json:"probe,omitempty"`
+}
+
+// recipeArtifact is a published output of an encode or waveform step
+type recipeArtifact struct {
+	Step        string `json:"step"`
+	FileName    string `json:"file_name"`
+	DownloadURL string `json:"download_url"`
+	ContentType string `json:"content_type"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// recipeOp describes what an operation reads, produces and accepts
+type recipeOp struct {
+	media    bool     // produces audio that later steps can read
+	artifact bool     // its output is published for download
+	filter   string   // FFmpeg filter it depends on
+	params   []string // json names of the step fields it accepts
+}
+
+var recipeOps = map[string]recipeOp{
+	"probe":    {},
+	"trim":     {media: true, params: []string{"start", "duration"}},
+	"loudnorm": {media: true, filter: "loudnorm", params: []string{"loudness", "true_peak", "loudness_range"}},
+	"encode":   {media: true, artifact: true, params: []string{"format", "quality"}},
+	"waveform": {artifact: true, filter: "showwavespic", params: []string{"width", "height", "color"}},
+}
+
+// waveformProfile lets a waveform image be published like an audio output
+var waveformProfile = audioProfile{Name: "waveform", Extension: "png", ContentType: "image/png"}
+
+var (
+	stepNamePattern  = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+	timestampPattern = regexp.MustCompile(`^([0-9]+(\.[0-9]+)?|[0-9]{1,2}:[0-5][0-9]:[0-5][0-9](\.[0-9]+)?)$`)
+	colorPattern     = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+// validate checks a whole recipe before anything is downloaded: every step's
+// parameters, and that each step reads the source or an earlier step's audio.
+// Defaults are filled in on the way.
+func (req *RecipeRequest) validate() *apiError {
+	if apiErr := validateSource(req.VideoURL, req.Source); apiErr != nil {
+		return apiErr
+	}
+	if req.InstanceID != "" && !instanceIDPattern.MatchString(req.InstanceID) {
+		return newAPIError(codeInvalidRequest, "instance_id may only contain letters, digits, '.', '_' and '-'")
+	}
+	if _, ok := parsePriority(req.Priority); !ok {
+		return newAPIError(codeInvalidRequest, "priority must be interactive or batch")
+	}
+	if len(req.Steps) == 0 || len(req.Steps) > cfg.Limits.MaxRecipeSteps {
+		return newAPIErrorf(codeInvalidRequest, "steps must hold between 1 and %d steps", cfg.Limits.MaxRecipeSteps)
+	}
+
+	outputs := map[string]recipeOp{"source": {media: true}}
+	published := false
+	for i := range req.Steps {
+		step := &req.Steps[i]
+		if apiErr := step.validate(outputs); apiErr != nil {
+			return newAPIErrorf(apiErr.Code, "steps[%d] (%s): %s", i, step.Name, apiErr.Message)
+		}
+		outputs[step.Name] = recipeOps[step.Op]
+		published = published || recipeOps[step.Op].artifact
+	}
+	if !published {
+		return newAPIError(codeInvalidRequest, "steps must include an encode or waveform step, or the recipe produces nothing")
+	}
+	return validateCallbackURL(req.CallbackURL)
+}
+
+// validate checks one step against the outputs of the steps before it
+func (s *RecipeStep) validate(outputs map[string]recipeOp) *apiError {
+	if !stepNamePattern.MatchString(s.Name) {
+		return newAPIError(codeInvalidRequest, "name must be 1-32 lowercase letters, digits, '_' or '-'")
+	}
+	if _, taken := outputs[s.Name]; taken {
+		return newAPIError(codeInvalidRequest, "name is already used by the source or an earlier step")
+	}
+	op, ok := recipeOps[s.Op]
+	if !ok {
+		return newAPIErrorf(codeInvalidRequest, "unknown op %q; supported: probe, trim, loudnorm, encode, waveform", s.Op)
+	}
+	if s.Input == "" {
+		s.Input = "source"
+	}
+	if in, ok := outputs[s.Input]; !ok {
+		return newAPIErrorf(codeInvalidRequest, "input %q is not the source or an earlier step", s.Input)
+	} else if !in.media {
+		return newAPIErrorf(codeInvalidRequest, "input %q produces no audio to read", s.Input)
+	}
+	for _, name := range s.setParams() {
+		if !slices.Contains(op.params, name) {
+			return newAPIErrorf(codeInvalidRequest, "%s does not apply to %s", name, s.Op)
+		}
+	}
+	if op.filter != "" && !filterAvailable(op.filter) {
+		return newAPIErrorf(codeInvalidRequest, "%s needs the %s filter, which this FFmpeg build lacks", s.Op, op.filter)
+	}
+
+	switch s.Op {
+	case "trim":
+		if s.Start == "" && s.Duration == "" {
+			return newAPIError(codeInvalidRequest, "trim needs start, duration or both")
+		}
+		for _, t := range []string{s.Start, s.Duration} {
+			if t != "" && !timestampPattern.MatchString(t) {
+				return newAPIErrorf(codeInvalidRequest, "%q is not a time in seconds or HH:MM:SS[.ms]", t)
+			}
+		}
+	case "loudnorm":
+		for _, p := range []struct {
+			v        **float64
+			name     string
+			def      float64
+			min, max float64
+		}{
+			{&s.Loudness, "loudness", -16, -70, -5},
+			{&s.TruePeak, "true_peak", -1.5, -9, 0},
+			{&s.LoudnessRange, "loudness_range", 11, 1, 50},
+		} {
+			if *p.v == nil {
+				def := p.def
+				*p.v = &def
+			}
+			if v := **p.v; v < p.min || v > p.max {
+				return newAPIErrorf(codeInvalidRequest, "%s must be between %g and %g", p.name, p.min, p.max)
+			}
+		}
+	case "encode":
+		profile, ok := lookupProfile(s.Format)
+		if !ok {
+			return newAPIErrorf(codeUnsupportedFormat, "Unsupported output format: %s. Supported: %s", s.Format, profileList())
+		}
+		s.Format = profile.Name
+		if s.Quality != "" && !audioQualityPattern.MatchString(s.Quality) {
+			return newAPIError(codeInvalidRequest, "quality must be a bitrate such as 128k or 192k")
+		}
+	case "waveform":
+		if s.Width == 0 {
+			s.Width = 1200
+		}
+		if s.Height == 0 {
+			s.Height = 240
+		}
+		if s.Color == "" {
+			s.Color = "#1e88e5"
+		}
+		if s.Width < 1 || s.Width > 4096 || s.Height < 1 || s.Height > 1024 {
+			return newAPIError(codeInvalidRequest, "width must be 1-4096 and height 1-1024 pixels")
+		}
+		if !colorPattern.MatchString(s.Color) {
+			return newAPIError(codeInvalidRequest, "color must be #rrggbb")
+		}
+	}
+	return nil
+}
+
+// setParams returns the json names of the op-specific fields that are set
+func (s *RecipeStep) setParams() []string {
+	var set []string
+	for _, p := range []struct {
+		name  string
+		isSet bool
+	}{
+		{"start", s.Start != ""}, {"duration", s.Duration != ""},
+		{"loudness", s.Loudness != nil}, {"true_peak", s.TruePeak != nil}, {"loudness_range", s.LoudnessRange != nil},
+		{"format", s.Format != ""}, {"quality", s.Quality != ""},
+		{"width", s.Width != 0}, {"height", s.Height != 0}, {"color", s.Color != ""},
+	} {
+		if p.isSet {
+			set = append(set, p.name)
+		}
+	}
+	return set
+}
+
+// profile returns how the step's output is written and published
+func (s *RecipeStep) profile() audioProfile {
+	switch s.Op {
+	case "encode":
+		p, _ := lookupProfile(s.Format) // validated
+		return p
+	case "waveform":
+		return waveformProfile
+	}
+	return audioProfile{Name: s.Op, Extension: "wav", ContentType: "audio/wav"} // intermediate PCM
+}
+
+// ffmpegArgs returns the FFmpeg arguments that run the step on input.
+// Intermediate audio is kept as 16-bit PCM so only the encode steps are lossy.
+func (s *RecipeStep) ffmpegArgs(input, output string) []string {
+	switch s.Op {
+	case "trim":
+		var args []string
+		if s.Start != "" {
+			args = append(args, "-ss", s.Start)
+		}
+		args = append(args, "-i", input)
+		if s.Duration != "" {
+			args = append(args, "-t", s.Duration)
+		}
+		return append(args, "-vn", "-acodec", "pcm_s16le", "-y", output)
+	case "loudnorm":
+		// loudnorm resamples to 192 kHz internally, so set the rate back
+		filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", *s.Loudness, *s.TruePeak, *s.LoudnessRange)
+		return []string{"-i", input, "-vn", "-af", filter, "-acodec", "pcm_s16le", "-ar", "48000", "-y", output}
+	case "encode":
+		return s.profile().ffmpegArgs(input, output, s.Quality)
+	case "waveform":
+		filter := fmt.Sprintf("showwavespic=s=%dx%d:colors=0x%s", s.Width, s.Height, s.Color[1:])
+		return []string{"-i", input, "-filter_complex", filter, "-frames:v", "1", "-y", output}
+	}
+	return nil
+}
+
+// mediaInfo is what ffprobe reports about a file
+type mediaInfo struct {
+	FormatName string        `json:"format_name,omitempty"`
+	Duration   float64       `json:"duration_seconds,omitempty"`
+	BitRate    int64         `json:"bit_rate,omitempty"`
+	Size       int64         `json:"size,omitempty"`
+	Streams    []mediaStream `json:"streams"`
+}
+
+// mediaStream is one stream of a probed file
+type mediaStream struct {
+	Index      int    `json:"index"`
+	CodecType  string `json:"codec_type"`
+	CodecName  string `json:"codec_name,omitempty"`
+	SampleRate string `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+}
+
+// probeMedia runs ffprobe on path
+func probeMedia(ctx context.Context, path string) (*mediaInfo, *apiError) {
+	ctx, cancel := context.WithTimeout(ctx, cfg.FFmpeg.ExtractTimeout.std())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", "-show_streams", path)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, &apiError{Code: codeInvalidInputMedia, Message: fmt.Sprintf("ffprobe could not read the input: %v", err), Details: stderr.String()}
+	}
+
+	var probed struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+			BitRate    string `json:"bit_rate"`
+			Size       string `json:"size"`
+		} `json:"format"`
+		Streams []mediaStream `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probed); err != nil {
+		return nil, newAPIErrorf(codeInternal, "Unreadable ffprobe output: %v", err)
+	}
+	info := &mediaInfo{FormatName: probed.Format.FormatName, Streams: probed.Streams}
+	info.Duration, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	info.BitRate, _ = strconv.ParseInt(probed.Format.BitRate, 10, 64)
+	info.Size, _ = strconv.ParseInt(probed.Format.Size, 10, 64)
+	return info, nil
+}
+
+// recipeHandler serves POST /v1/recipe. The source is downloaded once and
+// the steps run in order, each FFmpeg step taking its own worker slot. Every
+// step reports its progress, and the response lists each published output.
+func recipeHandler(w http.ResponseWriter, r *http.Request) {
+	var req RecipeRequest
+	if apiErr := decodeJSON(r, &req); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+	if apiErr := req.validate(); apiErr != nil {
+		writeError(w, r, apiErr)
+		return
+	}
+
+	instanceId := os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID")
+	if instanceId == "" {
+		instanceId = "default"
+	}
+	logInstance := req.InstanceID
+	if logInstance == "" {
+		logInstance = instanceId
+	}
+	ctx := withLogAttrs(startStage(r.Context(), "probe"), slog.String("instance_id", logInstance))
+	class, _ := parsePriority(req.Priority) // validated above
+	ticket := jobTicket{tenant: logInstance, class: class}
+	journal.describe(ctx, jobParams{Tenant: logInstance, Priority: class.String(), VideoURL: req.VideoURL, Source: req.Source})
+	requestCallback(w, req.CallbackURL)
+
+	if refuseIfNoSpace(ctx, w, r, 0) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	progressCallback := logProgress(ctx)
+
+	// Every file the recipe writes shares this prefix; intermediates are
+	// deleted when the job ends, published outputs once their TTL expires
+	prefix := filepath.Join(cfg.Storage.ProcessingDir, fmt.Sprintf("recipe_%s_%d_", instanceId, time.Now().UnixNano()))
+	videoFile := prefix + "source.tmp"
+	tempFiles.trackInput(videoFile)
+	defer tempFiles.release(videoFile)
+
+	release, ok := waitForSlot(ctx, w, r, downloadPool, ticket)
+	if !ok {
+		return
+	}
+	ctx = startStage(ctx, "download")
+	videoSource, _, err := downloadSource(ctx, req.VideoURL, req.Source, videoFile, progressCallback)
+	release()
+	if err != nil {
+		writeError(w, r, asAPIError(err, codeDownloadFailed))
+		return
+	}
+	var fileSize int64
+	if info, err := os.Stat(videoFile); err == nil {
+		fileSize = info.Size()
+	}
+	inputSize.observe(float64(fileSize), "recipe")
+
+	resp := RecipeResponse{
+		Success:     true,
+		VideoSource: videoSource,
+		FileSize:    fmt.Sprintf("%.2f MB", float64(fileSize)/(1024*1024)),
+	}
+	files := map[string]string{"source": videoFile}
+	for i := range req.Steps {
+		step := &req.Steps[i]
+		stepCtx := withLogAttrs(startStage(ctx, step.Name), slog.String("op", step.Op))
+		// The download reports up to 60%; the steps share the rest
+		progressCallback(step.Name, "Starting "+step.Op, 60+40*float64(i)/float64(len(req.Steps)))
+
+		start := time.Now()
+		result := recipeStepResult{Name: step.Name, Op: step.Op}
+		if step.Op == "probe" {
+			info, apiErr := probeMedia(stepCtx, files[step.Input])
+			if apiErr != nil {
+				writeError(w, r.WithContext(ctx), stepError(i, step, apiErr))
+				return
+			}
+			result.Probe = info
+		} else {
+			output := prefix + step.Name + "." + step.profile().Extension
+			if recipeOps[step.Op].artifact {
+				tempFiles.trackPending(output)
+			} else {
+				tempFiles.trackInput(output)
+				defer tempFiles.release(output)
+			}
+			if !runRecipeStep(stepCtx, w, r, ticket, i, step, files[step.Input], output) {
+				return
+			}
+			files[step.Name] = output
+			if recipeOps[step.Op].artifact {
+				artifact := recipeArtifact{Step: step.Name, FileName: filepath.Base(output), ContentType: step.profile().ContentType,
+					DownloadURL: publishOutput(output, step.profile())}
+				if info, err := os.Stat(output); err == nil {
+					artifact.Bytes = info.Size()
+					outputSize.observe(float64(info.Size()), step.profile().Name)
+				}
+				journal.addArtifact(jobIDFrom(ctx), jobArtifact{FileName: artifact.FileName, DownloadURL: artifact.DownloadURL})
+				resp.Artifacts = append(resp.Artifacts, artifact)
+			}
+		}
+		result.DurationMs = time.Since(start).Milliseconds()
+		resp.Steps = append(resp.Steps, result)
+		progressCallback(step.Name, step.Op+" finished", 60+40*float64(i+1)/float64(len(req.Steps)))
+	}
+
+	resp.Message = fmt.Sprintf("Recipe finished: %d steps, %d outputs", len(resp.Steps), len(resp.Artifacts))
+	slog.InfoContext(ctx, "Recipe completed", "steps", len(resp.Steps), "artifacts", len(resp.Artifacts))
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// runRecipeStep runs one FFmpeg step once a worker slot is free, writing the
+// error response and returning false if it fails
+func runRecipeStep(ctx context.Context, w http.ResponseWriter, r *http.Request, ticket jobTicket, index int, step *RecipeStep, input, output string) bool {
+	release, ok := waitForSlot(ctx, w, r, ffmpegPool, ticket)
+	if !ok {
+		return false
+	}
+	defer release()
+	ctx, cancel := context.WithTimeout(ctx, cfg.FFmpeg.ExtractTimeout.std())
+	defer cancel()
+
+	slog.InfoContext(ctx, "Running recipe step", "input", filepath.Base(input))
+	if out, err := runFFmpeg(ctx, step.profile().Name, step.ffmpegArgs(input, output)); err != nil {
+		slog.ErrorContext(ctx, "FFmpeg failed", "error", err, "stderr", string(out))
+		writeError(w, r.WithContext(ctx), stepError(index, step, ffmpegError(ctx, err, out)))
+		return false
+	}
+	if _, err := os.Stat(output); err != nil {
+		writeError(w, r.WithContext(ctx), stepError(index, step, newAPIError(codeTranscodeFailed, "FFmpeg produced no output")))
+		return false
+	}
+	return true
+}
+
+// stepError names the failing step in an error's message
+func stepError(index int, step *RecipeStep, apiErr *apiError) *apiError {
+	failed := *apiErr
+	failed.Message = fmt.Sprintf("steps[%d] (%s): %s", index, step.Name, apiErr.Message)
+	return &failed
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecipeValidate(t *testing.T) {
+	setupTestEnv(t)
+	encode := `{"name":"mp3","op":"encode"}`
+	tests := []struct {
+		name  string
+		steps string
+		code  string
+		msg   string // part of the error message; "" for a valid recipe
+	}{
+		{"valid", `[{"name":"cut","op":"trim","start":"5","duration":"00:01:00"},{"name":"norm","op":"loudnorm","input":"cut"},{"name":"out","op":"encode","input":"norm","format":"flac"}]`, "", ""},
+		{"empty pipeline", `[]`, codeInvalidRequest, "steps must hold between 1"},
+		{"too many steps", "[" + strings.TrimSuffix(strings.Repeat(`{"name":"p","op":"probe"},`, 33), ",") + "]", codeInvalidRequest, "steps must hold between 1"},
+		{"unknown op", `[{"name":"x","op":"reverse"},` + encode + `]`, codeInvalidRequest, `steps[0] (x): unknown op "reverse"`},
+		{"bad name", `[{"name":"Bad Name","op":"encode"}]`, codeInvalidRequest, "name must be"},
+		{"duplicate name", `[{"name":"a","op":"trim","start":"1"},{"name":"a","op":"encode"}]`, codeInvalidRequest, "steps[1] (a): name is already used"},
+		{"source name taken", `[{"name":"source","op":"encode"}]`, codeInvalidRequest, "name is already used"},
+		{"unknown input", `[{"name":"out","op":"encode","input":"later"}]`, codeInvalidRequest, `input "later" is not the source or an earlier step`},
+		{"input without audio", `[{"name":"wave","op":"waveform"},{"name":"out","op":"encode","input":"wave"}]`, codeInvalidRequest, `input "wave" produces no audio`},
+		{"param of another op", `[{"name":"out","op":"encode","start":"5"}]`, codeInvalidRequest, "start does not apply to encode"},
+		{"trim without bounds", `[{"name":"cut","op":"trim"},` + encode + `]`, codeInvalidRequest, "trim needs start, duration or both"},
+		{"bad trim time", `[{"name":"cut","op":"trim","start":"1:2"},` + encode + `]`, codeInvalidRequest, "is not a time"},
+		{"loudness out of range", `[{"name":"norm","op":"loudnorm","loudness":0},` + encode + `]`, codeInvalidRequest, "loudness must be between -70 and -5"},
+		{"unsupported format", `[{"name":"out","op":"encode","format":"ogg"}]`, codeUnsupportedFormat, "Unsupported output format: ogg"},
+		{"bad quality", `[{"name":"out","op":"encode","quality":"loud"}]`, codeInvalidRequest, "quality must be a bitrate"},
+		{"waveform too wide", `[{"name":"wave","op":"waveform","width":5000}]`, codeInvalidRequest, "width must be 1-4096"},
+		{"bad colour", `[{"name":"wave","op":"waveform","color":"blue"}]`, codeInvalidRequest, "color must be #rrggbb"},
+		{"no output", `[{"name":"p","op":"probe"}]`, codeInvalidRequest, "the recipe produces nothing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req RecipeRequest
+			body := `{"video_url":"https://example.com/v.mp4","steps":` + tt.steps + `}`
+			if err := json.Unmarshal([]byte(body), &req); err != nil {
+				t.Fatal(err)
+			}
+			apiErr := req.validate()
+			switch {
+			case tt.msg == "" && apiErr != nil:
+				t.Errorf("validate() = %v, want ok", apiErr)
+			case tt.msg != "" && apiErr == nil:
+				t.Errorf("validate() ok, want %s", tt.msg)
+			case apiErr != nil && (apiErr.Code != tt.code || !strings.Contains(apiErr.Message, tt.msg)):
+				t.Errorf("validate() = %s %q, want %s containing %q", apiErr.Code, apiErr.Message, tt.code, tt.msg)
+			}
+		})
+	}
+}
+
+func TestRecipeValidateFillsDefaults(t *testing.T) {
+	setupTestEnv(t)
+	req := RecipeRequest{VideoURL: "https://example.com/v.mp4", Steps: []RecipeStep{
+		{Name: "norm", Op: "loudnorm"},
+		{Name: "wave", Op: "waveform", Input: "norm"},
+		{Name: "out", Op: "encode", Input: "norm"},
+	}}
+	if apiErr := req.validate(); apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	norm, wave, out := req.Steps[0], req.Steps[1], req.Steps[2]
+	if norm.Input != "source" || *norm.Loudness != -16 || *norm.TruePeak != -1.5 || *norm.LoudnessRange != 11 {
+		t.Errorf("loudnorm defaults: input %q, %v/%v/%v", norm.Input, *norm.Loudness, *norm.TruePeak, *norm.LoudnessRange)
+	}
+	if wave.Width != 1200 || wave.Height != 240 || wave.Color != "#1e88e5" {
+		t.Errorf("waveform defaults: %dx%d %s", wave.Width, wave.Height, wave.Color)
+	}
+	if out.Format != "mp3" {
+		t.Errorf("encode format defaulted to %q, want mp3", out.Format)
+	}
+}
+
+func TestRecipeRunsEveryStep(t *testing.T) {
+	ffmpegRuns := setupTestEnv(t)
+	body := `{"video_url":"` + serveVideo(t) + `","steps":[
+		{"name":"info","op":"probe"},
+		{"name":"cut","op":"trim","start":"1","duration":"30"},
+		{"name":"norm","op":"loudnorm","input":"cut"},
+		{"name":"mp3","op":"encode","input":"norm"},
+		{"name":"flac","op":"encode","input":"cut","format":"flac"},
+		{"name":"wave","op":"waveform","input":"norm"}]}`
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/recipe", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	extractRoute(strict(trackJob(recipeHandler)))(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("recipe answered %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var resp RecipeResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Steps) != 6 || resp.Steps[0].Probe == nil {
+		t.Errorf("steps = %+v, want 6 with the probe result first", resp.Steps)
+	}
+	if n := ffmpegRuns(); n != 5 {
+		t.Errorf("ffmpeg ran %d times, want once per FFmpeg step", n)
+	}
+
+	want := []struct{ step, ext, contentType string }{
+		{"mp3", ".mp3", "audio/mpeg"},
+		{"flac", ".flac", "audio/flac"},
+		{"wave", ".png", "image/png"},
+	}
+	if len(resp.Artifacts) != len(want) {
+		t.Fatalf("artifacts = %+v, want %d", resp.Artifacts, len(want))
+	}
+	for i, w := range want {
+		a := resp.Artifacts[i]
+		if a.Step != w.step || filepath.Ext(a.FileName) != w.ext || a.ContentType != w.contentType || a.Bytes != 5000 {
+			t.Errorf("artifacts[%d] = %+v, want step %s as %s", i, a, w.step, w.contentType)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.Storage.ProcessingDir, a.FileName)); err != nil {
+			t.Errorf("artifact %s not published: %v", a.Step, err)
+		}
+	}
+
+	// the intermediates and the source are gone, the outputs kept
+	leftovers, _ := filepath.Glob(filepath.Join(cfg.Storage.ProcessingDir, "recipe_*"))
+	if len(leftovers) != len(want) {
+		t.Errorf("processing directory holds %v, want only the %d outputs", leftovers, len(want))
+	}
+
+	st, ok := journal.get(rec.Header().Get("X-Job-ID"))
+	if !ok || st.Status != jobSucceeded || len(st.Artifacts) != len(want) {
+		t.Errorf("journaled job = %+v", st)
+	}
+}
+
+func TestRecipeFailingStepIsNamed(t *testing.T) {
+	setupTestEnv(t)
+	bin := filepath.SplitList(os.Getenv("PATH"))[0]
+	fail := "#!/bin/sh\necho 'Invalid data found when processing input' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(bin, "ffmpeg"), []byte(fail), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	body := `{"video_url":"` + serveVideo(t) + `","steps":[{"name":"cut","op":"trim","start":"1"},{"name":"out","op":"encode","input":"cut"}]}`
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/recipe", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	extractRoute(strict(trackJob(recipeHandler)))(rec, req)
+
+	var resp FFmpegResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	if resp.Success || !strings.HasPrefix(resp.Error, "steps[0] (cut): ") || resp.Code != codeInvalidInputMedia {
+		t.Errorf("recipe answered %d: %s", rec.Code, rec.Body.String())
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(cfg.Storage.ProcessingDir, "recipe_*")); len(leftovers) != 0 {
+		t.Errorf("failed recipe left %v", leftovers)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ObjectSource identifies an object in S3-compatible storage (such as R2)
+// that the server fetches itself instead of receiving it base64-encoded
+type ObjectSource struct {
+	Bucket string `json:"bucket" openapi:"required"`
+	Key    string `json:"key" openapi:"required"`
+}
+
+// s3Client performs SigV4-signed requests against an S3-compatible endpoint
+type s3Client struct {
+	endpoint        string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	concurrency     int
+	chunkSize       int64
+	httpClient      *http.Client
+}
+
+// newS3ClientFromConfig builds a client from the s3 section of cfg, using the
+// same chunk size and chunk timeout as URL downloads
+func newS3ClientFromConfig() (*s3Client, error) {
+	c := cfg.S3
+	if c.Endpoint == "" {
+		return nil, newAPIError(codeStorageNotConfigured, "object storage is not configured (S3_ENDPOINT is empty)")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return nil, newAPIError(codeStorageNotConfigured, "object storage credentials are not configured")
+	}
+
+	return &s3Client{
+		endpoint:        c.Endpoint,
+		region:          c.Region,
+		accessKeyID:     c.AccessKeyID,
+		secretAccessKey: c.SecretAccessKey,
+		concurrency:     c.DownloadConcurrency,
+		chunkSize:       cfg.Download.ChunkSize,
+		httpClient:      &http.Client{Timeout: cfg.Download.ChunkTimeout.std()},
+	}, nil
+}
+
+// objectURL returns the path-style URL for an object
+func (c *s3Client) objectURL(src ObjectSource) string {
+	segments := strings.Split(src.Key, "/")
+	for i, s := range segments {
+		segments[i] = s3Escape(s)
+	}
+	return fmt.Sprintf("%s/%s/%s", c.endpoint, s3Escape(src.Bucket), strings.Join(segments, "/"))
+}
+
+// s3Escape percent-encodes a path segment the way SigV4 expects
+// (RFC 3986 unreserved characters are left alone, everything else is encoded)
+func s3Escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ('A' <= ch && ch <= 'Z') || ('a' <= ch && ch <= 'z') || ('0' <= ch && ch <= '9') ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' {
+			b.WriteByte(ch)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", ch)
+	}
+	return b.String()
+}
+
+// newRequest creates a signed request for an object
+func (c *s3Client) newRequest(ctx context.Context, method string, src ObjectSource) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(src), nil)
+	if err != nil {
+		return nil, err
+	}
+	injectTraceparent(ctx, req)
+	c.sign(req, time.Now().UTC())
+	return req, nil
+}
+
+// sign adds AWS Signature Version 4 headers to a request without a body
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	c.signPayload(req, now, "UNSIGNED-PAYLOAD")
+}
+
+// signPayload signs a request whose payload hashes to payloadHash
+func (c *s3Client) signPayload(req *http.Request, now time.Time, payloadHash string) {
+	amzDate := now.Format("20060102T150405Z")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope, signature := c.signature(now, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKeyID, scope, signedHeaders, signature))
+}
+
+// presignURL returns rawURL with a SigV4 signature for a GET in its query
+// string, valid for expires. Tools that cannot sign their own requests,
+// such as ffprobe, can read an object through it.
+func (c *s3Client) presignURL(rawURL string, expires time.Duration, now time.Time) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	amzDate := now.Format("20060102T150405Z")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", now.Format("20060102"), c.region)
+
+	// Encode sorts by key, as the canonical query string must be
+	query := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {c.accessKeyID + "/" + scope},
+		"X-Amz-Date":          {amzDate},
+		"X-Amz-Expires":       {strconv.Itoa(int(expires / time.Second))},
+		"X-Amz-SignedHeaders": {"host"},
+	}.Encode()
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		u.EscapedPath(),
+		query,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	_, signature := c.signature(now, canonicalRequest)
+	u.RawQuery = query + "&X-Amz-Signature=" + signature
+	return u.String(), nil
+}
+
+// signature returns the credential scope for now and the signature of a
+// canonical request within it
+func (c *s3Client) signature(now time.Time, canonicalRequest string) (scope, signature string) {
+	date := now.Format("20060102")
+	scope = fmt.Sprintf("%s/%s/s3/aws4_request", date, c.region)
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format("20060102T150405Z"),
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretAccessKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// headObject returns the size and ETag of an object
+func (c *s3Client) headObject(ctx context.Context, src ObjectSource) (int64, string, error) {
+	ctx, span := startSpan(ctx, "HEAD object", spanKindClient)
+	defer span.finish()
+
+	req, err := c.newRequest(ctx, http.MethodHead, src)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create HEAD request: %v", err)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to get object info: %v", err)
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return 0, "", fmt.Errorf("object not found: %s/%s", src.Bucket, src.Key)
+	case resp.StatusCode != http.StatusOK:
+		return 0, "", fmt.Errorf("object storage returned HTTP %d for HEAD", resp.StatusCode)
+	}
+
+	if resp.ContentLength < 0 {
+		return 0, "", fmt.Errorf("object storage did not report the size of %s/%s", src.Bucket, src.Key)
+	}
+	return resp.ContentLength, resp.Header.Get("ETag"), nil
+}
+
+// downloadObjectWithProgress downloads an object with parallel ranged GETs,
+// writing each chunk at its offset in outputPath. The first chunk that fails
+// cancels the others, and its error is returned.
+func (c *s3Client) downloadObjectWithProgress(ctx context.Context, src ObjectSource, outputPath string, progressCallback ProgressCallback) error {
+	slog.InfoContext(ctx, "Starting parallel object download", "source", src.String(), "path", outputPath)
+
+	progressCallback("info", "Getting object information...", 0)
+
+	fileSize, _, err := c.headObject(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	fileSizeMB := float64(fileSize) / (1024 * 1024)
+	slog.InfoContext(ctx, "Object size", "bytes", fileSize)
+	progressCallback("info", fmt.Sprintf("File size: %.2f MB", fileSizeMB), 5)
+
+	if maxBytes := cfg.Limits.MaxDownloadBytes; fileSize > maxBytes { // same limit as URL downloads
+		return newAPIErrorf(codeSourceTooLarge, "video file too large (%.1f MB). Maximum supported: %dMB", fileSizeMB, maxBytes/(1024*1024))
+	}
+
+	videoFileHandle, err := os.Create(outputPath)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer videoFileHandle.Close()
+
+	if err := videoFileHandle.Truncate(fileSize); err != nil {
+		return fmt.Errorf("failed to allocate temp file: %v", err)
+	}
+
+	totalChunks := (fileSize + c.chunkSize - 1) / c.chunkSize
+	chunks := make(chan int64)
+	errs := make(chan error, c.concurrency)
+
+	var mu sync.Mutex
+	var completed int64
+
+	progressCallback("download", fmt.Sprintf("Starting parallel download (%d chunks, %d workers)...", totalChunks, c.concurrency), 10)
+
+	workCtx, cancelWorkers := context.WithCancel(ctx)
+	defer cancelWorkers()
+
+	var wg sync.WaitGroup
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for start := range chunks {
+				end := min(start+c.chunkSize, fileSize) - 1
+				if err := c.downloadRange(workCtx, src, videoFileHandle, start, end); err != nil {
+					// queued before the cancel, so it is ahead of the other
+					// workers' cancellation errors
+					errs <- err
+					cancelWorkers()
+					return
+				}
+
+				mu.Lock()
+				completed++
+				progress := 10 + (float64(completed)/float64(totalChunks))*50 // 10-60% for download
+				progressCallback("download", fmt.Sprintf("Downloaded chunk %d/%d", completed, totalChunks), progress)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	var firstErr error
+feed:
+	for start := int64(0); start < fileSize; start += c.chunkSize {
+		select {
+		case chunks <- start:
+		case firstErr = <-errs:
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+
+	if firstErr == nil {
+		select {
+		case firstErr = <-errs:
+		default:
+		}
+	}
+	if firstErr != nil {
+		slog.ErrorContext(ctx, "Object download failed", "error", firstErr)
+		return firstErr
+	}
+
+	progressCallback("download", "Download completed!", 60)
+	slog.InfoContext(ctx, "Object download completed", "bytes", fileSize)
+	return nil
+}
+
+// downloadRange fetches bytes start..end (inclusive) and writes them at the
+// same offset in f, retrying transient failures a few times
+func (c *s3Client) downloadRange(ctx context.Context, src ObjectSource, f *os.File, start, end int64) error {
+	const maxAttempts = 3
+
+	ctx, span := startSpan(ctx, "GET object range", spanKindClient)
+	defer span.finish()
+	span.setAttr("http.request.header.range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		span.setAttr("attempts", attempt)
+		if attempt > 1 {
+			chunkRetries.inc("object_storage")
+			slog.WarnContext(ctx, "Retrying range", "start", start, "end", end, "attempt", attempt, "max_attempts", maxAttempts, "error", lastErr)
+			timer := time.NewTimer(time.Duration(attempt-1) * 500 * time.Millisecond)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				err := fmt.Errorf("failed to download range %d-%d: %v", start, end, ctx.Err())
+				span.fail(err)
+				return err
+			}
+		}
+
+		req, err := c.newRequest(ctx, http.MethodGet, src)
+		if err != nil {
+			return fmt.Errorf("failed to create range request: %v", err)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("object storage returned HTTP %d for range %d-%d", resp.StatusCode, start, end)
+			if resp.StatusCode < 500 {
+				span.fail(lastErr)
+				return lastErr
+			}
+			continue
+		}
+
+		written, err := io.Copy(io.NewOffsetWriter(f, start), resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if written != end-start+1 {
+			lastErr = fmt.Errorf("short read for range %d-%d: got %d bytes", start, end, written)
+			continue
+		}
+		return nil
+	}
+
+	err := fmt.Errorf("failed to download range %d-%d: %v", start, end, lastErr)
+	span.fail(err)
+	return err
+}
+
+// String returns an s3:// URL for logging
+func (src ObjectSource) String() string {
+	return (&url.URL{Scheme: "s3", Host: src.Bucket, Path: "/" + src.Key}).String()
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priorityClass separates latency-sensitive jobs from bulk work
+type priorityClass int
+
+const (
+	priorityInteractive priorityClass = iota
+	priorityBatch
+	numPriorityClasses
+)
+
+var priorityNames = [numPriorityClasses]string{"interactive", "batch"}
+
+func (c priorityClass) String() string {
+	return priorityNames[c]
+}
+
+// parsePriority maps a request's priority field to its class; empty means
+// interactive
+func parsePriority(s string) (priorityClass, bool) {
+	switch s {
+	case "", "interactive":
+		return priorityInteractive, true
+	case "batch":
+		return priorityBatch, true
+	}
+	return 0, false
+}
+
+// jobTicket identifies who a queued job belongs to and how urgent it is
+type jobTicket struct {
+	tenant string // the request's instance_id
+	class  priorityClass
+	resume *pendingJob // saved if the job is still queued at shutdown; nil if it cannot be resumed
+}
+
+// workPool bounds how many jobs run one kind of work at once. Jobs beyond
+// the limit wait in a bounded queue; once that is full new jobs are refused
+// so the client can back off or retry on another instance. Free slots are
+// handed out by weighted round robin, first across priority classes and
+// then across tenants within a class, so one tenant's bulk import cannot
+// starve everyone else's small uploads.
+type workPool struct {
+	name           string
+	mu             sync.Mutex
+	slots          int
+	running        int
+	maxQueue       int
+	maxTenantQueue int
+	waiting        *fairQueue
+	closed         bool // set at shutdown; queued and new jobs are refused
+}
+
+// poolWaiter is a job queued for a slot
+type poolWaiter struct {
+	ticket   jobTicket
+	granted  bool
+	position int           // 1-based place in line as of the last queue change; guarded by the pool's mu
+	ready    chan struct{} // closed when a slot is handed to the waiter or the pool closes
+	moved    chan struct{} // signalled when the waiter's position changes
+}
+
+var errQueueFull = errors.New("job queue is full")
+
+// Process-wide pools: FFmpeg runs are CPU-bound, downloads are bound by the
+// network and by how many files the disk budget can hold at once
+var (
+	ffmpegPool   *workPool
+	downloadPool *workPool
+)
+
+func newWorkPool(name string, slots, maxQueue, maxTenantQueue int, classWeights [numPriorityClasses]int, tenantWeights map[string]int) *workPool {
+	p := &workPool{
+		name:           name,
+		slots:          slots,
+		maxQueue:       maxQueue,
+		maxTenantQueue: maxTenantQueue,
+		waiting:        newFairQueue(classWeights, tenantWeights),
+	}
+	queueDepth.set(0, name)
+	return p
+}
+
+// newWorkPoolsFromConfig creates the FFmpeg and download pools from cfg
+func newWorkPoolsFromConfig() {
+	c := cfg.Workers
+	classWeights := [numPriorityClasses]int{c.InteractiveWeight, c.BatchWeight}
+	tenantWeights, _ := parseTenantWeights(c.TenantWeights) // checked by config validation
+	ffmpegPool = newWorkPool("ffmpeg", c.FFmpegConcurrency, c.QueueSize, c.TenantQueueSize, classWeights, tenantWeights)
+	downloadPool = newWorkPool("download", c.DownloadConcurrency, c.QueueSize, c.TenantQueueSize, classWeights, tenantWeights)
+}
+
+// parseTenantWeights reads "tenant=weight,tenant=weight"
+func parseTenantWeights(s string) (map[string]int, error) {
+	weights := map[string]int{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if !ok || err != nil || n < 1 || strings.TrimSpace(k) == "" {
+			return nil, fmt.Errorf("invalid tenant weight %q, want tenant=weight with weight >= 1", pair)
+		}
+		weights[strings.TrimSpace(k)] = n
+	}
+	return weights, nil
+}
+
+// acquire waits for a slot. While queued it calls onPosition with the job's
+// 1-based place in line each time that changes. The returned release func
+// must be called once the work is done; calling it again is harmless.
+func (p *workPool) acquire(ctx context.Context, t jobTicket, onPosition func(int)) (func(), error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errShuttingDown
+	}
+	if p.running < p.slots && p.waiting.len() == 0 {
+		p.running++
+		p.mu.Unlock()
+		return p.releaseFunc(), nil
+	}
+	if p.waiting.len() >= p.maxQueue || p.waiting.tenantLen(t.tenant) >= p.maxTenantQueue {
+		p.mu.Unlock()
+		queueRejections.inc(p.name)
+		return nil, errQueueFull
+	}
+	wt := &poolWaiter{ticket: t, ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	p.waiting.push(wt)
+	p.notifyMoved()
+	position := wt.position
+	queueDepth.set(float64(p.waiting.len()), p.name)
+	p.mu.Unlock()
+
+	reported := 0
+	for {
+		if position > 0 && position != reported && onPosition != nil {
+			onPosition(position)
+			reported = position
+		}
+		select {
+		case <-wt.ready:
+			if !wt.granted {
+				return nil, errShuttingDown
+			}
+			return p.releaseFunc(), nil
+		case <-wt.moved:
+			p.mu.Lock()
+			position = wt.position
+			p.mu.Unlock()
+		case <-ctx.Done():
+			p.mu.Lock()
+			if p.closed && !wt.granted {
+				// Turned away by close as the caller gave up
+				p.mu.Unlock()
+				return nil, errShuttingDown
+			}
+			if wt.granted {
+				// The slot arrived as the caller gave up; pass it on
+				p.running--
+			} else {
+				p.waiting.remove(wt)
+			}
+			p.dispatch()
+			p.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// releaseFunc returns a func that gives one slot back exactly once
+func (p *workPool) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.running--
+			p.dispatch()
+		})
+	}
+}
+
+// dispatch hands free slots to waiters in scheduling order and tells the
+// rest their position may have changed. The caller must hold p.mu.
+func (p *workPool) dispatch() {
+	for p.running < p.slots && p.waiting.len() > 0 {
+		wt := p.waiting.pop()
+		wt.granted = true
+		p.running++
+		close(wt.ready)
+	}
+	p.notifyMoved()
+	queueDepth.set(float64(p.waiting.len()), p.name)
+}
+
+// notifyMoved recomputes every waiter's position in one pass and wakes the
+// waiters whose position changed. A job arriving in a quieter tenant can
+// overtake queued ones, so this runs on pushes as well as pops. The caller
+// must hold p.mu.
+func (p *workPool) notifyMoved() {
+	p.waiting.updatePositions(func(wt *poolWaiter) {
+		select {
+		case wt.moved <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// close refuses new jobs and turns away every queued one, which then
+// receives errShuttingDown. Running jobs keep their slots.
+func (p *workPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for p.waiting.len() > 0 {
+		close(p.waiting.pop().ready)
+	}
+	queueDepth.set(0, p.name)
+}
+
+// saturated reports whether a new job would be refused right now
+func (p *workPool) saturated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running >= p.slots && p.waiting.len() >= p.maxQueue
+}
+
+// stats returns the number of running and queued jobs
+func (p *workPool) stats() (running, queued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running, p.waiting.len()
+}
+
+// wrrCursor walks a list of weighted entries in weighted round robin: the
+// entry under the cursor is picked up to its weight times in a row before
+// the cursor moves on to the next eligible entry
+type wrrCursor struct {
+	index  int
+	credit int // picks left for the entry at index in this turn
+}
+
+// next returns the index of the entry to pick, or -1 when none is eligible
+func (c *wrrCursor) next(weights []int, eligible func(int) bool) int {
+	n := len(weights)
+	for tries := 0; tries <= n; tries++ {
+		if c.credit > 0 && c.index >= 0 && c.index < n && eligible(c.index) {
+			c.credit--
+			return c.index
+		}
+		c.index = (c.index + 1) % n
+		c.credit = weights[c.index]
+	}
+	return -1
+}
+
+// removed keeps the cursor on the following entry after entry i is deleted
+func (c *wrrCursor) removed(i int) {
+	switch {
+	case i < c.index:
+		c.index--
+	case i == c.index:
+		c.index--
+		c.credit = 0
+	}
+}
+
+// tenantQueue holds one tenant's waiters in arrival order
+type tenantQueue struct {
+	tenant  string
+	weight  int
+	waiters []*poolWaiter
+}
+
+// classQueue round-robins across the tenants with waiters in one class
+type classQueue struct {
+	tenants []*tenantQueue
+	cursor  wrrCursor
+}
+
+// fairQueue is the waiting room of a workPool
+type fairQueue struct {
+	classes       [numPriorityClasses]*classQueue
+	classWeights  [numPriorityClasses]int
+	classCursor   wrrCursor
+	tenantWeights map[string]int
+	size          int
+}
+
+func newFairQueue(classWeights [numPriorityClasses]int, tenantWeights map[string]int) *fairQueue {
+	q := &fairQueue{classWeights: classWeights, classCursor: wrrCursor{index: -1}, tenantWeights: tenantWeights}
+	for i := range q.classes {
+		q.classes[i] = &classQueue{cursor: wrrCursor{index: -1}}
+	}
+	return q
+}
+
+func (q *fairQueue) len() int {
+	return q.size
+}
+
+// tenantLen counts the waiters of one tenant across classes
+func (q *fairQueue) tenantLen(tenant string) int {
+	n := 0
+	for _, cq := range q.classes {
+		for _, tq := range cq.tenants {
+			if tq.tenant == tenant {
+				n += len(tq.waiters)
+			}
+		}
+	}
+	return n
+}
+
+func (q *fairQueue) push(wt *poolWaiter) {
+	cq := q.classes[wt.ticket.class]
+	for _, tq := range cq.tenants {
+		if tq.tenant == wt.ticket.tenant {
+			tq.waiters = append(tq.waiters, wt)
+			q.size++
+			return
+		}
+	}
+	weight := q.tenantWeights[wt.ticket.tenant]
+	if weight == 0 {
+		weight = 1
+	}
+	cq.tenants = append(cq.tenants, &tenantQueue{tenant: wt.ticket.tenant, weight: weight, waiters: []*poolWaiter{wt}})
+	q.size++
+}
+
+// pop removes and returns the next waiter to run
+func (q *fairQueue) pop() *poolWaiter {
+	ci := q.classCursor.next(q.classWeights[:], func(i int) bool { return len(q.classes[i].tenants) > 0 })
+	if ci < 0 {
+		return nil
+	}
+	cq := q.classes[ci]
+	weights := make([]int, len(cq.tenants))
+	for i, tq := range cq.tenants {
+		weights[i] = tq.weight
+	}
+	ti := cq.cursor.next(weights, func(int) bool { return true })
+	tq := cq.tenants[ti]
+	wt := tq.waiters[0]
+	tq.waiters = tq.waiters[1:]
+	q.size--
+	if len(tq.waiters) == 0 {
+		cq.removeTenant(ti)
+	}
+	return wt
+}
+
+func (cq *classQueue) removeTenant(i int) {
+	cq.tenants = append(cq.tenants[:i], cq.tenants[i+1:]...)
+	cq.cursor.removed(i)
+}
+
+// remove drops a waiter that gave up
+func (q *fairQueue) remove(wt *poolWaiter) {
+	cq := q.classes[wt.ticket.class]
+	for ti, tq := range cq.tenants {
+		for wi, other := range tq.waiters {
+			if other != wt {
+				continue
+			}
+			tq.waiters = append(tq.waiters[:wi], tq.waiters[wi+1:]...)
+			q.size--
+			if len(tq.waiters) == 0 {
+				cq.removeTenant(ti)
+			}
+			return
+		}
+	}
+}
+
+// updatePositions replays the schedule once on a copy of the queue and
+// stores each waiter's 1-based place in line, calling moved for every
+// waiter whose place changed. The copy's pops do not touch the waiters.
+func (q *fairQueue) updatePositions(moved func(*poolWaiter)) {
+	sim := q.clone()
+	for position := 1; sim.len() > 0; position++ {
+		wt := sim.pop()
+		if wt.position != position {
+			wt.position = position
+			moved(wt)
+		}
+	}
+}
+
+func (q *fairQueue) clone() *fairQueue {
+	c := &fairQueue{classWeights: q.classWeights, classCursor: q.classCursor, tenantWeights: q.tenantWeights, size: q.size}
+	for i, cq := range q.classes {
+		cc := &classQueue{cursor: cq.cursor, tenants: make([]*tenantQueue, len(cq.tenants))}
+		for j, tq := range cq.tenants {
+			cc.tenants[j] = &tenantQueue{tenant: tq.tenant, weight: tq.weight, waiters: append([]*poolWaiter(nil), tq.waiters...)}
+		}
+		c.classes[i] = cc
+	}
+	return c
+}
+
+// rejectIfSaturated refuses a job up front when the FFmpeg queue is already
+// full, before its body is read. It reports whether the job was refused.
+func rejectIfSaturated(w http.ResponseWriter, r *http.Request) bool {
+	if !ffmpegPool.saturated() {
+		return false
+	}
+	queueRejections.inc(ffmpegPool.name)
+	writeQueueFull(w, r)
+	return true
+}
+
+func writeQueueFull(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(cfg.Workers.RetryAfter.std()/time.Second)))
+	writeError(w, r, newAPIError(codeQueueFull, "Too many jobs queued on this instance, retry later"))
+}
+
+// waitForSlot acquires a slot in pool for the request's job. While the job
+// is queued its place in line is reported as queue_position by
+// GET /v1/jobs/{id}, and sent in 102 Processing interim responses carrying
+// X-Queue-Position to clients that read them. On failure it writes the
+// error response and returns ok=false.
+func waitForSlot(ctx context.Context, w http.ResponseWriter, r *http.Request, pool *workPool, t jobTicket) (release func(), ok bool) {
+	queued := false
+	start := time.Now()
+	release, err := pool.acquire(ctx, t, func(position int) {
+		if !queued {
+			queued = true
+			ctx = startStage(ctx, "queued")
+			journal.setStatus(jobIDFrom(ctx), jobQueued)
+		}
+		journal.setQueuePosition(jobIDFrom(ctx), position)
+		slog.InfoContext(ctx, "Waiting for a worker slot", "pool", pool.name, "priority", t.class.String(), "queue_position", position)
+		w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+		w.WriteHeader(http.StatusProcessing)
+	})
+	w.Header().Del("X-Queue-Position")
+	if queued && err == nil {
+		slog.InfoContext(ctx, "Worker slot acquired", "pool", pool.name, "waited_ms", time.Since(start).Milliseconds())
+	}
+
+	// Errors are logged with the job's stage, not just the request's
+	r = r.WithContext(ctx)
+	switch {
+	case err == nil:
+		journal.setStatus(jobIDFrom(ctx), jobRunning)
+		return release, true
+	case errors.Is(err, errShuttingDown):
+		w.Header().Set("Retry-After", "1")
+		if t.resume == nil {
+			writeError(w, r, newAPIError(codeDraining, "Server is shutting down, retry on another instance"))
+			break
+		}
+		if err := t.resume.save(); err != nil {
+			slog.WarnContext(ctx, "Failed to save queued job for resumption", "error", err)
+			writeError(w, r, newAPIError(codeDraining, "Server is shutting down, retry on another instance"))
+			break
+		}
+		slog.InfoContext(ctx, "Saved queued job for resumption after restart", "pool", pool.name)
+		journal.setStatus(t.resume.ID, jobSuspended)
+		writeError(w, r, newAPIError(codeDraining, "Server is shutting down. The job was saved and will finish after restart; retry the same request to collect the result"))
+	case errors.Is(err, errQueueFull):
+		slog.WarnContext(ctx, "Job queue full, refusing job", "pool", pool.name, "priority", t.class.String())
+		writeQueueFull(w, r)
+	default:
+		slog.WarnContext(ctx, "Gave up waiting for a worker slot", "pool", pool.name, "error", err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(cfg.Workers.RetryAfter.std()/time.Second)))
+		writeError(w, r, newAPIError(codeQueueTimeout, "Timed out waiting for a worker slot"))
+	}
+	return nil, false
+}
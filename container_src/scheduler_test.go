@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getJob fetches a job through GET /v1/jobs/{id}
+func getJob(t *testing.T, id string) jobState {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+apiVersionPrefix+"/jobs/{id}", jobHandler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, apiVersionPrefix+"/jobs/"+id, nil))
+	var st jobState
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("unreadable job %q: %v", rec.Body.String(), err)
+	}
+	return st
+}
+
+func TestQueuePositionReportedByJobStatus(t *testing.T) {
+	setupTestEnv(t)
+	pool := newWorkPool("test", 1, 4, 4, [numPriorityClasses]int{1, 1}, nil)
+	hold, err := pool.acquire(context.Background(), jobTicket{tenant: "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two jobs queue behind the running one
+	ids := []string{newJobID(), newJobID()}
+	granted := make(chan func(), len(ids))
+	for _, id := range ids {
+		journal.create(context.Background(), id, apiVersionPrefix+"/extract-audio")
+		ctx := context.WithValue(context.Background(), jobIDKey{}, id)
+		go func() {
+			release, ok := waitForSlot(ctx, httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil), pool, jobTicket{tenant: "b"})
+			if ok {
+				granted <- release
+			}
+		}()
+		waitFor(t, func() bool { st, _ := journal.get(id); return st.QueuePosition > 0 })
+	}
+
+	for i, id := range ids {
+		if st := getJob(t, id); st.Status != jobQueued || st.QueuePosition != i+1 {
+			t.Errorf("job %d: status %s at position %d, want queued at %d", i, st.Status, st.QueuePosition, i+1)
+		}
+	}
+
+	hold()
+	release := <-granted
+	waitFor(t, func() bool { return getJob(t, ids[1]).QueuePosition == 1 })
+	if st := getJob(t, ids[0]); st.Status != jobRunning || st.QueuePosition != 0 {
+		t.Errorf("started job: status %s at position %d, want running without a position", st.Status, st.QueuePosition)
+	}
+	release()
+	(<-granted)()
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// queued pushes one waiter per "tenant/class" spec, class being i or b
+func queued(q *fairQueue, specs ...string) []*poolWaiter {
+	var out []*poolWaiter
+	for _, spec := range specs {
+		tenant, class, _ := strings.Cut(spec, "/")
+		t := jobTicket{tenant: tenant}
+		if class == "b" {
+			t.class = priorityBatch
+		}
+		wt := &poolWaiter{ticket: t}
+		q.push(wt)
+		out = append(out, wt)
+	}
+	return out
+}
+
+// drain pops every waiter, returning them as "tenant/class" specs
+func drain(q *fairQueue) []string {
+	var order []string
+	for q.len() > 0 {
+		wt := q.pop()
+		order = append(order, wt.ticket.tenant+"/"+wt.ticket.class.String()[:1])
+	}
+	return order
+}
+
+func repeat(spec string, n int) []string {
+	out := make([]string, n)
+	for i := range out {
+		out[i] = spec
+	}
+	return out
+}
+
+func TestFairQueueOrder(t *testing.T) {
+	tests := []struct {
+		name          string
+		classWeights  [numPriorityClasses]int
+		tenantWeights map[string]int
+		push          []string
+		want          []string
+	}{
+		{
+			name:         "interactive gets its weight in turns per batch turn",
+			classWeights: [numPriorityClasses]int{4, 1},
+			push:         append(repeat("a/b", 3), repeat("a/i", 9)...),
+			want: []string{
+				"a/i", "a/i", "a/i", "a/i", "a/b",
+				"a/i", "a/i", "a/i", "a/i", "a/b",
+				"a/i", "a/b",
+			},
+		},
+		{
+			name:         "batch runs when no interactive job waits",
+			classWeights: [numPriorityClasses]int{4, 1},
+			push:         repeat("a/b", 3),
+			want:         repeat("a/b", 3),
+		},
+		{
+			name:         "tenants alternate within a class",
+			classWeights: [numPriorityClasses]int{1, 1},
+			push:         append(repeat("bulk/i", 4), "x/i", "y/i"),
+			want:         []string{"bulk/i", "x/i", "y/i", "bulk/i", "bulk/i", "bulk/i"},
+		},
+		{
+			name:          "tenant weight gives consecutive turns",
+			classWeights:  [numPriorityClasses]int{1, 1},
+			tenantWeights: map[string]int{"heavy": 2},
+			push:          append(repeat("heavy/i", 4), repeat("light/i", 3)...),
+			want:          []string{"heavy/i", "heavy/i", "light/i", "heavy/i", "heavy/i", "light/i", "light/i"},
+		},
+		{
+			name:         "tenants are fair within each class",
+			classWeights: [numPriorityClasses]int{2, 1},
+			push:         []string{"a/i", "a/i", "a/b", "a/b", "b/i", "b/b"},
+			want:         []string{"a/i", "b/i", "a/b", "a/i", "b/b", "a/b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFairQueue(tt.classWeights, tt.tenantWeights)
+			queued(q, tt.push...)
+			if got := drain(q); !slices.Equal(got, tt.want) {
+				t.Errorf("dequeue order\n got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	tests := []struct {
+		name   string
+		weight int      // weight of tenant a
+		pops   int      // waiters dequeued before the removal
+		remove []string // tenants whose waiters all give up
+		want   []string // the rest of the dequeue order
+	}{
+		{
+			name:   "tenant under the cursor leaves mid-turn",
+			weight: 3,
+			pops:   1,
+			remove: []string{"a"},
+			want:   []string{"b/i", "c/i", "b/i", "c/i"},
+		},
+		{
+			name:   "tenant before the cursor leaves",
+			weight: 1,
+			pops:   2,
+			remove: []string{"a"},
+			want:   []string{"c/i", "b/i", "c/i"},
+		},
+		{
+			name:   "tenant after the cursor leaves mid-turn",
+			weight: 3,
+			pops:   1,
+			remove: []string{"b"},
+			want:   []string{"a/i", "a/i", "c/i", "a/i", "c/i"},
+		},
+		{
+			name:   "last tenant leaves",
+			weight: 1,
+			pops:   2,
+			remove: []string{"c"},
+			want:   []string{"a/i", "b/i", "a/i", "a/i"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFairQueue([numPriorityClasses]int{1, 1}, map[string]int{"a": tt.weight})
+			waiters := queued(q, "a/i", "a/i", "a/i", "a/i", "b/i", "b/i", "c/i", "c/i")
+			for i := 0; i < tt.pops; i++ {
+				q.pop()
+			}
+			for _, wt := range waiters {
+				if slices.Contains(tt.remove, wt.ticket.tenant) {
+					q.remove(wt)
+				}
+			}
+			if got := drain(q); !slices.Equal(got, tt.want) {
+				t.Errorf("dequeue order after removal\n got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWRRCursorRemoved(t *testing.T) {
+	tests := []struct {
+		name       string
+		cursor     wrrCursor
+		removed    int
+		wantIndex  int
+		wantCredit int
+	}{
+		{"before the cursor", wrrCursor{index: 2, credit: 2}, 0, 1, 2},
+		{"under the cursor", wrrCursor{index: 2, credit: 2}, 2, 1, 0},
+		{"after the cursor", wrrCursor{index: 1, credit: 2}, 2, 1, 2},
+		{"first entry under the cursor", wrrCursor{index: 0, credit: 1}, 0, -1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.cursor
+			c.removed(tt.removed)
+			if c.index != tt.wantIndex || c.credit != tt.wantCredit {
+				t.Errorf("cursor %+v after removing %d, want index %d credit %d", c, tt.removed, tt.wantIndex, tt.wantCredit)
+			}
+		})
+	}
+}
+
+func TestPositionsMatchDequeueOrder(t *testing.T) {
+	tests := []struct {
+		name string
+		pops int
+		push []string
+	}{
+		{"one tenant", 0, repeat("a/i", 5)},
+		{"mixed classes and tenants", 0, []string{"a/b", "a/i", "b/i", "a/i", "c/b", "b/i", "a/i", "c/i"}},
+		{"mid-turn", 3, []string{"a/i", "a/i", "a/i", "b/i", "a/b", "b/b", "c/i", "a/i", "c/i"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newFairQueue([numPriorityClasses]int{3, 1}, map[string]int{"a": 2})
+			waiters := queued(q, tt.push...)
+			for i := 0; i < tt.pops; i++ {
+				q.pop()
+			}
+			q.updatePositions(func(*poolWaiter) {})
+			want := map[*poolWaiter]int{}
+			for _, wt := range waiters {
+				want[wt] = wt.position
+			}
+			for position := 1; q.len() > 0; position++ {
+				wt := q.pop()
+				if want[wt] != position {
+					t.Errorf("%s/%s dequeued at %d, updatePositions said %d", wt.ticket.tenant, wt.ticket.class, position, want[wt])
+				}
+			}
+		})
+	}
+}
+
+func TestUpdatePositionsReportsOnlyMovedWaiters(t *testing.T) {
+	q := newFairQueue([numPriorityClasses]int{1, 1}, nil)
+	waiters := queued(q, "a/i", "a/i", "a/i")
+	moved := 0
+	q.updatePositions(func(*poolWaiter) { moved++ })
+	if moved != 3 {
+		t.Fatalf("first pass moved %d waiters, want all 3", moved)
+	}
+
+	// a waiter joining the back of the line moves nobody ahead of it
+	late := queued(q, "a/i")[0]
+	var got []*poolWaiter
+	q.updatePositions(func(wt *poolWaiter) { got = append(got, wt) })
+	if len(got) != 1 || got[0] != late || late.position != 4 {
+		t.Errorf("after a push moved %d waiters, want only the new one at 4 (got %d)", len(got), late.position)
+	}
+
+	// a quieter tenant overtakes the waiters behind the head of the line
+	quiet := queued(q, "b/i")[0]
+	got = got[:0]
+	q.updatePositions(func(wt *poolWaiter) { got = append(got, wt) })
+	if quiet.position != 2 || waiters[0].position != 1 || waiters[1].position != 3 || len(got) != 4 {
+		t.Errorf("positions after a quieter tenant joined: new %d, head %d, second %d; %d moved, want 4",
+			quiet.position, waiters[0].position, waiters[1].position, len(got))
+	}
+
+	q.pop()
+	got = got[:0]
+	q.updatePositions(func(wt *poolWaiter) { got = append(got, wt) })
+	if len(got) != 4 || quiet.position != 1 {
+		t.Errorf("after a pop moved %d waiters with b at %d, want all 4 forward", len(got), quiet.position)
+	}
+}
+
+func TestCancelledWaiterLeavesQueue(t *testing.T) {
+	setupTestEnv(t)
+	pool := newWorkPool("test", 1, 4, 4, [numPriorityClasses]int{1, 1}, nil)
+	hold, err := pool.acquire(context.Background(), jobTicket{tenant: "a"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() {
+		_, err := pool.acquire(ctx, jobTicket{tenant: "b"}, nil)
+		gaveUp <- err
+	}()
+	waitFor(t, func() bool { _, queued := pool.stats(); return queued == 1 })
+	positions := make(chan int, 8)
+	granted := make(chan func())
+	go func() {
+		release, _ := pool.acquire(context.Background(), jobTicket{tenant: "c"}, func(p int) { positions <- p })
+		granted <- release
+	}()
+	waitFor(t, func() bool { _, queued := pool.stats(); return queued == 2 })
+	if p := <-positions; p != 2 {
+		t.Fatalf("second waiter at position %d, want 2", p)
+	}
+
+	cancel()
+	if err := <-gaveUp; err != context.Canceled {
+		t.Fatalf("cancelled waiter got %v", err)
+	}
+	if p := <-positions; p != 1 {
+		t.Errorf("waiter behind a cancelled one moved to %d, want 1", p)
+	}
+	hold()
+	(<-granted)()
+	if running, queued := pool.stats(); running != 0 || queued != 0 {
+		t.Errorf("pool has %d running and %d queued jobs, want none", running, queued)
+	}
+}
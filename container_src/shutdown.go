@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pendingDir is the reserved subdirectory of the processing directory that
+// holds jobs saved at shutdown
+const pendingDir = "pending"
+
+// pendingJob is a job that was still queued when the server shut down. It is
+// saved to disk and finished by the next process, which stores the result in
+// the cache so the client's retry is answered without redoing the work.
+type pendingJob struct {
+	ID       string         `json:"id"`
+	Tenant   string         `json:"tenant"`
+	Priority string         `json:"priority"`
+	Profile  string         `json:"profile"`
+	Preset   string         `json:"preset,omitempty"` // resolved again on resume, as the client's retry will be
+	Quality  string         `json:"quality,omitempty"`
+	CacheKey string         `json:"cache_key,omitempty"` // empty until the source has been hashed
+	Request  *FFmpegRequest `json:"request,omitempty"`   // extract jobs: the source to fetch
+	Input    string         `json:"input,omitempty"`     // a video already on disk, moved into the pending directory
+	SavedAt  time.Time      `json:"saved_at"`
+
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+var errShuttingDown = errors.New("server is shutting down")
+
+func pendingPath() string {
+	return filepath.Join(cfg.Storage.ProcessingDir, pendingDir)
+}
+
+// save writes the job to the pending directory, moving its input there so
+// the janitor does not delete it. Without a result cache a resumed job's
+// output would be unreachable, so nothing is saved.
+func (j *pendingJob) save() error {
+	if results == nil {
+		return errors.New("result cache disabled")
+	}
+	dir := pendingPath()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if j.Input != "" && filepath.Dir(j.Input) != dir {
+		kept := filepath.Join(dir, j.ID+".input"+filepath.Ext(j.Input))
+		if err := os.Rename(j.Input, kept); err != nil {
+			return fmt.Errorf("failed to keep input: %v", err)
+		}
+		j.Input = kept
+	}
+	j.SavedAt = time.Now().UTC()
+
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, j.ID+".json")
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// discard removes the saved job and its input
+func (j *pendingJob) discard() {
+	os.Remove(filepath.Join(pendingPath(), j.ID+".json"))
+	if j.Input != "" {
+		os.Remove(j.Input)
+	}
+}
+
+func (j *pendingJob) ticket() jobTicket {
+	class, _ := parsePriority(j.Priority)
+	return jobTicket{tenant: j.Tenant, class: class, resume: j}
+}
+
+// resumePendingJobs finishes the jobs saved by the previous process in the
+// background. They run through the worker pools like any other job, and
+// count as active jobs so the next shutdown waits for them too.
+func resumePendingJobs(ctx context.Context) {
+	entries, err := os.ReadDir(pendingPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Failed to read pending jobs", "error", err)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(pendingPath(), e.Name()))
+		var job pendingJob
+		if err == nil {
+			err = json.Unmarshal(data, &job)
+		}
+		if err != nil || job.ID == "" {
+			slog.Warn("Dropping unreadable pending job", "file", e.Name(), "error", err)
+			os.Remove(filepath.Join(pendingPath(), e.Name()))
+			continue
+		}
+		if results == nil {
+			slog.Warn("Dropping pending job, result cache disabled", "job_id", job.ID)
+			job.discard()
+			continue
+		}
+
+		health.activeJobs.Add(1)
+		go func() {
+			defer health.activeJobs.Add(-1)
+			jobCtx := withLogAttrs(ctx, slog.String("job_id", job.ID), slog.String("instance_id", job.Tenant))
+			slog.InfoContext(jobCtx, "Resuming job saved at shutdown", "saved_at", job.SavedAt)
+			journal.setStatus(job.ID, jobRunning)
+			if err := job.run(jobCtx); err != nil {
+				if ctx.Err() != nil || errors.Is(err, errShuttingDown) {
+					slog.InfoContext(jobCtx, "Resumed job interrupted by shutdown, keeping it", "error", err)
+					if err := job.save(); err != nil {
+						slog.WarnContext(jobCtx, "Failed to save interrupted job", "error", err)
+					}
+					journal.setStatus(job.ID, jobSuspended)
+					return
+				}
+				slog.WarnContext(jobCtx, "Resumed job failed", "error", err)
+				apiErr := asAPIError(err, codeInternal)
+				journal.fail(job.ID, jobError{Code: apiErr.Code, Message: apiErr.Message})
+				webhooks.deliver(job.ID, job.CallbackURL, FFmpegResponse{Error: apiErr.Message, Code: apiErr.Code})
+			} else {
+				slog.InfoContext(jobCtx, "Resumed job completed")
+				journal.succeed(job.ID, nil, "")
+				webhooks.deliver(job.ID, job.CallbackURL, FFmpegResponse{Success: true,
+					Message: "Job finished after a restart; repeat the request to collect the result from the cache"})
+			}
+			job.discard()
+		}()
+	}
+}
+
+// run redoes the job: it fetches the source unless the input was kept,
+// transcodes it and stores the result in the cache
+func (j *pendingJob) run(ctx context.Context) error {
+	profile, apiErr := outputProfile(j.Profile, j.Preset)
+	if apiErr != nil {
+		return apiErr
+	}
+	t := j.ticket()
+
+	if j.Input == "" {
+		if j.Request == nil {
+			return errors.New("job has neither an input nor a source")
+		}
+		if j.CacheKey == "" {
+			if id := sourceIdentity(ctx, *j.Request); id != "" {
+				j.CacheKey = cacheKey(id, profile, j.Quality)
+			}
+		}
+		if results.contains(j.CacheKey) {
+			return nil
+		}
+
+		input := filepath.Join(pendingPath(), j.ID+".input")
+		release, err := downloadPool.acquire(ctx, t, nil)
+		if err != nil {
+			return err
+		}
+		_, _, err = downloadSource(ctx, j.Request.VideoURL, j.Request.Source, input, logProgress(ctx))
+		release()
+		if err != nil {
+			os.Remove(input)
+			return fmt.Errorf("download failed: %v", err)
+		}
+		j.Input = input
+	}
+
+	if j.CacheKey == "" {
+		h, err := hashFile(j.Input)
+		if err != nil {
+			return err
+		}
+		j.CacheKey = cacheKey(h, profile, j.Quality)
+	}
+	if results.contains(j.CacheKey) {
+		return nil
+	}
+
+	output := filepath.Join(pendingPath(), j.ID+"."+profile.Extension)
+	defer os.Remove(output)
+	release, err := ffmpegPool.acquire(ctx, t, nil)
+	if err != nil {
+		return err
+	}
+	defer release()
+	ffmpegCtx, cancel := context.WithTimeout(ctx, cfg.FFmpeg.ExtractTimeout.std())
+	defer cancel()
+	if out, err := profile.runFFmpeg(ffmpegCtx, j.Input, output, j.Quality); err != nil {
+		return ffmpegError(ffmpegCtx, err, out)
+	}
+	results.put(j.CacheKey, output, profile)
+	return nil
+}
+
+func logProgress(ctx context.Context) ProgressCallback {
+	return func(stage, message string, progress float64) {
+		slog.DebugContext(withStage(ctx, stage), message, "progress", progress)
+	}
+}
+
+// waitForJobs waits until no job is active or timeout passes, reporting
+// whether every job finished
+func (h *healthState) waitForJobs(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for h.activeJobs.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		<-ticker.C
+	}
+	return true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postExtract posts body to the extraction route
+func postExtract(body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, apiVersionPrefix+"/extract-audio", strings.NewReader(body))
+	rec := httptest.NewRecorder()
+	extractRoute(strict(idempotent(trackJob(ffmpegHandler))))(rec, req)
+	return rec
+}
+
+func TestQueuedJobResumesAfterRestart(t *testing.T) {
+	tests := []struct {
+		name  string
+		pool  func() *workPool
+		input bool // whether the downloaded video is kept with the job
+	}{
+		{"queued for a download", func() *workPool { return downloadPool }, false},
+		{"queued for FFmpeg", func() *workPool { return ffmpegPool }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ffmpegRuns := setupTestEnv(t)
+			cfg.Workers.FFmpegConcurrency, cfg.Workers.DownloadConcurrency = 1, 1
+			newWorkPoolsFromConfig()
+			body := `{"video_url":"` + serveVideo(t) + `","audio_format":"mp3"}`
+
+			// a job waiting behind a busy pool when the drain closes it
+			hold, err := tt.pool().acquire(context.Background(), jobTicket{tenant: "other"}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer hold()
+			answered := make(chan *httptest.ResponseRecorder)
+			go func() { answered <- postExtract(body) }()
+			waitFor(t, func() bool {
+				_, queued := tt.pool().stats()
+				return queued > 0
+			})
+			ffmpegPool.close()
+			downloadPool.close()
+			rec := <-answered
+			jobID := rec.Header().Get("X-Job-ID")
+			var resp FFmpegResponse
+			json.Unmarshal(rec.Body.Bytes(), &resp)
+			if resp.Code != codeDraining || !strings.Contains(resp.Error, "will finish after restart") {
+				t.Fatalf("drained job answered %+v", resp)
+			}
+			if st := journal.status(jobID); st != jobSuspended {
+				t.Fatalf("drained job is %s, want suspended", st)
+			}
+			saved := filepath.Join(pendingPath(), jobID+".json")
+			if _, err := os.Stat(saved); err != nil {
+				t.Fatalf("job not saved: %v", err)
+			}
+			inputs, _ := filepath.Glob(filepath.Join(pendingPath(), jobID+".input*"))
+			if (len(inputs) == 1) != tt.input {
+				t.Errorf("pending directory holds inputs %v", inputs)
+			}
+
+			// the next process finishes the job from what was saved
+			journal.close()
+			journal = newJobJournalFromConfig()
+			results = newResultCacheFromConfig()
+			newWorkPoolsFromConfig()
+			resumePendingJobs(context.Background())
+			if !health.waitForJobs(5 * time.Second) {
+				t.Fatal("resumed job did not finish")
+			}
+			if st, _ := journal.get(jobID); st.Status != jobSucceeded {
+				t.Errorf("resumed job = %+v, want succeeded", st)
+			}
+			if left, _ := os.ReadDir(pendingPath()); len(left) != 0 {
+				t.Errorf("pending directory still holds %d files", len(left))
+			}
+			if n := ffmpegRuns(); n != 1 {
+				t.Fatalf("ffmpeg ran %d times, want once", n)
+			}
+
+			// and the client's retry collects the result from the cache
+			rec = postExtract(body)
+			var retry FFmpegResponse
+			json.Unmarshal(rec.Body.Bytes(), &retry)
+			if rec.Code != http.StatusOK || !retry.Success || !retry.CacheHit {
+				t.Errorf("retry answered %d: %+v, want a cache hit", rec.Code, retry)
+			}
+			if n := ffmpegRuns(); n != 1 {
+				t.Errorf("retry ran ffmpeg again (%d runs)", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A small OpenTelemetry-compatible tracer: spans with W3C traceparent
+// propagation, exported as OTLP/HTTP JSON when an endpoint is configured.
+
+// Span kinds as defined by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// span is one timed operation in a trace
+type span struct {
+	mu       sync.Mutex
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]any
+	errMsg   string
+	ended    bool
+}
+
+// setAttr records an attribute; values may be strings, bools, ints or floats
+func (s *span) setAttr(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs[key] = value
+}
+
+// fail marks the span as failed
+func (s *span) fail(err error) {
+	if err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = redactURLs(err.Error())
+}
+
+// finish ends the span and hands it to the exporter. Only the first call
+// counts, so a deferred finish is safe after an explicit one.
+func (s *span) finish() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.sampled {
+		tracer.export(s)
+	}
+}
+
+// traceparent renders the span as a W3C traceparent header value
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+type spanKey struct{}
+type requestTraceKey struct{}
+
+// spanFromContext returns the current span, or nil outside a trace
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanKey{}).(*span)
+	return s
+}
+
+// startSpan starts a child of the current span, or a new trace if there is none
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]any{}, sampled: true}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.traceID, s.parentID, s.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// requestTrace holds a request's server span and its currently open stage
+type requestTrace struct {
+	mu    sync.Mutex
+	root  *span
+	stage *span
+}
+
+// startStage ends the request's previous stage span and starts the next one
+// as a sibling under the request span. The stage is also attached to the
+// context's log lines.
+func startStage(ctx context.Context, stage string) context.Context {
+	ctx = withStage(ctx, stage)
+	rt, ok := ctx.Value(requestTraceKey{}).(*requestTrace)
+	if !ok {
+		return ctx
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if rt.stage != nil {
+		rt.stage.finish()
+	}
+	ctx, rt.stage = startSpan(context.WithValue(ctx, spanKey{}, rt.root), stage, spanKindInternal)
+	return ctx
+}
+
+// traceparentPattern matches version 00 of the W3C traceparent header
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// parseTraceparent returns a remote parent span for a traceparent header
+func parseTraceparent(header string) (*span, bool) {
+	m := traceparentPattern.FindStringSubmatch(strings.TrimSpace(header))
+	if m == nil || m[1] == strings.Repeat("0", 32) || m[2] == strings.Repeat("0", 16) {
+		return nil, false
+	}
+	parent := &span{ended: true}
+	hex.Decode(parent.traceID[:], []byte(m[1]))
+	hex.Decode(parent.spanID[:], []byte(m[2]))
+	flags, _ := strconv.ParseUint(m[3], 16, 8)
+	parent.sampled = flags&1 == 1
+	return parent, true
+}
+
+// injectTraceparent propagates the current span on an outgoing request
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	if s := spanFromContext(ctx); s != nil {
+		req.Header.Set("traceparent", s.traceparent())
+	}
+}
+
+// withTracing starts a server span for each request, continuing the caller's
+// trace when it sends a valid traceparent. A stage still open when the
+// request fails is marked as the failed one.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		ctx, root := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		root.setAttr("http.request.method", r.Method)
+		root.setAttr("url.path", r.URL.Path)
+
+		rt := &requestTrace{root: root}
+		ctx = context.WithValue(ctx, requestTraceKey{}, rt)
+		ctx = withLogAttrs(ctx, slog.String("trace_id", hex.EncodeToString(root.traceID[:])))
+
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			status := sw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			if r.Pattern != "" {
+				root.mu.Lock()
+				root.name = r.Pattern
+				root.mu.Unlock()
+				root.setAttr("http.route", r.Pattern)
+			}
+			root.setAttr("http.response.status_code", status)
+
+			rt.mu.Lock()
+			if rt.stage != nil {
+				if status >= 400 {
+					rt.stage.fail(fmt.Errorf("request failed with HTTP %d", status))
+				}
+				rt.stage.finish()
+			}
+			rt.mu.Unlock()
+			if status >= 500 {
+				root.fail(fmt.Errorf("HTTP %d", status))
+			}
+			root.finish()
+		}()
+		// The mux records the matched pattern on the request it is given
+		r = r.WithContext(ctx)
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// spanExporter receives finished spans
+type spanExporter interface {
+	export(s *span)
+	shutdown(ctx context.Context)
+}
+
+// noopExporter drops spans; it is used when no OTLP endpoint is configured
+type noopExporter struct{}
+
+func (noopExporter) export(*span)                 {}
+func (noopExporter) shutdown(ctx context.Context) {}
+
+// tracer is the process-wide span exporter
+var tracer spanExporter = noopExporter{}
+
+// otlpExporter batches spans and posts them as OTLP/HTTP JSON
+type otlpExporter struct {
+	endpoint    string
+	headers     map[string]string
+	serviceName string
+	client      *http.Client
+	spans       chan *span
+	stop        chan struct{} // closed by shutdown; spans is never closed
+	stopOnce    sync.Once
+	done        chan struct{}
+}
+
+// setupTracing installs an OTLP exporter when a traces endpoint or a base
+// OTLP endpoint is configured, unless the exporter is "none". The tracing
+// section maps onto the standard OTEL_* variables, so headers (k=v,k=v) and
+// the service name are honoured as well.
+func setupTracing() {
+	c := cfg.Tracing
+	if c.Exporter == "none" {
+		return
+	}
+	endpoint := c.TracesEndpoint
+	if endpoint == "" {
+		if base := c.Endpoint; base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+	if endpoint == "" {
+		return
+	}
+
+	headers := map[string]string{}
+	for _, pair := range strings.Split(c.Headers, ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	serviceName := c.ServiceName
+
+	tracer = newOTLPExporter(endpoint, headers, serviceName)
+	slog.Info("Exporting traces over OTLP", "endpoint", endpoint, "service", serviceName)
+}
+
+// newOTLPExporter starts an exporter posting to endpoint
+func newOTLPExporter(endpoint string, headers map[string]string, serviceName string) *otlpExporter {
+	e := &otlpExporter{
+		endpoint:    endpoint,
+		headers:     headers,
+		serviceName: serviceName,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *span, 2048),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// export queues a finished span. Spans finished once shutdown has begun,
+// such as those of resumed jobs or webhook retries, are dropped.
+func (e *otlpExporter) export(s *span) {
+	select {
+	case <-e.stop:
+		return
+	default:
+	}
+	select {
+	case e.spans <- s:
+	default: // drop rather than block a request when the collector is slow
+	}
+}
+
+// shutdown flushes queued spans, waiting at most until ctx is done
+func (e *otlpExporter) shutdown(ctx context.Context) {
+	e.stopOnce.Do(func() { close(e.stop) })
+	select {
+	case <-e.done:
+	case <-ctx.Done():
+	}
+}
+
+// run sends a batch every five seconds or every 256 spans, and whatever is
+// queued once shutdown begins
+func (e *otlpExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	var batch []*span
+	for {
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) >= 256 {
+				e.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			e.send(batch)
+			batch = nil
+		case <-e.stop:
+			for {
+				select {
+				case s := <-e.spans:
+					batch = append(batch, s)
+				default:
+					e.send(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []*span) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(e.payload(batch))
+	if err != nil {
+		slog.Warn("Failed to encode spans", "error", err)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Failed to create OTLP request", "error", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		slog.Warn("Failed to export spans", "spans", len(batch), "error", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		slog.Warn("OTLP collector rejected spans", "spans", len(batch), "status", resp.StatusCode)
+	}
+}
+
+// payload builds an OTLP ExportTraceServiceRequest in its JSON encoding
+func (e *otlpExporter) payload(batch []*span) map[string]any {
+	spans := make([]any, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		out := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != ([8]byte{}) {
+			out["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.errMsg != "" {
+			out["status"] = map[string]any{"code": 2, "message": s.errMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, out)
+	}
+
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": otlpAttributes(map[string]any{
+					"service.name":        e.serviceName,
+					"service.instance.id": os.Getenv("CLOUDFLARE_DURABLE_OBJECT_ID"),
+				}),
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "vegvisr-container"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP KeyValues
+func otlpAttributes(attrs map[string]any) []any {
+	out := make([]any, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]any
+		switch v := v.(type) {
+		case string:
+			value = map[string]any{"stringValue": v}
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = map[string]any{"intValue": strconv.FormatInt(v, 10)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		out = append(out, map[string]any{"key": k, "value": value})
+	}
+	return out
+}
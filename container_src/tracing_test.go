@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const traceID, spanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		name        string
+		header      string
+		wantOK      bool
+		wantSampled bool
+	}{
+		{"sampled", "00-" + traceID + "-" + spanID + "-01", true, true},
+		{"not sampled", "00-" + traceID + "-" + spanID + "-00", true, false},
+		{"other flags kept", "00-" + traceID + "-" + spanID + "-03", true, true},
+		{"surrounding space", "  00-" + traceID + "-" + spanID + "-01 ", true, true},
+		{"empty", "", false, false},
+		{"unknown version", "01-" + traceID + "-" + spanID + "-01", false, false},
+		{"uppercase hex", "00-4BF92F3577B34DA6A3CE929D0E0E4736-" + spanID + "-01", false, false},
+		{"zero trace ID", "00-00000000000000000000000000000000-" + spanID + "-01", false, false},
+		{"zero span ID", "00-" + traceID + "-0000000000000000-01", false, false},
+		{"short trace ID", "00-" + traceID[:30] + "-" + spanID + "-01", false, false},
+		{"trailing field", "00-" + traceID + "-" + spanID + "-01-extra", false, false},
+		{"not hex", "00-" + traceID[:31] + "g-" + spanID + "-01", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, ok := parseTraceparent(tt.header)
+			if ok != tt.wantOK {
+				t.Fatalf("parseTraceparent(%q) ok = %v, want %v", tt.header, ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got := hex.EncodeToString(parent.traceID[:]); got != traceID {
+				t.Errorf("trace ID %s, want %s", got, traceID)
+			}
+			if got := hex.EncodeToString(parent.spanID[:]); got != spanID {
+				t.Errorf("span ID %s, want %s", got, spanID)
+			}
+			if parent.sampled != tt.wantSampled {
+				t.Errorf("sampled = %v, want %v", parent.sampled, tt.wantSampled)
+			}
+		})
+	}
+}
+
+func TestTraceparentRoundTrip(t *testing.T) {
+	_, s := startSpan(context.Background(), "op", spanKindInternal)
+	parent, ok := parseTraceparent(s.traceparent())
+	if !ok || parent.traceID != s.traceID || parent.spanID != s.spanID || !parent.sampled {
+		t.Errorf("traceparent %q did not round-trip", s.traceparent())
+	}
+}
+
+// otlpSpan is the part of an exported OTLP span the tests check
+type otlpSpan struct {
+	TraceID      string `json:"traceId"`
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+	Kind         int    `json:"kind"`
+	Start        string `json:"startTimeUnixNano"`
+	End          string `json:"endTimeUnixNano"`
+	Attributes   []struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	} `json:"attributes"`
+	Status *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"status"`
+}
+
+// otlpCollector records the spans posted to it
+func otlpCollector(t *testing.T) (string, func() []otlpSpan) {
+	t.Helper()
+	var mu sync.Mutex
+	var spans []otlpSpan
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get("Content-Type") != "application/json" || r.Header.Get("X-Api-Key") != "secret" {
+			t.Errorf("unexpected request headers: %v", r.Header)
+		}
+		var req struct {
+			ResourceSpans []struct {
+				Resource struct {
+					Attributes []struct {
+						Key   string         `json:"key"`
+						Value map[string]any `json:"value"`
+					} `json:"attributes"`
+				} `json:"resource"`
+				ScopeSpans []struct {
+					Spans []otlpSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			t.Errorf("collector got invalid JSON: %v", err)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range req.ResourceSpans {
+			found := false
+			for _, a := range rs.Resource.Attributes {
+				found = found || (a.Key == "service.name" && a.Value["stringValue"] == "test-service")
+			}
+			if !found {
+				t.Errorf("resource lacks service.name: %+v", rs.Resource)
+			}
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []otlpSpan {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]otlpSpan(nil), spans...)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	url, collected := otlpCollector(t)
+	e := newOTLPExporter(url, map[string]string{"X-Api-Key": "secret"}, "test-service")
+	saved := tracer
+	tracer = e
+	t.Cleanup(func() { tracer = saved })
+
+	ctx, root := startSpan(context.Background(), "GET /v1/jobs/{id}", spanKindServer)
+	root.setAttr("http.response.status_code", 200)
+	_, child := startSpan(ctx, "HEAD source", spanKindClient)
+	child.setAttr("url.full", "https://example.com/v.mp4")
+	child.setAttr("retry", true)
+	child.setAttr("bytes", int64(42))
+	child.setAttr("ratio", 0.5)
+	child.fail(io.ErrUnexpectedEOF)
+	child.finish()
+	root.finish()
+
+	ctx2, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	e.shutdown(ctx2)
+
+	spans := collected()
+	if len(spans) != 2 {
+		t.Fatalf("collector got %d spans, want 2", len(spans))
+	}
+	got, parent := spans[0], spans[1]
+	if got.Name != "HEAD source" || got.Kind != spanKindClient || parent.Kind != spanKindServer {
+		t.Errorf("unexpected spans: %+v, %+v", got, parent)
+	}
+	if got.TraceID != hex.EncodeToString(root.traceID[:]) || parent.TraceID != got.TraceID {
+		t.Errorf("spans not in the root's trace")
+	}
+	if got.ParentSpanID != parent.SpanID || parent.ParentSpanID != "" {
+		t.Errorf("parent links wrong: child parent %q, root %q with parent %q", got.ParentSpanID, parent.SpanID, parent.ParentSpanID)
+	}
+	if got.Start == "" || got.End < got.Start {
+		t.Errorf("bad span times %s..%s", got.Start, got.End)
+	}
+	if got.Status == nil || got.Status.Code != 2 || got.Status.Message != io.ErrUnexpectedEOF.Error() {
+		t.Errorf("failed span status %+v", got.Status)
+	}
+
+	want := map[string]map[string]any{
+		"url.full": {"stringValue": "https://example.com/v.mp4"},
+		"retry":    {"boolValue": true},
+		"bytes":    {"intValue": "42"},
+		"ratio":    {"doubleValue": 0.5},
+	}
+	for _, a := range got.Attributes {
+		w, ok := want[a.Key]
+		if !ok {
+			t.Errorf("unexpected attribute %s", a.Key)
+			continue
+		}
+		for k, v := range w {
+			if a.Value[k] != v {
+				t.Errorf("attribute %s = %v, want %s %v", a.Key, a.Value, k, v)
+			}
+		}
+		delete(want, a.Key)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing attributes %v", want)
+	}
+}
+
+func TestOTLPExportAfterShutdown(t *testing.T) {
+	url, collected := otlpCollector(t)
+	e := newOTLPExporter(url, map[string]string{"X-Api-Key": "secret"}, "test-service")
+	e.shutdown(context.Background())
+	e.shutdown(context.Background()) // a second shutdown is harmless
+
+	// Finishing spans after shutdown must neither panic nor export them
+	for i := 0; i < 10; i++ {
+		_, s := startSpan(context.Background(), "late", spanKindInternal)
+		e.export(s)
+	}
+	<-e.done
+	if n := len(collected()); n != 0 {
+		t.Errorf("collector got %d spans after shutdown", n)
+	}
+}
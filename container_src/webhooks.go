@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery states reported in a job's callback log
+const (
+	callbackPending   = "pending"
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// jobCallback is the delivery log of a job's callback_url
+type jobCallback struct {
+	URL        string            `json:"url"` // query string redacted
+	DeliveryID string            `json:"delivery_id"`
+	Status     string            `json:"status" doc:"pending, delivered or failed"`
+	Attempts   []callbackAttempt `json:"attempts,omitempty"`
+}
+
+// callbackAttempt is one POST to the callback URL
+type callbackAttempt struct {
+	Attempt    int       `json:"attempt"`
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+}
+
+// webhookSender POSTs a job's final response to the callback_url its
+// request named. Each delivery is signed with HMAC-SHA256 so the receiver
+// can tell it came from this service, and retried with exponential backoff
+// until the receiver answers 2xx.
+type webhookSender struct {
+	client      *http.Client
+	key         []byte
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+
+	ctx    context.Context // canceled at shutdown to abandon pending retries
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// webhooks is the process-wide sender; nil when callbacks are disabled
+var webhooks *webhookSender
+
+// newWebhookSenderFromConfig signs with webhooks.signing_key. Without a key
+// callbacks are disabled and requests naming a callback_url are refused.
+func newWebhookSenderFromConfig() *webhookSender {
+	if cfg.Webhooks.SigningKey == "" {
+		slog.Info("Webhook callbacks disabled, WEBHOOK_SIGNING_KEY not set")
+		return nil
+	}
+	client := &http.Client{
+		Timeout: cfg.Webhooks.Timeout.std(),
+		// A redirect is reported as the receiver's answer, not followed
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	return newWebhookSender(client, []byte(cfg.Webhooks.SigningKey), cfg.Webhooks.MaxAttempts,
+		cfg.Webhooks.Backoff.std(), cfg.Webhooks.MaxBackoff.std())
+}
+
+// newWebhookSender creates a sender using client, which lets a test point
+// it at an httptest receiver
+func newWebhookSender(client *http.Client, key []byte, maxAttempts int, backoff, maxBackoff time.Duration) *webhookSender {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &webhookSender{
+		client:      client,
+		key:         key,
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		maxBackoff:  maxBackoff,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+// validateCallbackURL checks a callback_url from a request
+func validateCallbackURL(raw string) *apiError {
+	if raw == "" {
+		return nil
+	}
+	if webhooks == nil {
+		return newAPIError(codeInvalidRequest, "callback_url is not available: WEBHOOK_SIGNING_KEY is not set")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || len(raw) > 2048 {
+		return newAPIError(codeInvalidRequest, "callback_url must be an absolute http or https URL of at most 2048 characters")
+	}
+	return nil
+}
+
+// sign returns the X-Webhook-Signature value for body sent at ts: the
+// timestamp and the hex HMAC-SHA256 of "<timestamp>.<body>"
+func (s *webhookSender) sign(ts int64, body []byte) string {
+	mac := hmac.New(sha256.New, s.key)
+	fmt.Fprintf(mac, "%d.", ts)
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// deliver sends the response payload to callbackURL in the background, journaling every
+// attempt in the job's callback log
+func (s *webhookSender) deliver(jobID, callbackURL string, resp any) {
+	if s == nil || callbackURL == "" {
+		return
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		slog.Warn("Failed to encode webhook payload", "job_id", jobID, "error", err)
+		return
+	}
+	deliveryID := "dlv_" + newRequestID()[:16]
+	journal.startCallback(jobID, &jobCallback{URL: redactURL(callbackURL), DeliveryID: deliveryID, Status: callbackPending})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.run(jobID, deliveryID, callbackURL, body)
+	}()
+}
+
+func (s *webhookSender) run(jobID, deliveryID, callbackURL string, body []byte) {
+	log := slog.With("job_id", jobID, "delivery_id", deliveryID, "callback_url", callbackURL)
+	wait := s.backoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		status, err := s.post(jobID, deliveryID, attempt, callbackURL, body)
+		a := callbackAttempt{Attempt: attempt, At: start.UTC(), StatusCode: status, DurationMs: time.Since(start).Milliseconds()}
+		if err == nil && status/100 != 2 {
+			err = fmt.Errorf("receiver answered %d", status)
+		}
+		if err != nil {
+			a.Error = redactURLs(err.Error())
+		}
+
+		switch {
+		case err == nil:
+			webhookAttempts.inc(callbackDelivered)
+			journal.recordDelivery(jobID, a, callbackDelivered)
+			log.Info("Webhook delivered", "attempt", attempt, "status", status)
+			return
+		case attempt >= s.maxAttempts || !retryableDelivery(status):
+			webhookAttempts.inc(callbackFailed)
+			journal.recordDelivery(jobID, a, callbackFailed)
+			log.Warn("Webhook delivery failed, giving up", "attempt", attempt, "error", err)
+			return
+		}
+		webhookAttempts.inc("retry")
+		journal.recordDelivery(jobID, a, callbackPending)
+		log.Info("Webhook delivery failed, retrying", "attempt", attempt, "error", err, "retry_in", wait.String())
+
+		select {
+		case <-time.After(wait):
+		case <-s.ctx.Done():
+			journal.recordDelivery(jobID, callbackAttempt{Attempt: attempt + 1, At: time.Now().UTC(), Error: "abandoned at shutdown"}, callbackFailed)
+			log.Warn("Webhook delivery abandoned at shutdown", "attempts", attempt)
+			return
+		}
+		wait = min(2*wait, s.maxBackoff)
+	}
+}
+
+// post makes one delivery attempt, returning the receiver's status code
+func (s *webhookSender) post(jobID, deliveryID string, attempt int, callbackURL string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vegvisr-container-webhook")
+	req.Header.Set("X-Webhook-Signature", s.sign(time.Now().Unix(), body))
+	req.Header.Set("X-Webhook-ID", deliveryID)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(attempt))
+	req.Header.Set("X-Job-ID", jobID)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, nil
+}
+
+// retryableDelivery reports whether an attempt is worth repeating: network
+// errors, timeouts, rate limiting and server errors are; any other answer
+// from the receiver is final
+func retryableDelivery(status int) bool {
+	return status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+}
+
+// close abandons pending retries and waits for attempts in progress
+func (s *webhookSender) close() {
+	if s == nil {
+		return
+	}
+	s.cancel()
+	s.wg.Wait()
+}
+
+// requestCallback asks for the job's final response to be POSTed to
+// callbackURL once the handler writes it
+func requestCallback(w http.ResponseWriter, callbackURL string) {
+	if jw, ok := w.(*jobWriter); ok {
+		jw.callbackURL = callbackURL
+	}
+}
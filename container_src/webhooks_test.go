@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receivedCall is one delivery attempt as the receiver saw it
+type receivedCall struct {
+	at     time.Time
+	header http.Header
+	body   []byte
+}
+
+// webhookReceiver answers each delivery with the next status in statuses,
+// then 200, recording every call
+func webhookReceiver(t *testing.T, statuses ...int) (string, func() []receivedCall) {
+	t.Helper()
+	var mu sync.Mutex
+	var calls []receivedCall
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, receivedCall{at: time.Now(), header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(calls) <= len(statuses) {
+			status = statuses[len(calls)-1]
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/hook", func() []receivedCall {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]receivedCall(nil), calls...)
+	}
+}
+
+// deliverAndWait sends one callback for a fresh job and waits until the
+// sender gives up or succeeds, returning the job's callback log
+func deliverAndWait(t *testing.T, s *webhookSender, url string) *jobCallback {
+	t.Helper()
+	id := newJobID()
+	journal.create(context.Background(), id, apiVersionPrefix+"/extract-audio")
+	s.deliver(id, url, FFmpegResponse{Success: true, Message: "done"})
+	s.wg.Wait()
+
+	st, ok := journal.get(id)
+	if !ok || st.Callback == nil {
+		t.Fatal("no callback log journaled")
+	}
+	return st.Callback
+}
+
+func TestWebhookSignatureVerifies(t *testing.T) {
+	setupTestEnv(t)
+	key := []byte("test-signing-key")
+	url, calls := webhookReceiver(t)
+	s := newWebhookSender(http.DefaultClient, key, 3, time.Millisecond, time.Millisecond)
+	deliverAndWait(t, s, url)
+
+	got := calls()
+	if len(got) != 1 {
+		t.Fatalf("receiver got %d calls, want 1", len(got))
+	}
+	sig := got[0].header.Get("X-Webhook-Signature")
+	ts, v1, ok := strings.Cut(strings.TrimPrefix(sig, "t="), ",v1=")
+	if !ok {
+		t.Fatalf("malformed signature header %q", sig)
+	}
+	if _, err := strconv.ParseInt(ts, 10, 64); err != nil {
+		t.Fatalf("signature timestamp %q: %v", ts, err)
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s.%s", ts, got[0].body)
+	if want := hex.EncodeToString(mac.Sum(nil)); !hmac.Equal([]byte(v1), []byte(want)) {
+		t.Errorf("signature %s does not verify, want %s", v1, want)
+	}
+	if got[0].header.Get("X-Webhook-Attempt") != "1" || got[0].header.Get("X-Webhook-ID") == "" {
+		t.Errorf("missing delivery headers: %v", got[0].header)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	const backoff = 20 * time.Millisecond
+	tests := []struct {
+		name       string
+		statuses   []int // receiver answers, then 200
+		wantStatus string
+		wantCodes  []int
+	}{
+		{"server error retried", []int{500, 503}, callbackDelivered, []int{500, 503, 200}},
+		{"rate limit retried", []int{429}, callbackDelivered, []int{429, 200}},
+		{"client error final", []int{400}, callbackFailed, []int{400}},
+		{"not found final", []int{404}, callbackFailed, []int{404}},
+		{"gives up after max attempts", []int{500, 500, 500, 500}, callbackFailed, []int{500, 500, 500}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestEnv(t)
+			url, calls := webhookReceiver(t, tt.statuses...)
+			s := newWebhookSender(http.DefaultClient, []byte("k"), 3, backoff, time.Second)
+			cb := deliverAndWait(t, s, url)
+
+			got := calls()
+			if len(got) != len(tt.wantCodes) {
+				t.Fatalf("receiver got %d calls, want %d", len(got), len(tt.wantCodes))
+			}
+			// The wait doubles after each failed attempt
+			for i := 1; i < len(got); i++ {
+				if gap, want := got[i].at.Sub(got[i-1].at), backoff<<(i-1); gap < want {
+					t.Errorf("attempt %d came %v after the previous one, want at least %v", i+1, gap, want)
+				}
+				if got[i].header.Get("X-Webhook-ID") != got[0].header.Get("X-Webhook-ID") {
+					t.Errorf("attempt %d has a different delivery ID", i+1)
+				}
+			}
+
+			if cb.Status != tt.wantStatus {
+				t.Errorf("callback status %q, want %q", cb.Status, tt.wantStatus)
+			}
+			if len(cb.Attempts) != len(tt.wantCodes) {
+				t.Fatalf("journaled %d attempts, want %d", len(cb.Attempts), len(tt.wantCodes))
+			}
+			for i, a := range cb.Attempts {
+				if a.Attempt != i+1 || a.StatusCode != tt.wantCodes[i] {
+					t.Errorf("attempt %d journaled as #%d with status %d, want status %d", i+1, a.Attempt, a.StatusCode, tt.wantCodes[i])
+				}
+				if (a.Error == "") != (tt.wantCodes[i] == 200) {
+					t.Errorf("attempt %d error %q for status %d", i+1, a.Error, a.StatusCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML reads the subset of YAML a config file needs: nested mappings
+// by indentation, scalar values, quoted strings and # comments. Sequences,
+// anchors and multi-line scalars are rejected rather than misread.
+func parseYAML(data []byte) (map[string]any, error) {
+	type frame struct {
+		indent int
+		m      map[string]any
+	}
+	root := map[string]any{}
+	stack := []frame{{indent: 0, m: root}}
+	pendingKey := "" // a "key:" line whose nested mapping has not started yet
+	pendingIndent := 0
+
+	for n, line := range strings.Split(string(data), "\n") {
+		lineNo := n + 1
+		line = strings.TrimRight(stripYAMLComment(line), " \t\r")
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		if strings.Contains(line[:indent], "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", lineNo)
+		}
+
+		if pendingKey != "" {
+			parent := stack[len(stack)-1]
+			child := map[string]any{}
+			if indent > pendingIndent {
+				parent.m[pendingKey] = child
+				stack = append(stack, frame{indent: indent, m: child})
+			} else {
+				parent.m[pendingKey] = nil
+			}
+			pendingKey = ""
+		}
+		for len(stack) > 1 && indent < stack[len(stack)-1].indent {
+			stack = stack[:len(stack)-1]
+		}
+		if indent != stack[len(stack)-1].indent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", lineNo)
+		}
+
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			return nil, fmt.Errorf("line %d: sequences are not supported", lineNo)
+		}
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok || (value != "" && value[0] != ' ') {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNo)
+		}
+		key = strings.Trim(strings.TrimSpace(key), `"'`)
+		value = strings.TrimSpace(value)
+		m := stack[len(stack)-1].m
+		if _, dup := m[key]; dup {
+			return nil, fmt.Errorf("line %d: duplicate key %q", lineNo, key)
+		}
+
+		if value == "" {
+			pendingKey, pendingIndent = key, indent
+			continue
+		}
+		v, err := parseYAMLScalar(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		m[key] = v
+	}
+	if pendingKey != "" {
+		stack[len(stack)-1].m[pendingKey] = nil
+	}
+	return root, nil
+}
+
+// stripYAMLComment removes a # comment that is not inside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseYAMLScalar converts a plain or quoted scalar to a string, number,
+// boolean or nil
+func parseYAMLScalar(s string) (any, error) {
+	switch s[0] {
+	case '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		return v, nil
+	case '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return nil, fmt.Errorf("invalid quoted string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case '[', '{', '&', '*', '|', '>':
+		return nil, fmt.Errorf("unsupported YAML syntax %q", s)
+	}
+	switch s {
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	case "null", "Null", "NULL", "~":
+		return nil, nil
+	}
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}
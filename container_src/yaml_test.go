@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		want    map[string]any
+		wantErr string
+	}{
+		{
+			name: "nested mappings",
+			doc: `server:
+  port: 9000
+  timeouts:
+    drain: 30s
+limits:
+  max_upload_bytes: 524288000
+`,
+			want: map[string]any{
+				"server": map[string]any{"port": int64(9000), "timeouts": map[string]any{"drain": "30s"}},
+				"limits": map[string]any{"max_upload_bytes": int64(524288000)},
+			},
+		},
+		{
+			name: "dedent back to an outer level",
+			doc: `a:
+  b:
+    c: 1
+  d: 2
+e: 3`,
+			want: map[string]any{"a": map[string]any{"b": map[string]any{"c": int64(1)}, "d": int64(2)}, "e": int64(3)},
+		},
+		{
+			name: "comments and document marker",
+			doc: `---
+# whole-line comment
+server:   # trailing comment
+  port: 8081 # port
+  path: /a#b
+`,
+			want: map[string]any{"server": map[string]any{"port": int64(8081), "path": "/a#b"}},
+		},
+		{
+			name: "quoted scalars",
+			doc: `double: "a # not a comment"
+single: 'it''s'
+escaped: "tab\there"
+number: "8080"
+"quoted key": x`,
+			want: map[string]any{"double": "a # not a comment", "single": "it's", "escaped": "tab\there", "number": "8080", "quoted key": "x"},
+		},
+		{
+			name: "plain scalars",
+			doc: `on: true
+off: False
+none: ~
+empty:
+ratio: 0.5
+name: vegvisr-container`,
+			want: map[string]any{"on": true, "off": false, "none": nil, "empty": nil, "ratio": 0.5, "name": "vegvisr-container"},
+		},
+		{
+			name: "windows line endings",
+			doc:  "server:\r\n  port: 1\r\n",
+			want: map[string]any{"server": map[string]any{"port": int64(1)}},
+		},
+		{name: "flow mapping", doc: "server: {port: 9000}", wantErr: `line 1: unsupported YAML syntax "{port: 9000}"`},
+		{name: "flow sequence", doc: "hosts: [a, b]", wantErr: "line 1: unsupported YAML syntax"},
+		{name: "block sequence", doc: "hosts:\n  - a\n  - b", wantErr: "line 2: sequences are not supported"},
+		{name: "anchor", doc: "base: &defaults\n  port: 1", wantErr: `line 1: unsupported YAML syntax "&defaults"`},
+		{name: "alias", doc: "server: *defaults", wantErr: "line 1: unsupported YAML syntax"},
+		{name: "merge key", doc: "server:\n  <<: *defaults", wantErr: "line 2: unsupported YAML syntax"},
+		{name: "block scalar", doc: "key: |\n  text", wantErr: "line 1: unsupported YAML syntax"},
+		{name: "tab indentation", doc: "server:\n\tport: 1", wantErr: "line 2: tabs are not allowed"},
+		{name: "inconsistent indentation", doc: "a:\n    b: 1\n  c: 2", wantErr: "line 3: inconsistent indentation"},
+		{name: "duplicate key", doc: "a: 1\na: 2", wantErr: `line 2: duplicate key "a"`},
+		{name: "not a mapping", doc: "just text", wantErr: `line 1: expected "key: value"`},
+		{name: "unterminated quote", doc: `a: "open`, wantErr: "line 1: invalid quoted string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML([]byte(tt.doc))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseYAML error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML\n got %#v\nwant %#v", got, tt.want)
+			}
+		})
+	}
+}